@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/subtle"
+	"github.com/hyt-hz/gorest"
+	"github.com/hyt-hz/wxOpenID/log"
+	"golang.org/x/net/context"
+	"net/http"
+	"strings"
+)
+
+// authentication of internal callers with API keys given in
+// "Authorization: Bearer <key>" header
+type auth struct {
+	keys [][]byte
+}
+
+func newAuth(keys []string) *auth {
+	a := &auth{
+		keys: make([][]byte, 0, len(keys)),
+	}
+	for _, key := range keys {
+		if key != "" {
+			a.keys = append(a.keys, []byte(key))
+		}
+	}
+	return a
+}
+
+func (a *auth) authenticate(r *http.Request) bool {
+
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	presented := []byte(strings.TrimSpace(header[len("Bearer "):]))
+
+	for _, key := range a.keys {
+		if subtle.ConstantTimeCompare(presented, key) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *auth) AuthHttpMiddleware(handlerFunc gorest.ContextHandlerFunc) gorest.ContextHandlerFunc {
+	f := func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if !a.authenticate(r) {
+			log.Warning("Unauthorized request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		handlerFunc(ctx, w, r)
+	}
+
+	return gorest.ContextHandlerFunc(f)
+}
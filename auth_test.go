@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthHttpMiddleware(t *testing.T) {
+
+	cases := []struct {
+		keys          []string
+		authorization string
+		status        int
+	}{
+		{[]string{"key1", "key2"}, "Bearer key2", http.StatusOK},
+		{[]string{"key1", "key2"}, "", http.StatusUnauthorized},
+		{[]string{"key1", "key2"}, "Bearer key3", http.StatusUnauthorized},
+		{[]string{"key1", "key2"}, "key1", http.StatusUnauthorized},
+		{[]string{"key1", "key2"}, "Bearer ", http.StatusUnauthorized},
+		// fails closed without keys configured
+		{nil, "", http.StatusUnauthorized},
+		{nil, "Bearer ", http.StatusUnauthorized},
+		{[]string{""}, "Bearer ", http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		handler := newAuth(c.keys).AuthHttpMiddleware(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		r, _ := http.NewRequest("GET", "/wx/token", nil)
+		if c.authorization != "" {
+			r.Header.Set("Authorization", c.authorization)
+		}
+		w := httptest.NewRecorder()
+		handler(nil, w, r)
+		if !assert.Equal(t, c.status, w.Code, c.authorization) {
+			return
+		}
+	}
+}
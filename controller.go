@@ -1,26 +1,105 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"github.com/hyt-hz/gorest"
+	"github.com/hyt-hz/wxOpenID/log"
 	"github.com/hyt-hz/wxOpenID/service"
+	"github.com/hyt-hz/wxOpenID/wxcrypt"
 	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
+)
+
+// messages pushed by WeChat are small XML documents
+const maxMessageSize = 1 << 20
+
+var (
+	errReturnURLNotAllowed = errors.New("Return URL not allowed")
+	errPageURLNotAllowed   = errors.New("Page URL not in JS safe domains")
 )
 
 type controller struct {
-	wxs *service.WXService
+	wxs           *service.WXService
+	auth          *auth
+	returnHosts   map[string]bool
+	jsSafeDomains map[string]bool
 }
 
-func NewController(hbgroup *gorest.Group, wxs *service.WXService) (c *controller, err error) {
+func NewController(hbgroup *gorest.Group, wxs *service.WXService, option *Option) (c *controller, err error) {
 
 	c = &controller{
-		wxs: wxs,
+		wxs:           wxs,
+		auth:          newAuth(option.APIKeys),
+		returnHosts:   make(map[string]bool),
+		jsSafeDomains: make(map[string]bool),
+	}
+	for _, host := range option.OAuthReturnHosts {
+		c.returnHosts[strings.ToLower(host)] = true
+	}
+	for _, domain := range option.JSSafeDomains {
+		c.jsSafeDomains[strings.ToLower(domain)] = true
 	}
 
 	// register HTTP middlewares and handlers
-	//g.Use(cm.auth.AuthUserHttpMiddleware)
-
 	hbgroup.Get("/validateServer", c.validateServer)
+	hbgroup.Post("/validateServer", c.receiveMessage)
+	hbgroup.Get("/oauth/authorize", c.oauthAuthorize)
+	hbgroup.Get("/oauth/callback", c.oauthCallback)
+	hbgroup.Get("/oauth/ticket", c.oauthTicket)
+	hbgroup.Get("/oauth/userinfo", c.oauthUserInfo)
+	hbgroup.Post("/miniprogram/login", c.miniProgramLogin)
+	hbgroup.Post("/miniprogram/decrypt", c.miniProgramDecrypt)
+	hbgroup.Get("/jssdk/config", c.jssdkConfig)
+
+	// APIs for internal services
+	tokenGroup := hbgroup.NewGroup("/token")
+	tokenGroup.Use(c.auth.AuthHttpMiddleware)
+	tokenGroup.Get("", c.getToken)
+	tokenGroup.Post("/refresh", c.refreshToken)
+	tokenGroup.Get("/metrics", c.tokenMetrics)
+
+	webhookGroup := hbgroup.NewGroup("/webhooks")
+	webhookGroup.Use(c.auth.AuthHttpMiddleware)
+	webhookGroup.Get("/dead-letters", c.webhookDeadLetters)
+	webhookGroup.Post("/dead-letters/:id/retry", c.retryWebhookDelivery)
+
+	userGroup := hbgroup.NewGroup("/users")
+	userGroup.Use(c.auth.AuthHttpMiddleware)
+	userGroup.Get("/:openid", c.getFollower)
+
+	syncGroup := hbgroup.NewGroup("/follower-sync")
+	syncGroup.Use(c.auth.AuthHttpMiddleware)
+	syncGroup.Get("", c.followerSyncProgress)
+	syncGroup.Post("", c.startFollowerSync)
+
+	messageGroup := hbgroup.NewGroup("/messages")
+	messageGroup.Use(c.auth.AuthHttpMiddleware)
+	messageGroup.Post("/template", c.sendTemplateMessage)
+	messageGroup.Get("/template/:msgid", c.getTemplateDelivery)
+	messageGroup.Post("/custom", c.sendCustomMessage)
+	messageGroup.Post("/custom/typing", c.setTyping)
+
+	subscribeGroup := hbgroup.NewGroup("/miniprogram/subscribe-messages")
+	subscribeGroup.Use(c.auth.AuthHttpMiddleware)
+	subscribeGroup.Post("", c.sendSubscribeMessage)
+
+	massGroup := hbgroup.NewGroup("/mass")
+	massGroup.Use(c.auth.AuthHttpMiddleware)
+	massGroup.Post("/jobs", c.startMassJob)
+	massGroup.Get("/jobs", c.listMassJobs)
+	massGroup.Get("/jobs/:id", c.getMassJob)
+	massGroup.Delete("/jobs/:id", c.deleteMassJob)
+	massGroup.Post("/preview", c.previewMassMessage)
+
+	menuGroup := hbgroup.NewGroup("/menu")
+	menuGroup.Use(c.auth.AuthHttpMiddleware)
+	menuGroup.Get("", c.getMenu)
+	menuGroup.Post("/apply", c.applyMenu)
 
 	return
 }
@@ -37,7 +116,322 @@ func (c *controller) validateServer(ctx context.Context, w http.ResponseWriter,
 		return
 	}
 
-	c.wxs.ValidateServer(nil)
+	if err := c.wxs.ValidateServer(ctx, signature, timestamp, nonce); err != nil {
+		log.Warning("Failed to validate server request from %s: %s", r.RemoteAddr, err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
 	w.Write([]byte(echostr))
 	return
 }
+
+// messages and events pushed by WeChat, posted to the same URL as server
+// validation
+func (c *controller) receiveMessage(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	signature := r.FormValue("signature")
+	timestamp := r.FormValue("timestamp")
+	nonce := r.FormValue("nonce")
+
+	if err := c.wxs.ValidateServer(ctx, signature, timestamp, nonce); err != nil {
+		log.Warning("Failed to validate message from %s: %s", r.RemoteAddr, err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxMessageSize))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	req := &service.PushRequest{
+		Timestamp:    timestamp,
+		Nonce:        nonce,
+		EncryptType:  r.FormValue("encrypt_type"),
+		MsgSignature: r.FormValue("msg_signature"),
+		Body:         body,
+	}
+	reply, err := c.wxs.HandleMessage(ctx, req)
+	if err != nil {
+		log.Warning("Failed to handle message from %s: %s", r.RemoteAddr, err)
+		if err == wxcrypt.ErrInvalidSignature || err == wxcrypt.ErrAppIDMismatch {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		} else {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		}
+		return
+	}
+
+	if reply != nil {
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(reply)
+		return
+	}
+
+	// tell WeChat the message is received, so it won't retry
+	w.Write([]byte("success"))
+}
+
+// start web authorization, browser is redirected to WeChat and comes back to
+// return_to with OpenID ticket after the authorization
+func (c *controller) oauthAuthorize(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	returnTo := r.FormValue("return_to")
+	scope := r.FormValue("scope")
+	if scope == "" {
+		scope = service.ScopeBase
+	}
+
+	if !c.returnURLAllowed(returnTo) {
+		errHTTPJson(w, r, http.StatusBadRequest, errReturnURLNotAllowed)
+		return
+	}
+
+	state, err := c.wxs.NewOAuthState(returnTo)
+	if err != nil {
+		errHTTPJson(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	authorizeURL, err := c.wxs.AuthorizeURL(scope, state)
+	if err != nil {
+		if err == service.ErrInvalidScope {
+			errHTTPJson(w, r, http.StatusBadRequest, err)
+		} else {
+			errHTTPJson(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	http.Redirect(w, r, authorizeURL, http.StatusFound)
+}
+
+// redirect target of web authorization, exchange the code for user's OpenID
+// and redirect browser to the return URL of state with a signed ticket of the
+// OpenID, plain OpenID in URL could be forged by anyone
+func (c *controller) oauthCallback(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	// no code is given if user denied the authorization
+	code := r.FormValue("code")
+	state := r.FormValue("state")
+	if code == "" || state == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	returnTo, err := c.wxs.VerifyOAuthState(state)
+	if err != nil {
+		errHTTPJson(w, r, http.StatusForbidden, err)
+		return
+	}
+	// allow-list may have changed since the state was created
+	if !c.returnURLAllowed(returnTo) {
+		errHTTPJson(w, r, http.StatusForbidden, errReturnURLNotAllowed)
+		return
+	}
+
+	token, err := c.wxs.ExchangeCode(ctx, code)
+	if err != nil {
+		if service.IsWXError(err, service.ECInvalidCode, service.ECCodeUsed) {
+			errHTTPJson(w, r, http.StatusBadRequest, err)
+		} else {
+			errHTTPJson(w, r, http.StatusBadGateway, err)
+		}
+		return
+	}
+
+	ticket, err := c.wxs.NewOpenIDTicket(token.OpenID)
+	if err != nil {
+		errHTTPJson(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	u, _ := url.Parse(returnTo)
+	q := u.Query()
+	q.Set("ticket", ticket)
+	u.RawQuery = q.Encode()
+
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func ticketErrHTTP(w http.ResponseWriter, r *http.Request, err error) {
+	if err == service.ErrInvalidTicket || err == service.ErrTicketExpired {
+		errHTTPJson(w, r, http.StatusForbidden, err)
+	} else {
+		errHTTPJson(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+// OpenID carried in ticket handed to return URL of web authorization
+func (c *controller) oauthTicket(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	openID, err := c.wxs.VerifyOpenIDTicket(r.FormValue("ticket"))
+	if err != nil {
+		ticketErrHTTP(w, r, err)
+		return
+	}
+
+	gorest.WriteJsonResponse(w, map[string]string{"openid": openID})
+}
+
+// profile of user authorized with snsapi_userinfo scope, the user must prove
+// the OpenID with ticket got from web authorization, as the profile is
+// personal and fetching it may spend the user's refresh token
+func (c *controller) oauthUserInfo(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	openID, err := c.wxs.VerifyOpenIDTicket(r.FormValue("ticket"))
+	if err != nil {
+		ticketErrHTTP(w, r, err)
+		return
+	}
+
+	info, err := c.wxs.GetUserInfo(ctx, openID, r.FormValue("lang"))
+	if err != nil {
+		switch err {
+		case service.ErrUserTokenNotFound:
+			errHTTPJson(w, r, http.StatusNotFound, err)
+		case service.ErrScopeNotAuthorized, service.ErrReauthorizeRequired:
+			errHTTPJson(w, r, http.StatusForbidden, err)
+		default:
+			errHTTPJson(w, r, http.StatusBadGateway, err)
+		}
+		return
+	}
+
+	gorest.WriteJsonResponse(w, info)
+}
+
+// login of mini-program with code got from wx.login, session_key is kept on
+// server side and an opaque session ID is returned instead
+func (c *controller) miniProgramLogin(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	req := struct {
+		AppID string `json:"appid"`
+		Code  string `json:"code"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.AppID == "" || req.Code == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	session, err := c.wxs.Code2Session(ctx, req.AppID, req.Code)
+	if err != nil {
+		if err == service.ErrUnknownMiniProgram || service.IsWXError(err, service.ECInvalidCode, service.ECCodeUsed) {
+			errHTTPJson(w, r, http.StatusBadRequest, err)
+		} else {
+			errHTTPJson(w, r, http.StatusBadGateway, err)
+		}
+		return
+	}
+
+	gorest.WriteJsonResponse(w, map[string]string{
+		"session_id": session.ID,
+		"openid":     session.OpenID,
+		"unionid":    session.UnionID,
+	})
+}
+
+// decrypt encryptedData got from mini-program with session_key of the session,
+// rawData signature is verified as well if given
+func (c *controller) miniProgramDecrypt(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	req := struct {
+		SessionID     string `json:"session_id"`
+		EncryptedData string `json:"encrypted_data"`
+		IV            string `json:"iv"`
+		RawData       string `json:"raw_data"`
+		Signature     string `json:"signature"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil ||
+		req.SessionID == "" || req.EncryptedData == "" || req.IV == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if req.RawData != "" {
+		if err := c.wxs.VerifyMiniProgramRawData(req.SessionID, req.RawData, req.Signature); err != nil {
+			if err == service.ErrSessionNotFound {
+				errHTTPJson(w, r, http.StatusUnauthorized, err)
+			} else {
+				errHTTPJson(w, r, http.StatusForbidden, err)
+			}
+			return
+		}
+	}
+
+	data, err := c.wxs.DecryptMiniProgramData(req.SessionID, req.EncryptedData, req.IV)
+	if err != nil {
+		switch err {
+		case service.ErrSessionNotFound:
+			errHTTPJson(w, r, http.StatusUnauthorized, err)
+		case service.ErrWatermarkMismatch, service.ErrWatermarkExpired:
+			errHTTPJson(w, r, http.StatusForbidden, err)
+		default:
+			errHTTPJson(w, r, http.StatusBadRequest, err)
+		}
+		return
+	}
+
+	gorest.WriteJsonResponse(w, data)
+}
+
+// parameters of wx.config for H5 page at url
+func (c *controller) jssdkConfig(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	pageURL := r.FormValue("url")
+	u, err := url.Parse(pageURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if !c.jsSafeDomains[strings.ToLower(u.Hostname())] {
+		errHTTPJson(w, r, http.StatusForbidden, errPageURLNotAllowed)
+		return
+	}
+
+	config, err := c.wxs.JSSDKConfig(ctx, pageURL)
+	if err != nil {
+		errHTTPJson(w, r, http.StatusBadGateway, err)
+		return
+	}
+
+	gorest.WriteJsonResponse(w, config)
+}
+
+// only absolute http(s) URLs on allowed hosts can be used as return URL
+func (c *controller) returnURLAllowed(returnTo string) bool {
+
+	u, err := url.Parse(returnTo)
+	if err != nil {
+		return false
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+
+	return c.returnHosts[strings.ToLower(u.Hostname())]
+}
+
+// write error as JSON like gorest.ErrHTTPErrJson, but with HTTP status code,
+// errcode/errmsg of WeChat errors are passed through
+func errHTTPJson(w http.ResponseWriter, r *http.Request, status int, err error) {
+
+	var restErr *gorest.RestErr
+	switch e := err.(type) {
+	case *gorest.RestErr:
+		restErr = e
+	case *service.WXError:
+		restErr = &gorest.RestErr{ErrCode: e.ErrCode, ErrMSG: e.ErrMsg}
+	default:
+		restErr = &gorest.RestErr{ErrCode: gorest.ECNonRestErr, ErrMSG: err.Error()}
+	}
+
+	log.Warning("%s %s: %s", r.Method, r.URL.Path, restErr)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(restErr); err != nil {
+		log.Error("Failed to encode error response: %s", err)
+	}
+}
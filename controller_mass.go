@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/hyt-hz/gorest"
+	"github.com/hyt-hz/wxOpenID/service"
+	"golang.org/x/net/context"
+	"net/http"
+)
+
+func massErrHTTP(w http.ResponseWriter, r *http.Request, err error) {
+	if _, ok := err.(service.MassMessageError); ok || err == service.ErrNoMassRecipients ||
+		service.IsWXError(err, service.ECInvalidOpenID, service.ECUserNotSubscribed) {
+		errHTTPJson(w, r, http.StatusBadRequest, err)
+	} else if err == service.ErrMassJobNotFound {
+		errHTTPJson(w, r, http.StatusNotFound, err)
+	} else {
+		errHTTPJson(w, r, http.StatusBadGateway, err)
+	}
+}
+
+// mass job in response, without OpenIDs of recipients which can be many
+// and are of no use to caller
+func massJobView(job *service.MassJob) *service.MassJob {
+	view := *job
+	view.OpenIDs = nil
+	return &view
+}
+
+// start mass job to OpenIDs, a tag or all followers, sent in background
+func (c *controller) startMassJob(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	req := struct {
+		ToUser  []string `json:"touser"`
+		TagID   int64    `json:"tag_id"`
+		IsToAll bool     `json:"is_to_all"`
+		service.MassMessage
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	job, err := c.wxs.StartMassJob(&req.MassMessage, req.ToUser, req.TagID, req.IsToAll)
+	if err != nil {
+		massErrHTTP(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(massJobView(job))
+}
+
+func (c *controller) listMassJobs(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	jobs, err := c.wxs.ListMassJobs()
+	if err != nil {
+		errHTTPJson(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	views := make([]*service.MassJob, len(jobs))
+	for i, job := range jobs {
+		views[i] = massJobView(job)
+	}
+	gorest.WriteJsonResponse(w, views)
+}
+
+// state of mass job with results of its batches
+func (c *controller) getMassJob(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	params, _ := gorest.GetParams(ctx)
+	job, err := c.wxs.GetMassJob(params.ByName("id"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == service.ErrMassJobNotFound {
+			status = http.StatusNotFound
+		}
+		errHTTPJson(w, r, status, err)
+		return
+	}
+
+	gorest.WriteJsonResponse(w, massJobView(job))
+}
+
+// delete articles sent by mass job
+func (c *controller) deleteMassJob(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	params, _ := gorest.GetParams(ctx)
+	job, err := c.wxs.DeleteMassJob(ctx, params.ByName("id"))
+	if err != nil {
+		massErrHTTP(w, r, err)
+		return
+	}
+
+	gorest.WriteJsonResponse(w, massJobView(job))
+}
+
+// send mass message to a follower to check it before the mass job
+func (c *controller) previewMassMessage(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	req := struct {
+		ToUser string `json:"touser"`
+		service.MassMessage
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.wxs.PreviewMassMessage(ctx, req.ToUser, &req.MassMessage); err != nil {
+		massErrHTTP(w, r, err)
+		return
+	}
+
+	gorest.WriteJsonResponse(w, map[string]string{})
+}
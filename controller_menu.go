@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/hyt-hz/gorest"
+	"github.com/hyt-hz/wxOpenID/service"
+	"golang.org/x/net/context"
+	"net/http"
+)
+
+// menus in effect, the default one and conditional ones
+func (c *controller) getMenu(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	menu, err := c.wxs.GetCurrentMenu(ctx)
+	if err != nil {
+		errHTTPJson(w, r, http.StatusBadGateway, err)
+		return
+	}
+	conditional, err := c.wxs.GetConditionalMenus(ctx)
+	if err != nil {
+		errHTTPJson(w, r, http.StatusBadGateway, err)
+		return
+	}
+
+	gorest.WriteJsonResponse(w, map[string]interface{}{
+		"menu":            menu,
+		"conditionalmenu": conditional,
+	})
+}
+
+// reload menu file and apply it if changed
+func (c *controller) applyMenu(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	changed, err := c.wxs.ApplyMenuFile(ctx)
+	if err != nil {
+		if _, ok := err.(service.MenuError); ok || err == service.ErrMenuFileNotConfigured {
+			errHTTPJson(w, r, http.StatusBadRequest, err)
+		} else {
+			errHTTPJson(w, r, http.StatusBadGateway, err)
+		}
+		return
+	}
+
+	gorest.WriteJsonResponse(w, map[string]bool{"changed": changed})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/hyt-hz/gorest"
+	"github.com/hyt-hz/wxOpenID/service"
+	"golang.org/x/net/context"
+	"net/http"
+	"strconv"
+)
+
+// send template message on behalf of internal services
+func (c *controller) sendTemplateMessage(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	req := struct {
+		ToUser      string                          `json:"touser"`
+		TemplateID  string                          `json:"template_id"`
+		URL         string                          `json:"url"`
+		MiniProgram *service.TemplateMiniProgram    `json:"miniprogram"`
+		Data        map[string]service.TemplateData `json:"data"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil ||
+		req.ToUser == "" || req.TemplateID == "" || (req.MiniProgram != nil && req.MiniProgram.AppID == "") {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	msgID, err := c.wxs.SendTemplateMessage(ctx, req.ToUser, req.TemplateID, req.URL, req.MiniProgram, req.Data)
+	if err != nil {
+		if service.IsWXError(err, service.ECInvalidOpenID, service.ECInvalidTemplateID, service.ECUserNotSubscribed) {
+			errHTTPJson(w, r, http.StatusBadRequest, err)
+		} else {
+			errHTTPJson(w, r, http.StatusBadGateway, err)
+		}
+		return
+	}
+
+	gorest.WriteJsonResponse(w, map[string]int64{"msgid": msgID})
+}
+
+// delivery status of template message
+func (c *controller) getTemplateDelivery(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	params, _ := gorest.GetParams(ctx)
+	msgID, err := strconv.ParseInt(params.ByName("msgid"), 10, 64)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	delivery, err := c.wxs.GetTemplateDelivery(msgID)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == service.ErrTemplateDeliveryNotFound {
+			status = http.StatusNotFound
+		}
+		errHTTPJson(w, r, status, err)
+		return
+	}
+
+	gorest.WriteJsonResponse(w, delivery)
+}
+
+// send subscribe message of mini-program on behalf of internal services,
+// data not matching the template declared is rejected before sending
+func (c *controller) sendSubscribeMessage(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	req := struct {
+		AppID string `json:"appid"`
+		service.SubscribeMessage
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.AppID == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	err := c.wxs.SendSubscribeMessage(ctx, req.AppID, &req.SubscribeMessage)
+	if err != nil {
+		_, invalidData := err.(*service.SubscribeDataError)
+		if invalidData || err == service.ErrUnknownMiniProgram || err == service.ErrUnknownSubscribeTemplate ||
+			err == service.ErrInvalidMiniProgramState || err == service.ErrMissingRecipient ||
+			service.IsWXError(err, service.ECInvalidOpenID, service.ECInvalidTemplateID,
+				service.ECSubscribeRefused, service.ECInvalidTemplateParams) {
+			errHTTPJson(w, r, http.StatusBadRequest, err)
+		} else {
+			errHTTPJson(w, r, http.StatusBadGateway, err)
+		}
+		return
+	}
+
+	gorest.WriteJsonResponse(w, map[string]string{})
+}
+
+func customMessageErrHTTP(w http.ResponseWriter, r *http.Request, err error) {
+	if _, ok := err.(service.CustomMessageError); ok || err == service.ErrOutOfResponseWindow ||
+		service.IsWXError(err, service.ECInvalidOpenID, service.ECUserNotSubscribed) {
+		errHTTPJson(w, r, http.StatusBadRequest, err)
+	} else {
+		errHTTPJson(w, r, http.StatusBadGateway, err)
+	}
+}
+
+// send customer service message on behalf of internal services, in the
+// format of cgi-bin/message/custom/send
+func (c *controller) sendCustomMessage(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	msg := &service.CustomMessage{}
+	if err := json.NewDecoder(r.Body).Decode(msg); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.wxs.SendCustomMessage(ctx, msg); err != nil {
+		customMessageErrHTTP(w, r, err)
+		return
+	}
+
+	gorest.WriteJsonResponse(w, map[string]string{})
+}
+
+// show or cancel typing indicator in conversation with follower
+func (c *controller) setTyping(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	req := struct {
+		ToUser string `json:"touser"`
+		Typing bool   `json:"typing"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.wxs.SetTyping(ctx, req.ToUser, req.Typing); err != nil {
+		customMessageErrHTTP(w, r, err)
+		return
+	}
+
+	gorest.WriteJsonResponse(w, map[string]string{})
+}
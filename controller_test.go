@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestReturnURLAllowed(t *testing.T) {
+
+	ctl := &controller{
+		returnHosts: map[string]bool{"m.example.com": true},
+	}
+
+	cases := []struct {
+		returnTo string
+		allowed  bool
+	}{
+		{"https://m.example.com/", true},
+		{"http://m.example.com/a?b=c#d", true},
+		{"https://M.Example.com:8443/", true},
+		{"https://evil.com/", false},
+		{"https://m.example.com.evil.com/", false},
+		{"https://evil.com/?m.example.com", false},
+		{"https://m.example.com@evil.com/", false},
+		{"//m.example.com/", false},
+		{"/relative", false},
+		{"javascript://m.example.com/%0aalert(1)", false},
+		{"ftp://m.example.com/", false},
+		{"", false},
+		{"https://[::1", false},
+	}
+
+	for _, c := range cases {
+		if !assert.Equal(t, c.allowed, ctl.returnURLAllowed(c.returnTo), c.returnTo) {
+			return
+		}
+	}
+}
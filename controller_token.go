@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/hyt-hz/gorest"
+	"github.com/hyt-hz/wxOpenID/service"
+	"golang.org/x/net/context"
+	"net/http"
+	"time"
+)
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+func writeTokenResponse(w http.ResponseWriter, token string, expiresAt time.Time) {
+	gorest.WriteJsonResponse(w, &tokenResponse{
+		AccessToken: token,
+		ExpiresIn:   int(expiresAt.Sub(time.Now()).Seconds()),
+	})
+}
+
+// access_token shared with internal services, so that only we refresh it
+func (c *controller) getToken(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	token, err := c.wxs.AccessTokenManager().Get(ctx)
+	if err != nil {
+		errHTTPJson(w, r, http.StatusBadGateway, err)
+		return
+	}
+
+	writeTokenResponse(w, token.Value, token.ExpiresAt)
+}
+
+// caller found the access_token invalid, refresh it only if it's still the
+// cached one, otherwise the cached token is already newer
+func (c *controller) refreshToken(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	req := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.AccessToken == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	token, err := c.wxs.AccessTokenManager().RefreshIfStale(ctx, req.AccessToken)
+	if err != nil {
+		errHTTPJson(w, r, http.StatusBadGateway, err)
+		return
+	}
+
+	writeTokenResponse(w, token.Value, token.ExpiresAt)
+}
+
+// metrics of access_token, for internal monitoring only
+func (c *controller) tokenMetrics(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	gorest.WriteJsonResponse(w, map[string]int64{
+		"access_token_retries": service.AccessTokenRetries(),
+	})
+}
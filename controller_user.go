@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/hyt-hz/gorest"
+	"github.com/hyt-hz/wxOpenID/service"
+	"golang.org/x/net/context"
+	"net/http"
+)
+
+// subscription state of a user of the Official Account
+func (c *controller) getFollower(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	params, _ := gorest.GetParams(ctx)
+	follower, err := c.wxs.GetFollower(params.ByName("openid"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == service.ErrFollowerNotFound {
+			status = http.StatusNotFound
+		}
+		errHTTPJson(w, r, status, err)
+		return
+	}
+
+	gorest.WriteJsonResponse(w, follower)
+}
+
+// progress of the running or the last follower synchronization
+func (c *controller) followerSyncProgress(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	gorest.WriteJsonResponse(w, c.wxs.FollowerSyncProgress())
+}
+
+// start follower synchronization in background, its progress is returned
+func (c *controller) startFollowerSync(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	if err := c.wxs.StartFollowerSync(); err != nil {
+		status := http.StatusInternalServerError
+		if err == service.ErrFollowerSyncRunning {
+			status = http.StatusConflict
+		}
+		errHTTPJson(w, r, status, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(c.wxs.FollowerSyncProgress())
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/hyt-hz/gorest"
+	"github.com/hyt-hz/wxOpenID/service"
+	"golang.org/x/net/context"
+	"net/http"
+)
+
+// webhook deliveries failed too many times
+func (c *controller) webhookDeadLetters(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	deliveries, err := c.wxs.Webhooks().DeadLetters()
+	if err != nil {
+		errHTTPJson(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	gorest.WriteJsonResponse(w, deliveries)
+}
+
+// deliver a dead letter again, e.g. after the webhook is fixed
+func (c *controller) retryWebhookDelivery(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	params, _ := gorest.GetParams(ctx)
+	delivery, err := c.wxs.Webhooks().Retry(params.ByName("id"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == service.ErrDeliveryNotFound {
+			status = http.StatusNotFound
+		} else if err == service.ErrWebhookNotConfigured {
+			status = http.StatusConflict
+		}
+		errHTTPJson(w, r, status, err)
+		return
+	}
+
+	gorest.WriteJsonResponse(w, delivery)
+}
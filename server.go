@@ -1,18 +1,48 @@
 package main
 
 import (
+	"fmt"
 	"github.com/hyt-hz/gorest"
 	"github.com/hyt-hz/wxOpenID/log"
 	"github.com/hyt-hz/wxOpenID/service"
+	"github.com/hyt-hz/wxOpenID/wxcrypt"
+	"golang.org/x/net/context"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
+// requests in progress are waited for this long on shutdown
+const shutdownTimeout = 10 * time.Second
+
 type Option struct {
 	Listen string
+	// API keys of internal services
+	APIKeys []string `yaml:"api_keys"`
+	// hosts allowed in return URL of web authorization
+	OAuthReturnHosts []string `yaml:"oauth_return_hosts"`
+	// JS safe domains configured in MP console, JS-SDK config is signed only
+	// for pages on these domains
+	JSSafeDomains []string       `yaml:"js_safe_domains"`
+	WX            service.Option `yaml:"wx"`
+}
+
+// options with secrets redacted, for logging
+func (o Option) String() string {
+	type option Option
+	c := option(o)
+	c.APIKeys = make([]string, len(o.APIKeys))
+	for i, key := range o.APIKeys {
+		c.APIKeys[i] = service.RedactSecret(key)
+	}
+	return fmt.Sprintf("%+v", c)
 }
 
 type server struct {
 	option Option
+	wxs    *service.WXService
 }
 
 var APIPrefix = "/wx"
@@ -28,11 +58,78 @@ func NewServer(option *Option) (s *server, err error) {
 	r.Use(gorest.RecoveryHttpMiddleware)
 	r.Use(gorest.CORSMiddleware)
 
-	hbs := service.NewWXService()
+	hbs, err := service.NewWXService(&s.option.WX)
+	if err != nil {
+		return nil, err
+	}
+	if s.option.WX.UserTokenFile != "" {
+		store, err := service.NewFileUserTokenStore(s.option.WX.UserTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		hbs.SetUserTokenStore(store)
+	}
+	if s.option.WX.Redis.Addr != "" {
+		hbs.SetTokenStore(service.NewRedisTokenStore(&s.option.WX.Redis))
+		hbs.SetLocker(service.NewRedisLocker(&s.option.WX.Redis))
+		hbs.SetDedupStore(service.NewRedisDedupStore(&s.option.WX.Redis, s.option.WX.DedupTTL))
+		hbs.SetOAuthStateStore(service.NewRedisOAuthStateStore(&s.option.WX.Redis))
+	} else if s.option.WX.TokenFile != "" {
+		store, err := service.NewFileTokenStore(s.option.WX.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		hbs.SetTokenStore(store)
+		if s.option.WX.LockDir != "" {
+			locker, err := service.NewFileLocker(s.option.WX.LockDir)
+			if err != nil {
+				return nil, err
+			}
+			hbs.SetLocker(locker)
+			store.SetLocker(locker)
+		}
+	}
+	if s.option.WX.FollowerFile != "" {
+		store, err := service.NewFileFollowerStore(s.option.WX.FollowerFile)
+		if err != nil {
+			return nil, err
+		}
+		hbs.SetFollowerStore(store)
+	}
+	if s.option.WX.TemplateDeliveryFile != "" {
+		store, err := service.NewFileTemplateDeliveryStore(s.option.WX.TemplateDeliveryFile)
+		if err != nil {
+			return nil, err
+		}
+		hbs.SetTemplateDeliveryStore(store)
+	}
+	if s.option.WX.MassJobFile != "" {
+		store, err := service.NewFileMassJobStore(s.option.WX.MassJobFile)
+		if err != nil {
+			return nil, err
+		}
+		hbs.SetMassJobStore(store)
+	}
+	if s.option.WX.WebhookQueueDir != "" {
+		queue, err := service.NewFileWebhookQueue(s.option.WX.WebhookQueueDir)
+		if err != nil {
+			return nil, err
+		}
+		hbs.Webhooks().SetQueue(queue)
+	}
+	if s.option.WX.EncodingAESKey != "" {
+		crypter, err := wxcrypt.NewCrypter(s.option.WX.Token, s.option.WX.EncodingAESKey, s.option.WX.AppID)
+		if err != nil {
+			return nil, err
+		}
+		hbs.SetCrypter(crypter)
+	}
+	hbs.Start()
+	s.wxs = hbs
 
 	// hongbao manager related API
 	hongbaoGroup := r.NewGroup(APIPrefix)
-	NewController(hongbaoGroup, hbs)
+	NewController(hongbaoGroup, hbs, &s.option)
 
 	router := gorest.BindHttprouter(r)
 
@@ -41,13 +138,35 @@ func NewServer(option *Option) (s *server, err error) {
 	return
 }
 
+// serve until SIGINT or SIGTERM, background jobs are stopped and what file
+// stores are saving is written before it returns
 func (s *server) Run() error {
 
+	hs := &http.Server{Addr: s.option.Listen}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigCh
+		log.Info("Shutting down on %s", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := hs.Shutdown(ctx); err != nil {
+			log.Error("Shutdown: %v", err)
+		}
+	}()
+
 	log.Info("Start to listen on %s", s.option.Listen)
-	err := http.ListenAndServe(s.option.Listen, nil)
-	if err != nil {
+	err := hs.ListenAndServe()
+	if err == http.ErrServerClosed {
+		<-stopped
+		err = nil
+	} else if err != nil {
 		log.Error("ListenAndServe: %v", err)
 	}
 
+	s.wxs.Stop()
 	return err
 }
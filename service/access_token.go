@@ -0,0 +1,127 @@
+package service
+
+import (
+	"github.com/hyt-hz/wxOpenID/httpclient"
+	"github.com/hyt-hz/wxOpenID/log"
+	"golang.org/x/net/context"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// how many times WeChat API calls were replayed with refreshed access_token
+var accessTokenRetries int64
+
+// number of WeChat API calls replayed with refreshed access_token since start
+func AccessTokenRetries() int64 {
+	return atomic.LoadInt64(&accessTokenRetries)
+}
+
+const (
+	DefaultAccessTokenRefreshMargin = 5 * time.Minute
+)
+
+// manager of access_token of an Official Account or mini-program, the token
+// is cached and refreshed in background before it expires, as WeChat limits
+// how many times it can be fetched every day
+type AccessTokenManager struct {
+	*tokenCache
+	appID     string
+	appSecret string
+	client    *myhttp.Client
+	apiBase   string
+}
+
+func NewAccessTokenManager(appID, appSecret string, client *myhttp.Client, apiBase string, margin time.Duration) *AccessTokenManager {
+
+	if margin <= 0 {
+		margin = DefaultAccessTokenRefreshMargin
+	}
+
+	m := &AccessTokenManager{
+		appID:     appID,
+		appSecret: appSecret,
+		client:    client,
+		apiBase:   apiBase,
+	}
+	m.tokenCache = newTokenCache("access_token of "+appID, "access_token:"+appID, m.fetchToken, margin)
+
+	return m
+}
+
+// current access_token
+func (m *AccessTokenManager) AccessToken(ctx context.Context) (string, error) {
+	token, err := m.Get(ctx)
+	if err != nil {
+		return "", err
+	}
+	return token.Value, nil
+}
+
+func (m *AccessTokenManager) fetchToken(ctx context.Context) (*Token, error) {
+
+	if m.appID == "" || m.appSecret == "" {
+		return nil, ErrAppNotConfigured
+	}
+
+	params := url.Values{}
+	params.Set("grant_type", "client_credential")
+	params.Set("appid", m.appID)
+	params.Set("secret", m.appSecret)
+
+	result := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	now := time.Now()
+	if err := getJSON(ctx, m.client, m.apiBase+"/cgi-bin/token", params, &result); err != nil {
+		return nil, err
+	}
+
+	return &Token{
+		Value:     result.AccessToken,
+		ExpiresAt: now.Add(time.Duration(result.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// call WeChat API at path with GET method, access_token is added to params
+func (m *AccessTokenManager) GetJSON(ctx context.Context, path string, params url.Values, v interface{}) error {
+	return m.callWithToken(ctx, path, params, func(apiURL string, params url.Values) error {
+		return getJSON(ctx, m.client, apiURL, params, v)
+	})
+}
+
+// call WeChat API at path with POST method and body in JSON, access_token is
+// added to params
+func (m *AccessTokenManager) PostJSON(ctx context.Context, path string, params url.Values, body interface{}, v interface{}) error {
+	return m.callWithToken(ctx, path, params, func(apiURL string, params url.Values) error {
+		return postJSON(ctx, m.client, apiURL, params, body, v)
+	})
+}
+
+// if WeChat reports the access_token invalid or expired, it's invalidated and
+// refreshed, and the call is replayed once
+func (m *AccessTokenManager) callWithToken(ctx context.Context, path string, params url.Values, call func(string, url.Values) error) error {
+
+	withToken := url.Values{}
+	for k, v := range params {
+		withToken[k] = v
+	}
+
+	for retried := false; ; retried = true {
+		token, err := m.AccessToken(ctx)
+		if err != nil {
+			return err
+		}
+		withToken.Set("access_token", token)
+
+		err = call(m.apiBase+path, withToken)
+		if retried || !IsWXError(err, ECInvalidCredential, ECInvalidAccessToken, ECAccessTokenExpired) {
+			return err
+		}
+
+		log.Warning("access_token of %s rejected by %s: %s, refresh and retry", m.appID, path, err)
+		atomic.AddInt64(&accessTokenRetries, 1)
+		m.Invalidate(token)
+	}
+}
@@ -0,0 +1,292 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func startTokenServer(fetchCnt *int32, sleep time.Duration, expiresIn int) (*WXService, func()) {
+	s, ts := newTestService(
+		&Option{AppID: "wx123", AppSecret: "secret"},
+		func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			if r.URL.Path != "/cgi-bin/token" || q.Get("grant_type") != "client_credential" ||
+				q.Get("appid") != "wx123" || q.Get("secret") != "secret" {
+				w.Write([]byte(`{"errcode":40013,"errmsg":"invalid appid"}`))
+				return
+			}
+			cnt := atomic.AddInt32(fetchCnt, 1)
+			time.Sleep(sleep)
+			w.Write([]byte(`{"access_token":"TOKEN` + strconv.Itoa(int(cnt)) +
+				`","expires_in":` + strconv.Itoa(expiresIn) + `}`))
+		},
+	)
+	return s, ts.Close
+}
+
+func TestAccessTokenManager(t *testing.T) {
+
+	var fetchCnt int32
+	s, stop := startTokenServer(&fetchCnt, 50*time.Millisecond, 7200)
+	defer stop()
+	m := s.AccessTokenManager()
+
+	{
+		// concurrent requests are collapsed into one fetch
+		wg := sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				token, err := m.AccessToken(nil)
+				assert.Nil(t, err)
+				assert.Equal(t, "TOKEN1", token)
+			}()
+		}
+		wg.Wait()
+		if !assert.Equal(t, int32(1), atomic.LoadInt32(&fetchCnt)) {
+			return
+		}
+	}
+
+	{
+		// cached
+		token, err := m.AccessToken(nil)
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, "TOKEN1", token) {
+			return
+		}
+		if !assert.Equal(t, int32(1), atomic.LoadInt32(&fetchCnt)) {
+			return
+		}
+	}
+
+	{
+		token, err := m.Refresh(nil)
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, "TOKEN2", token.Value) {
+			return
+		}
+	}
+}
+
+func TestAccessTokenManagerBackgroundRefresh(t *testing.T) {
+
+	var fetchCnt int32
+	// token expires in 1 second, refreshed every 100ms as margin is 5 minutes
+	s, stop := startTokenServer(&fetchCnt, 0, 1)
+	defer stop()
+	m := s.AccessTokenManager()
+	m.minInterval = 100 * time.Millisecond
+
+	m.Start()
+	time.Sleep(250 * time.Millisecond)
+	m.Stop()
+
+	cnt := atomic.LoadInt32(&fetchCnt)
+	if !assert.True(t, cnt >= 2 && cnt <= 4, "fetched %d times", cnt) {
+		return
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if !assert.Equal(t, cnt, atomic.LoadInt32(&fetchCnt)) {
+		return
+	}
+}
+
+func TestAccessTokenManagerBackgroundRetry(t *testing.T) {
+
+	var fetchCnt int32
+	var errCode int32 = -1
+	s, ts := newTestService(
+		&Option{AppID: "wx123", AppSecret: "secret"},
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&fetchCnt, 1)
+			if code := atomic.LoadInt32(&errCode); code != 0 {
+				w.Write([]byte(`{"errcode":` + strconv.Itoa(int(code)) + `,"errmsg":"error"}`))
+				return
+			}
+			w.Write([]byte(`{"access_token":"TOKEN","expires_in":7200}`))
+		},
+	)
+	defer ts.Close()
+	m := s.AccessTokenManager()
+	m.retryInterval = 20 * time.Millisecond
+	m.maxRetryInterval = 80 * time.Millisecond
+
+	{
+		// retried at 0, 20, 60, 140, 220ms... instead of every 20ms
+		m.Start()
+		time.Sleep(250 * time.Millisecond)
+		m.Stop()
+
+		cnt := atomic.LoadInt32(&fetchCnt)
+		if !assert.True(t, cnt >= 3 && cnt <= 6, "fetched %d times", cnt) {
+			return
+		}
+	}
+
+	{
+		// wrong AppSecret is not retried
+		atomic.StoreInt32(&errCode, ECInvalidAppSecret)
+		atomic.StoreInt32(&fetchCnt, 0)
+		m.Start()
+		defer m.Stop()
+		time.Sleep(150 * time.Millisecond)
+		if !assert.Equal(t, int32(1), atomic.LoadInt32(&fetchCnt)) {
+			return
+		}
+
+		// until refreshed on demand after it's fixed
+		atomic.StoreInt32(&errCode, 0)
+		if _, err := m.AccessToken(nil); !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, int32(2), atomic.LoadInt32(&fetchCnt)) {
+			return
+		}
+	}
+}
+
+func TestAccessTokenManagerNotConfigured(t *testing.T) {
+
+	s, _ := NewWXService(&Option{})
+	_, err := s.AccessTokenManager().AccessToken(nil)
+	if !assert.Equal(t, ErrAppNotConfigured, err) {
+		return
+	}
+}
+
+func TestAccessTokenRefreshIfStale(t *testing.T) {
+
+	var fetchCnt int32
+	s, stop := startTokenServer(&fetchCnt, 50*time.Millisecond, 7200)
+	defer stop()
+	m := s.AccessTokenManager()
+
+	if _, err := m.Get(nil); !assert.Nil(t, err) {
+		return
+	}
+
+	// several callers report the same stale token
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := m.RefreshIfStale(nil, "TOKEN1")
+			assert.Nil(t, err)
+			assert.Equal(t, "TOKEN2", token.Value)
+		}()
+	}
+	wg.Wait()
+	if !assert.Equal(t, int32(2), atomic.LoadInt32(&fetchCnt)) {
+		return
+	}
+
+	// late report of the old token does not refresh again
+	token, err := m.RefreshIfStale(nil, "TOKEN1")
+	if !assert.Nil(t, err) {
+		return
+	}
+	if !assert.Equal(t, "TOKEN2", token.Value) {
+		return
+	}
+	if !assert.Equal(t, int32(2), atomic.LoadInt32(&fetchCnt)) {
+		return
+	}
+
+	// reports arriving while the refresh finishes don't refresh again
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			time.Sleep(time.Duration(i*2) * time.Millisecond)
+			token, err := m.RefreshIfStale(nil, "TOKEN2")
+			assert.Nil(t, err)
+			assert.Equal(t, "TOKEN3", token.Value)
+		}(i)
+	}
+	wg.Wait()
+	if !assert.Equal(t, int32(3), atomic.LoadInt32(&fetchCnt)) {
+		return
+	}
+}
+
+func TestAccessTokenManagerRetry(t *testing.T) {
+
+	var fetchCnt int32
+	var callCnt int32
+	s, ts := newTestService(
+		&Option{AppID: "wx123", AppSecret: "secret"},
+		func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			switch r.URL.Path {
+			case "/cgi-bin/token":
+				cnt := atomic.AddInt32(&fetchCnt, 1)
+				w.Write([]byte(`{"access_token":"TOKEN` + strconv.Itoa(int(cnt)) + `","expires_in":7200}`))
+			case "/cgi-bin/test":
+				atomic.AddInt32(&callCnt, 1)
+				switch q.Get("access_token") {
+				case "TOKEN1":
+					w.Write([]byte(`{"errcode":40001,"errmsg":"invalid credential"}`))
+				case "TOKEN2":
+					w.Write([]byte(`{"errcode":0,"errmsg":"ok","value":"` + q.Get("key") + `"}`))
+				default:
+					w.Write([]byte(`{"errcode":42001,"errmsg":"access_token expired"}`))
+				}
+			}
+		},
+	)
+	defer ts.Close()
+	m := s.AccessTokenManager()
+
+	retries := AccessTokenRetries()
+	result := struct {
+		Value string `json:"value"`
+	}{}
+
+	{
+		err := m.GetJSON(nil, "/cgi-bin/test", url.Values{"key": {"abc"}}, &result)
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, "abc", result.Value) {
+			return
+		}
+		if !assert.Equal(t, int32(2), atomic.LoadInt32(&fetchCnt)) {
+			return
+		}
+		if !assert.Equal(t, int32(2), atomic.LoadInt32(&callCnt)) {
+			return
+		}
+		if !assert.Equal(t, retries+1, AccessTokenRetries()) {
+			return
+		}
+	}
+
+	{
+		// replayed only once
+		m.Refresh(nil)
+		err := m.PostJSON(nil, "/cgi-bin/test", nil, map[string]string{}, &result)
+		if !assert.True(t, IsWXError(err, ECAccessTokenExpired)) {
+			return
+		}
+		if !assert.Equal(t, int32(4), atomic.LoadInt32(&fetchCnt)) {
+			return
+		}
+		if !assert.Equal(t, int32(4), atomic.LoadInt32(&callCnt)) {
+			return
+		}
+	}
+}
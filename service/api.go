@@ -0,0 +1,131 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/hyt-hz/wxOpenID/httpclient"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// base URL of WeChat API, can be replaced for testing
+var DefaultAPIBase = "https://api.weixin.qq.com"
+
+// WeChat error codes which need special handling
+const (
+	ECSuccess             = 0
+	ECInvalidCredential   = 40001
+	ECInvalidAccessToken  = 40014
+	ECInvalidCode         = 40029
+	ECInvalidRefreshToken = 40030
+	ECAccessTokenExpired  = 42001
+	ECRefreshTokenExpired = 42002
+	ECCodeUsed            = 40163
+	ECInvalidOpenID       = 40003
+	ECInvalidTemplateID   = 40037
+	ECUserNotSubscribed   = 43004
+	ECInvalidAppID        = 40013
+	ECInvalidAppSecret    = 40125
+	ECIPNotWhitelisted    = 40164
+)
+
+// error returned by WeChat API in errcode/errmsg JSON fields
+type WXError struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+func (err *WXError) Error() string {
+	return fmt.Sprintf("WeChat error %d %s", err.ErrCode, err.ErrMsg)
+}
+
+// check if err is a WeChat error with one of the given error codes
+func IsWXError(err error, codes ...int) bool {
+	wxErr, ok := err.(*WXError)
+	if !ok {
+		return false
+	}
+	for _, code := range codes {
+		if wxErr.ErrCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// call WeChat API with GET method, and decode JSON response into v
+func getJSON(ctx context.Context, client *myhttp.Client, apiURL string, params url.Values, v interface{}) error {
+	return doJSON(ctx, client, "GET", apiURL, params, nil, v)
+}
+
+// call WeChat API with POST method and body encoded in JSON, and decode JSON
+// response into v
+func postJSON(ctx context.Context, client *myhttp.Client, apiURL string, params url.Values, body interface{}, v interface{}) error {
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return doJSON(ctx, client, "POST", apiURL, params, data, v)
+}
+
+func doJSON(ctx context.Context, client *myhttp.Client, method string, apiURL string, params url.Values, body []byte, v interface{}) error {
+
+	if len(params) > 0 {
+		apiURL += "?" + params.Encode()
+	}
+
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, apiURL, bodyReader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	}
+
+	response, err := client.DoRequest(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	return decodeResponse(data, v)
+}
+
+// errcodes returned with result still, e.g. msg_id of the batch sent before
+var resultErrCodes = map[int]bool{
+	ECMassClientMsgIDUsed: true,
+}
+
+// decode WeChat API response, errcode other than 0 is returned as *WXError
+func decodeResponse(data []byte, v interface{}) error {
+
+	wxErr := &WXError{}
+	if err := json.Unmarshal(data, wxErr); err != nil {
+		return err
+	}
+	if wxErr.ErrCode != ECSuccess {
+		if v != nil && resultErrCodes[wxErr.ErrCode] {
+			json.Unmarshal(data, v)
+		}
+		return wxErr
+	}
+
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,208 @@
+package service
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+)
+
+var (
+	ErrOutOfResponseWindow = errors.New("User has not interacted in 48 hours, out of response window")
+)
+
+// WeChat error codes of customer service message
+const (
+	ECOutOfResponseWindow = 45015
+)
+
+// types of customer service messages
+const (
+	CustomTypeText            = "text"
+	CustomTypeImage           = "image"
+	CustomTypeVoice           = "voice"
+	CustomTypeVideo           = "video"
+	CustomTypeMusic           = "music"
+	CustomTypeNews            = "news"
+	CustomTypeMPNews          = "mpnews"
+	CustomTypeMenu            = "msgmenu"
+	CustomTypeMiniProgramPage = "miniprogrampage"
+)
+
+type CustomText struct {
+	Content string `json:"content"`
+}
+
+// image, voice or mpnews uploaded as media
+type CustomMedia struct {
+	MediaID string `json:"media_id"`
+}
+
+type CustomVideo struct {
+	MediaID      string `json:"media_id"`
+	ThumbMediaID string `json:"thumb_media_id,omitempty"`
+	Title        string `json:"title,omitempty"`
+	Description  string `json:"description,omitempty"`
+}
+
+type CustomMusic struct {
+	Title        string `json:"title,omitempty"`
+	Description  string `json:"description,omitempty"`
+	MusicURL     string `json:"musicurl"`
+	HQMusicURL   string `json:"hqmusicurl,omitempty"`
+	ThumbMediaID string `json:"thumb_media_id"`
+}
+
+type CustomArticle struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	URL         string `json:"url"`
+	PicURL      string `json:"picurl,omitempty"`
+}
+
+// news linking to an article, WeChat allows only one
+type CustomNews struct {
+	Articles []CustomArticle `json:"articles"`
+}
+
+type CustomMenuItem struct {
+	ID      string `json:"id"`
+	Content string `json:"content"`
+}
+
+// menu of options, the one clicked by user is sent back as text message
+type CustomMenu struct {
+	HeadContent string           `json:"head_content,omitempty"`
+	List        []CustomMenuItem `json:"list"`
+	TailContent string           `json:"tail_content,omitempty"`
+}
+
+type CustomMiniProgramPage struct {
+	Title        string `json:"title,omitempty"`
+	AppID        string `json:"appid"`
+	PagePath     string `json:"pagepath"`
+	ThumbMediaID string `json:"thumb_media_id"`
+}
+
+// customer service account the message is sent as
+type CustomServiceAccount struct {
+	KfAccount string `json:"kf_account"`
+}
+
+// customer service message, in the format of cgi-bin/message/custom/send,
+// with content of MsgType
+type CustomMessage struct {
+	ToUser          string                 `json:"touser"`
+	MsgType         string                 `json:"msgtype"`
+	Text            *CustomText            `json:"text,omitempty"`
+	Image           *CustomMedia           `json:"image,omitempty"`
+	Voice           *CustomMedia           `json:"voice,omitempty"`
+	Video           *CustomVideo           `json:"video,omitempty"`
+	Music           *CustomMusic           `json:"music,omitempty"`
+	News            *CustomNews            `json:"news,omitempty"`
+	MPNews          *CustomMedia           `json:"mpnews,omitempty"`
+	Menu            *CustomMenu            `json:"msgmenu,omitempty"`
+	MiniProgramPage *CustomMiniProgramPage `json:"miniprogrampage,omitempty"`
+	CustomService   *CustomServiceAccount  `json:"customservice,omitempty"`
+}
+
+// customer service message not valid for its type
+type CustomMessageError string
+
+func (err CustomMessageError) Error() string {
+	return "Invalid customer service message: " + string(err)
+}
+
+// check that msg has what its type requires
+func (msg *CustomMessage) Validate() error {
+
+	if msg.ToUser == "" {
+		return CustomMessageError("touser missing")
+	}
+
+	switch msg.MsgType {
+	case CustomTypeText:
+		if msg.Text == nil || msg.Text.Content == "" {
+			return CustomMessageError("text.content missing")
+		}
+	case CustomTypeImage:
+		if msg.Image == nil || msg.Image.MediaID == "" {
+			return CustomMessageError("image.media_id missing")
+		}
+	case CustomTypeVoice:
+		if msg.Voice == nil || msg.Voice.MediaID == "" {
+			return CustomMessageError("voice.media_id missing")
+		}
+	case CustomTypeVideo:
+		if msg.Video == nil || msg.Video.MediaID == "" {
+			return CustomMessageError("video.media_id missing")
+		}
+	case CustomTypeMusic:
+		if msg.Music == nil || msg.Music.MusicURL == "" || msg.Music.ThumbMediaID == "" {
+			return CustomMessageError("music.musicurl or music.thumb_media_id missing")
+		}
+	case CustomTypeNews:
+		if msg.News == nil || len(msg.News.Articles) != 1 {
+			return CustomMessageError("news must have exactly one article")
+		}
+		if a := msg.News.Articles[0]; a.Title == "" || a.URL == "" {
+			return CustomMessageError("title or url of news article missing")
+		}
+	case CustomTypeMPNews:
+		if msg.MPNews == nil || msg.MPNews.MediaID == "" {
+			return CustomMessageError("mpnews.media_id missing")
+		}
+	case CustomTypeMenu:
+		if msg.Menu == nil || len(msg.Menu.List) == 0 {
+			return CustomMessageError("msgmenu.list empty")
+		}
+		for _, item := range msg.Menu.List {
+			if item.ID == "" || item.Content == "" {
+				return CustomMessageError("id or content of msgmenu item missing")
+			}
+		}
+	case CustomTypeMiniProgramPage:
+		p := msg.MiniProgramPage
+		if p == nil || p.AppID == "" || p.PagePath == "" || p.ThumbMediaID == "" {
+			return CustomMessageError("miniprogrampage.appid, pagepath or thumb_media_id missing")
+		}
+	default:
+		return CustomMessageError("unknown msgtype " + msg.MsgType)
+	}
+	return nil
+}
+
+// send customer service message to follower who interacted with us in 48
+// hours, ErrOutOfResponseWindow otherwise
+func (s *WXService) SendCustomMessage(ctx context.Context, msg *CustomMessage) error {
+
+	if err := msg.Validate(); err != nil {
+		return err
+	}
+
+	err := s.accessToken.PostJSON(ctx, "/cgi-bin/message/custom/send", nil, msg, nil)
+	if IsWXError(err, ECOutOfResponseWindow) {
+		return ErrOutOfResponseWindow
+	}
+	return err
+}
+
+// show or cancel typing indicator in conversation with follower
+func (s *WXService) SetTyping(ctx context.Context, openID string, typing bool) error {
+
+	if openID == "" {
+		return CustomMessageError("touser missing")
+	}
+
+	body := struct {
+		ToUser  string `json:"touser"`
+		Command string `json:"command"`
+	}{openID, "Typing"}
+	if !typing {
+		body.Command = "CancelTyping"
+	}
+
+	err := s.accessToken.PostJSON(ctx, "/cgi-bin/message/custom/typing", nil, &body, nil)
+	if IsWXError(err, ECOutOfResponseWindow) {
+		return ErrOutOfResponseWindow
+	}
+	return err
+}
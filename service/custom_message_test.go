@@ -0,0 +1,107 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestValidateCustomMessage(t *testing.T) {
+
+	cases := []struct {
+		msg   CustomMessage
+		valid bool
+	}{
+		{CustomMessage{ToUser: "OPENID", MsgType: CustomTypeText, Text: &CustomText{"hi"}}, true},
+		{CustomMessage{MsgType: CustomTypeText, Text: &CustomText{"hi"}}, false},
+		{CustomMessage{ToUser: "OPENID", MsgType: CustomTypeText}, false},
+		{CustomMessage{ToUser: "OPENID", MsgType: CustomTypeText, Image: &CustomMedia{"MEDIA"}}, false},
+		{CustomMessage{ToUser: "OPENID", MsgType: CustomTypeImage, Image: &CustomMedia{"MEDIA"}}, true},
+		{CustomMessage{ToUser: "OPENID", MsgType: CustomTypeVoice, Voice: &CustomMedia{}}, false},
+		{CustomMessage{ToUser: "OPENID", MsgType: CustomTypeVideo, Video: &CustomVideo{MediaID: "MEDIA"}}, true},
+		{CustomMessage{ToUser: "OPENID", MsgType: CustomTypeMusic, Music: &CustomMusic{MusicURL: "http://m"}}, false},
+		{CustomMessage{ToUser: "OPENID", MsgType: CustomTypeMusic,
+			Music: &CustomMusic{MusicURL: "http://m", ThumbMediaID: "THUMB"}}, true},
+		{CustomMessage{ToUser: "OPENID", MsgType: CustomTypeNews,
+			News: &CustomNews{[]CustomArticle{{Title: "t", URL: "http://a"}}}}, true},
+		{CustomMessage{ToUser: "OPENID", MsgType: CustomTypeNews,
+			News: &CustomNews{[]CustomArticle{{Title: "t", URL: "http://a"}, {Title: "t", URL: "http://b"}}}}, false},
+		{CustomMessage{ToUser: "OPENID", MsgType: CustomTypeMPNews, MPNews: &CustomMedia{"MEDIA"}}, true},
+		{CustomMessage{ToUser: "OPENID", MsgType: CustomTypeMenu,
+			Menu: &CustomMenu{HeadContent: "rate", List: []CustomMenuItem{{"101", "good"}, {"102", "bad"}}}}, true},
+		{CustomMessage{ToUser: "OPENID", MsgType: CustomTypeMenu, Menu: &CustomMenu{}}, false},
+		{CustomMessage{ToUser: "OPENID", MsgType: CustomTypeMiniProgramPage,
+			MiniProgramPage: &CustomMiniProgramPage{AppID: "wxmini", PagePath: "pages/index", ThumbMediaID: "THUMB"}}, true},
+		{CustomMessage{ToUser: "OPENID", MsgType: CustomTypeMiniProgramPage,
+			MiniProgramPage: &CustomMiniProgramPage{AppID: "wxmini"}}, false},
+		{CustomMessage{ToUser: "OPENID", MsgType: "wxcard"}, false},
+	}
+
+	for i, c := range cases {
+		err := c.msg.Validate()
+		if !assert.Equal(t, c.valid, err == nil, "case %d: %v", i, err) {
+			return
+		}
+	}
+}
+
+func TestSendCustomMessage(t *testing.T) {
+
+	requests := make(chan map[string]interface{}, 1)
+	s, ts := newTestService(&Option{AppID: "wx123", AppSecret: "secret"}, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cgi-bin/token":
+			w.Write([]byte(`{"access_token": "TOKEN", "expires_in": 7200}`))
+		case "/cgi-bin/message/custom/send", "/cgi-bin/message/custom/typing":
+			req := map[string]interface{}{}
+			json.NewDecoder(r.Body).Decode(&req)
+			if req["touser"] == "SILENT" {
+				w.Write([]byte(`{"errcode": 45015, "errmsg": "response out of time limit or subscription is canceled"}`))
+				return
+			}
+			req["path"] = r.URL.Path
+			requests <- req
+			w.Write([]byte(`{"errcode": 0, "errmsg": "ok"}`))
+		}
+	})
+	defer ts.Close()
+
+	msg := &CustomMessage{ToUser: "OPENID", MsgType: CustomTypeText, Text: &CustomText{"hello"}}
+	if !assert.Nil(t, s.SendCustomMessage(nil, msg)) {
+		return
+	}
+	req := <-requests
+	if !assert.Equal(t, "text", req["msgtype"]) || !assert.Equal(t, "hello", req["text"].(map[string]interface{})["content"]) {
+		return
+	}
+
+	{
+		msg := *msg
+		msg.ToUser = "SILENT"
+		if !assert.Equal(t, ErrOutOfResponseWindow, s.SendCustomMessage(nil, &msg)) {
+			return
+		}
+	}
+
+	if _, ok := s.SendCustomMessage(nil, &CustomMessage{ToUser: "OPENID", MsgType: CustomTypeText}).(CustomMessageError); !assert.True(t, ok) {
+		return
+	}
+
+	if !assert.Nil(t, s.SetTyping(nil, "OPENID", true)) {
+		return
+	}
+	req = <-requests
+	if !assert.Equal(t, "/cgi-bin/message/custom/typing", req["path"]) || !assert.Equal(t, "Typing", req["command"]) {
+		return
+	}
+	if !assert.Nil(t, s.SetTyping(nil, "OPENID", false)) {
+		return
+	}
+	if req = <-requests; !assert.Equal(t, "CancelTyping", req["command"]) {
+		return
+	}
+	if !assert.Equal(t, ErrOutOfResponseWindow, s.SetTyping(nil, "SILENT", true)) {
+		return
+	}
+}
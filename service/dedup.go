@@ -0,0 +1,171 @@
+package service
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// WeChat retries 3 times at 5 seconds interval, keep messages a while
+	// longer than that
+	DefaultDedupTTL      = time.Minute
+	DefaultDedupCapacity = 10000
+)
+
+// storage of messages recently received, to detect retries of WeChat
+type DedupStore interface {
+	// record key of a message, added is false if the key is already there,
+	// along with the reply saved for it, which is nil if the message is still
+	// being handled
+	Add(key string) (added bool, reply []byte, err error)
+	// save reply of the message with key, for its retries
+	SetReply(key string, reply []byte) error
+}
+
+// key to identify retries of msg, messages have MsgId while events are
+// identified by sender, CreateTime and event type, plus MsgID of the job for
+// job finish events as several jobs may finish in the same second
+func DedupKey(msg Message) string {
+
+	var msgID int64
+	switch m := msg.(type) {
+	case *TextMessage:
+		msgID = m.MsgID
+	case *ImageMessage:
+		msgID = m.MsgID
+	case *VoiceMessage:
+		msgID = m.MsgID
+	case *VideoMessage:
+		msgID = m.MsgID
+	case *LocationMessage:
+		msgID = m.MsgID
+	case *LinkMessage:
+		msgID = m.MsgID
+	}
+	if msgID != 0 {
+		return "msg:" + strconv.FormatInt(msgID, 10)
+	}
+
+	header := msg.Header()
+	key := "event:" + header.FromUserName + ":" + strconv.FormatInt(header.CreateTime, 10) + ":" + EventOf(msg)
+	switch m := msg.(type) {
+	case *TemplateSendJobFinishEvent:
+		key += ":" + strconv.FormatInt(m.MsgID, 10)
+	case *MassSendJobFinishEvent:
+		key += ":" + strconv.FormatInt(m.MsgID, 10)
+	}
+	return key
+}
+
+type dedupEntry struct {
+	key       string
+	reply     []byte
+	expiresAt time.Time
+}
+
+// DedupStore in memory, holds at most capacity keys, the oldest is dropped
+// when it's full
+type MemoryDedupStore struct {
+	sync.Mutex
+	ttl      time.Duration
+	capacity int
+	entries  map[string]*list.Element
+	// entries in order of expiry
+	order *list.List
+}
+
+func NewMemoryDedupStore(ttl time.Duration, capacity int) *MemoryDedupStore {
+	if ttl <= 0 {
+		ttl = DefaultDedupTTL
+	}
+	if capacity <= 0 {
+		capacity = DefaultDedupCapacity
+	}
+	return &MemoryDedupStore{
+		ttl:      ttl,
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (ms *MemoryDedupStore) Add(key string) (added bool, reply []byte, err error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	now := time.Now()
+	for e := ms.order.Front(); e != nil && now.After(e.Value.(*dedupEntry).expiresAt); e = ms.order.Front() {
+		ms.remove(e)
+	}
+
+	if e, ok := ms.entries[key]; ok {
+		return false, e.Value.(*dedupEntry).reply, nil
+	}
+	if ms.order.Len() >= ms.capacity {
+		ms.remove(ms.order.Front())
+	}
+	ms.entries[key] = ms.order.PushBack(&dedupEntry{key: key, expiresAt: now.Add(ms.ttl)})
+	return true, nil, nil
+}
+
+func (ms *MemoryDedupStore) remove(e *list.Element) {
+	ms.order.Remove(e)
+	delete(ms.entries, e.Value.(*dedupEntry).key)
+}
+
+func (ms *MemoryDedupStore) SetReply(key string, reply []byte) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if e, ok := ms.entries[key]; ok {
+		e.Value.(*dedupEntry).reply = reply
+	}
+	return nil
+}
+
+// DedupStore in Redis, shared by replicas behind load balancer, as WeChat
+// may send retries to another replica
+type RedisDedupStore struct {
+	client *redisClient
+	prefix string
+	ttl    string
+}
+
+func NewRedisDedupStore(option *RedisOption, ttl time.Duration) *RedisDedupStore {
+	if ttl <= 0 {
+		ttl = DefaultDedupTTL
+	}
+	return &RedisDedupStore{
+		client: newRedisClient(option),
+		prefix: option.Prefix + "dedup:",
+		ttl:    strconv.FormatInt(int64(ttl/time.Millisecond), 10),
+	}
+}
+
+// value is "-" while the message is being handled, and "+" followed by the
+// reply afterwards
+func (rs *RedisDedupStore) Add(key string) (added bool, reply []byte, err error) {
+
+	r, err := rs.client.Do("SET", rs.prefix+key, "-", "NX", "PX", rs.ttl)
+	if err != nil {
+		return false, nil, err
+	}
+	if r != nil {
+		return true, nil, nil
+	}
+
+	if r, err = rs.client.Do("GET", rs.prefix+key); err != nil {
+		return false, nil, err
+	}
+	if value, ok := r.(string); ok && len(value) > 0 && value[0] == '+' {
+		return false, []byte(value[1:]), nil
+	}
+	return false, nil, nil
+}
+
+func (rs *RedisDedupStore) SetReply(key string, reply []byte) error {
+	_, err := rs.client.Do("SET", rs.prefix+key, "+"+string(reply), "XX", "PX", rs.ttl)
+	return err
+}
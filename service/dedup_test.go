@@ -0,0 +1,136 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDedupKey(t *testing.T) {
+
+	msg := newTextMessage("hi")
+	msg.MsgID = 1234567890123456
+	if !assert.Equal(t, "msg:1234567890123456", DedupKey(msg)) {
+		return
+	}
+
+	event := newEvent(EventSubscribe, "")
+	event.Header().CreateTime = 1409735668
+	if !assert.Equal(t, "event:OPENID:1409735668:subscribe", DedupKey(event)) {
+		return
+	}
+
+	finish := &TemplateSendJobFinishEvent{MsgID: 200163836}
+	finish.MsgType, finish.Event = MsgTypeEvent, EventTemplateSendJobFinish
+	finish.FromUserName, finish.CreateTime = "OPENID", 1409735668
+	if !assert.Equal(t, "event:OPENID:1409735668:TEMPLATESENDJOBFINISH:200163836", DedupKey(finish)) {
+		return
+	}
+
+	massFinish := &MassSendJobFinishEvent{MsgID: 1000001625}
+	massFinish.MsgType, massFinish.Event = MsgTypeEvent, EventMassSendJobFinish
+	massFinish.FromUserName, massFinish.CreateTime = "OPENID", 1409735668
+	if !assert.Equal(t, "event:OPENID:1409735668:MASSSENDJOBFINISH:1000001625", DedupKey(massFinish)) {
+		return
+	}
+}
+
+func testDedupStore(t *testing.T, ds DedupStore) {
+
+	added, _, err := ds.Add("msg:1")
+	if !assert.Nil(t, err) || !assert.True(t, added) {
+		return
+	}
+
+	// still being handled
+	added, reply, err := ds.Add("msg:1")
+	if !assert.Nil(t, err) || !assert.False(t, added) || !assert.Nil(t, reply) {
+		return
+	}
+
+	if !assert.Nil(t, ds.SetReply("msg:1", []byte("<xml>reply</xml>"))) {
+		return
+	}
+	added, reply, err = ds.Add("msg:1")
+	if !assert.Nil(t, err) || !assert.False(t, added) || !assert.Equal(t, "<xml>reply</xml>", string(reply)) {
+		return
+	}
+
+	added, _, err = ds.Add("msg:2")
+	if !assert.Nil(t, err) || !assert.True(t, added) {
+		return
+	}
+
+	// forgotten after ttl
+	time.Sleep(150 * time.Millisecond)
+	added, _, err = ds.Add("msg:1")
+	if !assert.Nil(t, err) || !assert.True(t, added) {
+		return
+	}
+}
+
+func TestMemoryDedupStore(t *testing.T) {
+
+	testDedupStore(t, NewMemoryDedupStore(100*time.Millisecond, 0))
+
+	// the oldest is dropped when full
+	ds := NewMemoryDedupStore(0, 2)
+	for _, key := range []string{"msg:1", "msg:2", "msg:3", "msg:1"} {
+		added, _, err := ds.Add(key)
+		if !assert.Nil(t, err) || !assert.True(t, added) {
+			return
+		}
+	}
+	added, _, err := ds.Add("msg:3")
+	if !assert.Nil(t, err) || !assert.False(t, added) {
+		return
+	}
+}
+
+func TestRedisDedupStore(t *testing.T) {
+
+	fr := startFakeRedis()
+	defer fr.Close()
+
+	testDedupStore(t, NewRedisDedupStore(&RedisOption{Addr: fr.Addr(), Prefix: "wx:"}, 100*time.Millisecond))
+}
+
+func TestHandleDuplicateMessage(t *testing.T) {
+
+	s, _ := NewWXService(&Option{Token: "token", DispatchTimeout: 50 * time.Millisecond})
+	var cnt int32
+	s.Router().HandleEvent(EventSubscribe, func(ctx context.Context, msg Message) Reply {
+		atomic.AddInt32(&cnt, 1)
+		return &TextReply{Content: "welcome"}
+	})
+
+	body := []byte(`<xml><ToUserName><![CDATA[gh_account]]></ToUserName>` +
+		`<FromUserName><![CDATA[OPENID]]></FromUserName><CreateTime>1409735668</CreateTime>` +
+		`<MsgType><![CDATA[event]]></MsgType><Event><![CDATA[subscribe]]></Event></xml>`)
+
+	first, err := s.HandleMessage(nil, &PushRequest{Body: body})
+	if !assert.Nil(t, err) || !assert.True(t, strings.Contains(string(first), "welcome")) {
+		return
+	}
+
+	// retry gets the same reply without running handler again
+	retry, err := s.HandleMessage(nil, &PushRequest{Body: body})
+	if !assert.Nil(t, err) || !assert.Equal(t, string(first), string(retry)) {
+		return
+	}
+	if !assert.Equal(t, int32(1), atomic.LoadInt32(&cnt)) {
+		return
+	}
+
+	// the same event of another time is handled
+	other := []byte(strings.Replace(string(body), "1409735668", "1409735669", 1))
+	if _, err := s.HandleMessage(nil, &PushRequest{Body: other}); !assert.Nil(t, err) {
+		return
+	}
+	if !assert.Equal(t, int32(2), atomic.LoadInt32(&cnt)) {
+		return
+	}
+}
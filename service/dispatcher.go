@@ -0,0 +1,175 @@
+package service
+
+import (
+	"encoding/xml"
+	"errors"
+	"github.com/hyt-hz/wxOpenID/log"
+	"golang.org/x/net/context"
+	"time"
+)
+
+var (
+	ErrEncryptionNotConfigured = errors.New("Message encrypted but EncodingAESKey not configured")
+)
+
+const (
+	EncryptTypeAES = "aes"
+)
+
+const (
+	// WeChat retries if we don't respond in 5 seconds, leave some time for
+	// network
+	DefaultDispatchTimeout = 4 * time.Second
+)
+
+// dispatcher of messages to router, dispatch waits for the handler at most
+// timeout, slow handler keeps running in background and its reply is dropped,
+// so that WeChat gets response in time
+type MessageDispatcher struct {
+	router  *MessageRouter
+	timeout time.Duration
+}
+
+func NewMessageDispatcher(router *MessageRouter, timeout time.Duration) *MessageDispatcher {
+	if timeout <= 0 {
+		timeout = DefaultDispatchTimeout
+	}
+	return &MessageDispatcher{
+		router:  router,
+		timeout: timeout,
+	}
+}
+
+func (d *MessageDispatcher) Router() *MessageRouter {
+	return d.router
+}
+
+// route msg and return reply of its handler, nil if it's not done in time
+func (d *MessageDispatcher) Dispatch(msg Message) Reply {
+
+	// handler is not bound to the request, it may outlive it
+	ctx := context.Background()
+	replyCh := make(chan Reply, 1)
+	go func() {
+		replyCh <- d.router.Route(ctx, msg)
+	}()
+
+	select {
+	case reply := <-replyCh:
+		return reply
+	case <-time.After(d.timeout):
+		header := msg.Header()
+		log.Warning("Handler of %s message from %s not done in %s, continue in background",
+			header.MsgType, header.FromUserName, d.timeout)
+		return nil
+	}
+}
+
+// message pushed by WeChat, with parameters in its URL
+type PushRequest struct {
+	Timestamp string
+	Nonce     string
+	// "aes" if the message is encrypted in safe or compatible mode
+	EncryptType  string
+	MsgSignature string
+	Body         []byte
+}
+
+// handle message pushed by WeChat in XML, encrypted message is verified and
+// decrypted first, passive reply in XML is returned if any
+func (s *WXService) HandleMessage(ctx context.Context, req *PushRequest) (reply []byte, err error) {
+
+	body, err := s.decryptMessage(req)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := ParseMessage(body)
+	if err != nil {
+		return nil, err
+	}
+
+	// WeChat retries if we are slow, reply to retries as the first time
+	key := DedupKey(msg)
+	added, cached, err := s.dedup.Add(key)
+	if err != nil {
+		log.Warning("Failed to check duplicate of message %s: %s", key, err)
+	} else if !added {
+		log.Info("Duplicate message %s from %s, handled already", key, msg.Header().FromUserName)
+		return s.sealReply(req, cached), nil
+	}
+
+	if err := s.webhooks.Forward(msg); err != nil {
+		log.Error("Failed to forward message %s to webhooks: %s", key, err)
+	}
+
+	reply = s.dispatch(msg)
+	if added {
+		if err := s.dedup.SetReply(key, reply); err != nil {
+			log.Warning("Failed to save reply of message %s: %s", key, err)
+		}
+	}
+	return s.sealReply(req, reply), nil
+}
+
+// route msg to its handler and marshal the reply, nil if there is no reply
+func (s *WXService) dispatch(msg Message) []byte {
+
+	r := s.dispatcher.Dispatch(msg)
+	if r == nil {
+		return nil
+	}
+	reply, err := r.MarshalReply(msg)
+	if err != nil {
+		log.Error("Failed to marshal reply to %s: %s", msg.Header().FromUserName, err)
+		return nil
+	}
+	return reply
+}
+
+// encrypt reply in safe mode if the message was encrypted, acknowledgement
+// is sent as is
+func (s *WXService) sealReply(req *PushRequest, reply []byte) []byte {
+
+	if len(reply) == 0 || string(reply) == string(SuccessReply) {
+		return reply
+	}
+	if req.EncryptType != EncryptTypeAES || s.crypter == nil {
+		return reply
+	}
+
+	sealed, err := s.crypter.EncryptMessage(reply, req.Timestamp, req.Nonce)
+	if err != nil {
+		log.Error("Failed to encrypt reply: %s", err)
+		return nil
+	}
+	return sealed
+}
+
+// plaintext of pushed message, in compatible mode plaintext fields are pushed
+// along with the encrypted, which is used if EncodingAESKey is not configured
+func (s *WXService) decryptMessage(req *PushRequest) ([]byte, error) {
+
+	if req.EncryptType != EncryptTypeAES {
+		return req.Body, nil
+	}
+
+	envelope := struct {
+		Encrypt string `xml:"Encrypt"`
+	}{}
+	if err := xml.Unmarshal(req.Body, &envelope); err != nil || envelope.Encrypt == "" {
+		return nil, ErrInvalidMessage
+	}
+
+	if s.crypter == nil {
+		if _, err := ParseMessage(req.Body); err != nil {
+			return nil, ErrEncryptionNotConfigured
+		}
+		return req.Body, nil
+	}
+
+	if err := s.crypter.VerifySignature(req.MsgSignature, req.Timestamp, req.Nonce, envelope.Encrypt); err != nil {
+		return nil, err
+	}
+	return s.crypter.Decrypt(envelope.Encrypt)
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/hyt-hz/wxOpenID/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// write data to a temp file in the same directory and rename it to path,
+// so readers never see a half written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// file store saving in background
+type flusher interface {
+	// write what's not saved yet
+	Flush() error
+}
+
+// JSON file holding the whole content of a file store, readable only by
+// owner and replaced atomically on every save
+type jsonFile struct {
+	// what's in the file, for logs
+	name string
+	path string
+	// serialize saving, so that older content never overwrites newer
+	lock sync.Mutex
+
+	// content to save in background, encoded when it's written, so changes
+	// made in the meantime are saved together
+	laterLock sync.Mutex
+	later     func() ([]byte, error)
+	scheduled bool
+}
+
+func newJSONFile(name, path string) *jsonFile {
+	return &jsonFile{
+		name: name,
+		path: path,
+	}
+}
+
+// decode the file into v, v is left alone if the file doesn't exist yet
+func (f *jsonFile) Load(v interface{}) error {
+
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		log.Error("Failed to read %s file %s: %s", f.name, f.path, err)
+		return err
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		log.Error("Failed to parse %s file %s: %s", f.name, f.path, err)
+		return err
+	}
+
+	return nil
+}
+
+// replace the file with v encoded in JSON
+func (f *jsonFile) Save(v interface{}) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.path, data, 0600)
+}
+
+// save v in background, v is encoded with l held when the file is written,
+// saves requested while the file is being written are done at once after it
+func (f *jsonFile) SaveLater(l sync.Locker, v interface{}) {
+	f.laterLock.Lock()
+	defer f.laterLock.Unlock()
+
+	f.later = func() ([]byte, error) {
+		l.Lock()
+		defer l.Unlock()
+		return json.Marshal(v)
+	}
+	if !f.scheduled {
+		f.scheduled = true
+		go f.Flush()
+	}
+}
+
+// write content of the last SaveLater if not written yet
+func (f *jsonFile) Flush() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.laterLock.Lock()
+	marshal := f.later
+	f.later = nil
+	f.scheduled = false
+	f.laterLock.Unlock()
+	if marshal == nil {
+		return nil
+	}
+
+	data, err := marshal()
+	if err == nil {
+		err = writeFileAtomic(f.path, data, 0600)
+	}
+	if err != nil {
+		log.Error("Failed to save %s file %s: %s", f.name, f.path, err)
+		// retried by next save or flush
+		f.laterLock.Lock()
+		if f.later == nil {
+			f.later = marshal
+		}
+		f.laterLock.Unlock()
+	}
+	return err
+}
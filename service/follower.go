@@ -0,0 +1,233 @@
+package service
+
+import (
+	"errors"
+	"github.com/hyt-hz/wxOpenID/log"
+	"golang.org/x/net/context"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrFollowerNotFound = errors.New("Follower not found")
+)
+
+// subscribe scene of users followed by scanning parametric QR code, as in
+// subscribe_scene of cgi-bin/user/info
+const (
+	SubscribeSceneQRCode = "ADD_SCENE_QR_CODE"
+)
+
+// subscription state of a user of the Official Account
+type Follower struct {
+	OpenID     string `json:"openid"`
+	Subscribed bool   `json:"subscribed"`
+	// time of the latest subscription and unsubscription
+	SubscribeTime   time.Time `json:"subscribe_time"`
+	UnsubscribeTime time.Time `json:"unsubscribe_time"`
+	// how the user subscribed, and scene of the parametric QR code if
+	// subscribed by scanning it
+	SubscribeScene string `json:"subscribe_scene"`
+	QRScene        string `json:"qr_scene"`
+	// parametric QR code scanned by the user as follower
+	LastScanScene string    `json:"last_scan_scene"`
+	LastScanTime  time.Time `json:"last_scan_time"`
+	// time of the latest event applied, older events are ignored
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// storage of follower records, keyed by OpenID
+type FollowerStore interface {
+	Get(openID string) (*Follower, error)
+	Put(follower *Follower) error
+	// put records in one go, e.g. in synchronization
+	PutMany(followers []*Follower) error
+	// all follower records, subscribed or not
+	List() ([]*Follower, error)
+}
+
+// FollowerStore in memory, records are lost when process exits
+type MemoryFollowerStore struct {
+	sync.Mutex
+	followers map[string]Follower
+}
+
+func NewMemoryFollowerStore() *MemoryFollowerStore {
+	return &MemoryFollowerStore{
+		followers: make(map[string]Follower),
+	}
+}
+
+func (ms *MemoryFollowerStore) Get(openID string) (*Follower, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	follower, ok := ms.followers[openID]
+	if !ok {
+		return nil, ErrFollowerNotFound
+	}
+	return &follower, nil
+}
+
+func (ms *MemoryFollowerStore) Put(follower *Follower) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	ms.followers[follower.OpenID] = *follower
+	return nil
+}
+
+func (ms *MemoryFollowerStore) PutMany(followers []*Follower) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for _, follower := range followers {
+		ms.followers[follower.OpenID] = *follower
+	}
+	return nil
+}
+
+func (ms *MemoryFollowerStore) List() ([]*Follower, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	followers := make([]*Follower, 0, len(ms.followers))
+	for _, follower := range ms.followers {
+		follower := follower
+		followers = append(followers, &follower)
+	}
+	return followers, nil
+}
+
+// FollowerStore persisted in a JSON file, the whole file is rewritten in
+// background after changes, changes made in the meantime are written together,
+// which is fine for moderate number of followers
+type FileFollowerStore struct {
+	MemoryFollowerStore
+	file *jsonFile
+}
+
+func NewFileFollowerStore(path string) (*FileFollowerStore, error) {
+
+	fs := &FileFollowerStore{
+		MemoryFollowerStore: *NewMemoryFollowerStore(),
+		file:                newJSONFile("follower", path),
+	}
+
+	if err := fs.file.Load(&fs.followers); err != nil {
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+func (fs *FileFollowerStore) Put(follower *Follower) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	fs.followers[follower.OpenID] = *follower
+	fs.file.SaveLater(fs, fs.followers)
+	return nil
+}
+
+func (fs *FileFollowerStore) PutMany(followers []*Follower) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	for _, follower := range followers {
+		fs.followers[follower.OpenID] = *follower
+	}
+	fs.file.SaveLater(fs, fs.followers)
+	return nil
+}
+
+// write followers saved in background to the file
+func (fs *FileFollowerStore) Flush() error {
+	return fs.file.Flush()
+}
+
+// update follower record with subscribe, unsubscribe and SCAN events, other
+// messages are ignored, observed by router middleware
+func (s *WXService) trackFollower(ctx context.Context, msg Message) {
+
+	header := msg.Header()
+	at := time.Unix(header.CreateTime, 0)
+
+	var update func(f *Follower)
+	switch e := msg.(type) {
+	case *SubscribeEvent:
+		update = func(f *Follower) {
+			f.Subscribed = true
+			f.SubscribeTime = at
+			f.SubscribeScene, f.QRScene = "", ""
+			if strings.HasPrefix(e.EventKey, "qrscene_") {
+				f.SubscribeScene = SubscribeSceneQRCode
+				f.QRScene = strings.TrimPrefix(e.EventKey, "qrscene_")
+			}
+		}
+	case *UnsubscribeEvent:
+		update = func(f *Follower) {
+			f.Subscribed = false
+			f.UnsubscribeTime = at
+		}
+	case *ScanEvent:
+		update = func(f *Follower) {
+			// only followers get SCAN event
+			f.Subscribed = true
+			f.LastScanScene = e.EventKey
+			f.LastScanTime = at
+		}
+	default:
+		return
+	}
+
+	s.updateFollower(header.FromUserName, at, update)
+}
+
+// update follower record with state known at the given time, records
+// updated later than that are left alone, returns whether it's updated
+func (s *WXService) updateFollower(openID string, at time.Time, update func(f *Follower)) bool {
+	return s.updateFollowers(at, map[string]func(f *Follower){openID: update}) == 1
+}
+
+// update follower records by OpenID in one go, returns how many are updated
+func (s *WXService) updateFollowers(at time.Time, updates map[string]func(f *Follower)) int {
+
+	s.followerLock.Lock()
+	defer s.followerLock.Unlock()
+
+	followers := make([]*Follower, 0, len(updates))
+	for openID, update := range updates {
+		follower, err := s.followers.Get(openID)
+		if err == ErrFollowerNotFound {
+			follower, err = &Follower{OpenID: openID}, nil
+		}
+		if err != nil {
+			log.Error("Failed to load follower %s: %s", openID, err)
+			continue
+		}
+		if at.Before(follower.UpdatedAt) {
+			continue
+		}
+
+		update(follower)
+		follower.UpdatedAt = at
+		followers = append(followers, follower)
+	}
+	if len(followers) == 0 {
+		return 0
+	}
+
+	if err := s.followers.PutMany(followers); err != nil {
+		log.Error("Failed to save %d followers: %s", len(followers), err)
+		return 0
+	}
+	return len(followers)
+}
+
+// subscription state of user, ErrFollowerNotFound if we know nothing of the
+// user
+func (s *WXService) GetFollower(openID string) (*Follower, error) {
+	return s.followers.Get(openID)
+}
@@ -0,0 +1,279 @@
+package service
+
+import (
+	"errors"
+	"github.com/hyt-hz/wxOpenID/log"
+	"golang.org/x/net/context"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrFollowerSyncRunning = errors.New("Follower synchronization already running")
+)
+
+const (
+	// users per call of cgi-bin/user/info/batchget
+	userInfoBatchSize = 100
+)
+
+// progress of the running or the last follower synchronization
+type FollowerSyncProgress struct {
+	Running    bool      `json:"running"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	// followers reported by WeChat, listed and whose profiles are fetched so far
+	Total   int `json:"total"`
+	Listed  int `json:"listed"`
+	Fetched int `json:"fetched"`
+	// users in store not listed any more, marked unsubscribed
+	Unsubscribed int    `json:"unsubscribed"`
+	Error        string `json:"error,omitempty"`
+}
+
+type followerSync struct {
+	sync.Mutex
+	progress FollowerSyncProgress
+	stopCh   chan struct{}
+}
+
+// profile of follower returned by cgi-bin/user/info/batchget, only what we
+// keep in follower record
+type followerInfo struct {
+	Subscribe      int    `json:"subscribe"`
+	OpenID         string `json:"openid"`
+	SubscribeTime  int64  `json:"subscribe_time"`
+	SubscribeScene string `json:"subscribe_scene"`
+	QRScene        int64  `json:"qr_scene"`
+	QRSceneStr     string `json:"qr_scene_str"`
+}
+
+// progress of the running or the last follower synchronization
+func (s *WXService) FollowerSyncProgress() FollowerSyncProgress {
+	s.followerSync.Lock()
+	defer s.followerSync.Unlock()
+
+	return s.followerSync.progress
+}
+
+// synchronize follower records with the full follower list of WeChat, which
+// catches up with what happened before we tracked events, users in store but
+// not listed are marked unsubscribed
+func (s *WXService) SyncFollowers(ctx context.Context) (FollowerSyncProgress, error) {
+	if err := s.beginFollowerSync(); err != nil {
+		return FollowerSyncProgress{}, err
+	}
+	err := s.syncFollowers(ctx)
+	return s.endFollowerSync(err), err
+}
+
+// start follower synchronization in background
+func (s *WXService) StartFollowerSync() error {
+	if err := s.beginFollowerSync(); err != nil {
+		return err
+	}
+	go func() {
+		s.endFollowerSync(s.syncFollowers(context.Background()))
+	}()
+	return nil
+}
+
+func (s *WXService) beginFollowerSync() error {
+	s.followerSync.Lock()
+	defer s.followerSync.Unlock()
+
+	if s.followerSync.progress.Running {
+		return ErrFollowerSyncRunning
+	}
+	s.followerSync.progress = FollowerSyncProgress{
+		Running:   true,
+		StartedAt: time.Now(),
+	}
+	return nil
+}
+
+func (s *WXService) endFollowerSync(err error) FollowerSyncProgress {
+	s.followerSync.Lock()
+	defer s.followerSync.Unlock()
+
+	p := &s.followerSync.progress
+	p.Running = false
+	p.FinishedAt = time.Now()
+	if err != nil {
+		p.Error = err.Error()
+		log.Error("Follower synchronization failed after %d of %d followers: %s", p.Fetched, p.Total, err)
+	} else {
+		log.Info("Synchronized %d followers, %d marked unsubscribed", p.Fetched, p.Unsubscribed)
+	}
+	return *p
+}
+
+func (s *WXService) updateFollowerSync(update func(p *FollowerSyncProgress)) {
+	s.followerSync.Lock()
+	defer s.followerSync.Unlock()
+
+	update(&s.followerSync.progress)
+}
+
+func (s *WXService) syncFollowers(ctx context.Context) error {
+
+	// events are timed in seconds, truncate to compare with them
+	startedAt := s.FollowerSyncProgress().StartedAt.Truncate(time.Second)
+	listed := make(map[string]bool)
+
+	nextOpenID := ""
+	for {
+		result := struct {
+			Total int `json:"total"`
+			Count int `json:"count"`
+			Data  struct {
+				OpenID []string `json:"openid"`
+			} `json:"data"`
+			NextOpenID string `json:"next_openid"`
+		}{}
+		params := url.Values{}
+		params.Set("next_openid", nextOpenID)
+		if err := s.accessToken.GetJSON(ctx, "/cgi-bin/user/get", params, &result); err != nil {
+			return err
+		}
+		if result.Count == 0 {
+			break
+		}
+
+		for _, openID := range result.Data.OpenID {
+			listed[openID] = true
+		}
+		s.updateFollowerSync(func(p *FollowerSyncProgress) {
+			p.Total = result.Total
+			p.Listed += result.Count
+		})
+
+		for i := 0; i < len(result.Data.OpenID); i += userInfoBatchSize {
+			end := i + userInfoBatchSize
+			if end > len(result.Data.OpenID) {
+				end = len(result.Data.OpenID)
+			}
+			if err := s.syncFollowerBatch(ctx, result.Data.OpenID[i:end]); err != nil {
+				return err
+			}
+		}
+
+		if result.NextOpenID == "" {
+			break
+		}
+		nextOpenID = result.NextOpenID
+	}
+
+	return s.markUnlisted(listed, startedAt)
+}
+
+// fetch profiles of followers and update their records
+func (s *WXService) syncFollowerBatch(ctx context.Context, openIDs []string) error {
+
+	type user struct {
+		OpenID string `json:"openid"`
+	}
+	body := struct {
+		UserList []user `json:"user_list"`
+	}{}
+	for _, openID := range openIDs {
+		body.UserList = append(body.UserList, user{openID})
+	}
+
+	result := struct {
+		UserInfoList []followerInfo `json:"user_info_list"`
+	}{}
+	if err := s.accessToken.PostJSON(ctx, "/cgi-bin/user/info/batchget", nil, &body, &result); err != nil {
+		return err
+	}
+
+	fetchedAt := time.Now().Truncate(time.Second)
+	updates := make(map[string]func(f *Follower), len(result.UserInfoList))
+	for i := range result.UserInfoList {
+		info := &result.UserInfoList[i]
+		updates[info.OpenID] = func(f *Follower) {
+			// may have unsubscribed since listed
+			f.Subscribed = info.Subscribe == 1
+			if !f.Subscribed {
+				return
+			}
+			f.SubscribeTime = time.Unix(info.SubscribeTime, 0)
+			f.SubscribeScene = info.SubscribeScene
+			f.QRScene = info.QRSceneStr
+			if f.QRScene == "" && info.QRScene != 0 {
+				f.QRScene = strconv.FormatInt(info.QRScene, 10)
+			}
+		}
+	}
+	s.updateFollowers(fetchedAt, updates)
+
+	s.updateFollowerSync(func(p *FollowerSyncProgress) {
+		p.Fetched += len(result.UserInfoList)
+	})
+	return nil
+}
+
+// mark followers not listed as unsubscribed, unless they subscribed after
+// the synchronization started
+func (s *WXService) markUnlisted(listed map[string]bool, startedAt time.Time) error {
+
+	followers, err := s.followers.List()
+	if err != nil {
+		return err
+	}
+
+	unsubscribe := func(f *Follower) {
+		// when is unknown
+		f.Subscribed = false
+		f.UnsubscribeTime = startedAt
+	}
+	updates := make(map[string]func(f *Follower))
+	for _, f := range followers {
+		if f.Subscribed && !listed[f.OpenID] {
+			updates[f.OpenID] = unsubscribe
+		}
+	}
+
+	unsubscribed := s.updateFollowers(startedAt, updates)
+	s.updateFollowerSync(func(p *FollowerSyncProgress) {
+		p.Unsubscribed += unsubscribed
+	})
+	return nil
+}
+
+// synchronize followers every interval in background
+func (s *WXService) startFollowerSyncSchedule(interval time.Duration) {
+	s.followerSync.Lock()
+	defer s.followerSync.Unlock()
+
+	if s.followerSync.stopCh != nil {
+		return
+	}
+	stopCh := make(chan struct{})
+	s.followerSync.stopCh = stopCh
+
+	go func() {
+		for {
+			select {
+			case <-time.After(interval):
+			case <-stopCh:
+				return
+			}
+			if _, err := s.SyncFollowers(context.Background()); err == ErrFollowerSyncRunning {
+				log.Info("Skip scheduled follower synchronization, already running")
+			}
+		}
+	}()
+}
+
+func (s *WXService) stopFollowerSyncSchedule() {
+	s.followerSync.Lock()
+	defer s.followerSync.Unlock()
+
+	if s.followerSync.stopCh != nil {
+		close(s.followerSync.stopCh)
+		s.followerSync.stopCh = nil
+	}
+}
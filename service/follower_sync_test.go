@@ -0,0 +1,165 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// FollowerStore counting writes
+type countingFollowerStore struct {
+	MemoryFollowerStore
+	puts int32
+}
+
+func (cs *countingFollowerStore) Put(follower *Follower) error {
+	atomic.AddInt32(&cs.puts, 1)
+	return cs.MemoryFollowerStore.Put(follower)
+}
+
+func (cs *countingFollowerStore) PutMany(followers []*Follower) error {
+	atomic.AddInt32(&cs.puts, 1)
+	return cs.MemoryFollowerStore.PutMany(followers)
+}
+
+func TestSyncFollowers(t *testing.T) {
+
+	openIDs := make([]string, 200)
+	for i := range openIDs {
+		openIDs[i] = fmt.Sprintf("O%d", i)
+	}
+
+	var batches int32
+	s, ts := newTestService(&Option{AppID: "wx123", AppSecret: "secret"}, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cgi-bin/token":
+			w.Write([]byte(`{"access_token": "TOKEN", "expires_in": 7200}`))
+		case "/cgi-bin/user/get":
+			// 2 pages followed by an empty one
+			var page []string
+			next := ""
+			switch r.FormValue("next_openid") {
+			case "":
+				page, next = openIDs[:150], "O149"
+			case "O149":
+				page, next = openIDs[150:], "O199"
+			}
+			resp := map[string]interface{}{"total": len(openIDs), "count": len(page), "next_openid": next}
+			if len(page) > 0 {
+				resp["data"] = map[string]interface{}{"openid": page}
+			}
+			json.NewEncoder(w).Encode(resp)
+		case "/cgi-bin/user/info/batchget":
+			atomic.AddInt32(&batches, 1)
+			req := struct {
+				UserList []struct {
+					OpenID string `json:"openid"`
+				} `json:"user_list"`
+			}{}
+			json.NewDecoder(r.Body).Decode(&req)
+			if len(req.UserList) > 100 {
+				w.Write([]byte(`{"errcode": 45158, "errmsg": "too many users"}`))
+				return
+			}
+			list := []map[string]interface{}{}
+			for _, u := range req.UserList {
+				if u.OpenID == "O5" {
+					// unsubscribed since listed
+					list = append(list, map[string]interface{}{"subscribe": 0, "openid": u.OpenID})
+					continue
+				}
+				list = append(list, map[string]interface{}{
+					"subscribe": 1, "openid": u.OpenID, "subscribe_time": 1000,
+					"subscribe_scene": "ADD_SCENE_QR_CODE", "qr_scene": 98765, "qr_scene_str": "",
+				})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"user_info_list": list})
+		}
+	})
+	defer ts.Close()
+
+	store := &countingFollowerStore{MemoryFollowerStore: *NewMemoryFollowerStore()}
+	s.SetFollowerStore(store)
+	past := time.Now().Add(-time.Hour)
+	s.followers.Put(&Follower{OpenID: "GONE", Subscribed: true, UpdatedAt: past})
+	s.followers.Put(&Follower{OpenID: "LEFT", UnsubscribeTime: past, UpdatedAt: past})
+	atomic.StoreInt32(&store.puts, 0)
+
+	progress, err := s.SyncFollowers(nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	if !assert.False(t, progress.Running) || !assert.Equal(t, 200, progress.Total) ||
+		!assert.Equal(t, 200, progress.Listed) || !assert.Equal(t, 200, progress.Fetched) {
+		return
+	}
+	if !assert.Equal(t, 1, progress.Unsubscribed) || !assert.Equal(t, int32(3), atomic.LoadInt32(&batches)) {
+		return
+	}
+	// saved once for each batch, and once for the unlisted
+	if !assert.Equal(t, int32(4), atomic.LoadInt32(&store.puts)) {
+		return
+	}
+
+	{
+		f, err := s.GetFollower("O150")
+		if !assert.Nil(t, err) || !assert.True(t, f.Subscribed) {
+			return
+		}
+		if !assert.Equal(t, time.Unix(1000, 0), f.SubscribeTime) || !assert.Equal(t, "98765", f.QRScene) {
+			return
+		}
+	}
+
+	for _, openID := range []string{"O5", "GONE", "LEFT"} {
+		f, err := s.GetFollower(openID)
+		if !assert.Nil(t, err) || !assert.False(t, f.Subscribed, openID) {
+			return
+		}
+	}
+	if f, _ := s.GetFollower("LEFT"); !assert.Equal(t, past, f.UnsubscribeTime) {
+		return
+	}
+
+	// record updated by later event is left alone
+	s.followers.Put(&Follower{OpenID: "O7", UpdatedAt: time.Now().Add(time.Hour)})
+	if _, err := s.SyncFollowers(nil); !assert.Nil(t, err) {
+		return
+	}
+	if f, _ := s.GetFollower("O7"); !assert.False(t, f.Subscribed) {
+		return
+	}
+}
+
+func TestFollowerSyncRunning(t *testing.T) {
+
+	block := make(chan struct{})
+	s, ts := newTestService(&Option{AppID: "wx123", AppSecret: "secret"}, func(w http.ResponseWriter, r *http.Request) {
+		<-block
+		w.Write([]byte(`{"errcode": 40013, "errmsg": "invalid appid"}`))
+	})
+	defer ts.Close()
+
+	if !assert.Nil(t, s.StartFollowerSync()) {
+		return
+	}
+	if !assert.Equal(t, ErrFollowerSyncRunning, s.StartFollowerSync()) {
+		return
+	}
+	if !assert.True(t, s.FollowerSyncProgress().Running) {
+		return
+	}
+	close(block)
+
+	for i := 0; i < 100 && s.FollowerSyncProgress().Running; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	progress := s.FollowerSyncProgress()
+	if !assert.False(t, progress.Running) || !assert.Contains(t, progress.Error, "40013") {
+		return
+	}
+}
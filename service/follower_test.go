@@ -0,0 +1,117 @@
+package service
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func pushEvent(s *WXService, event string, eventKey string, createTime int64) error {
+	body := fmt.Sprintf(`<xml><ToUserName><![CDATA[gh_account]]></ToUserName>`+
+		`<FromUserName><![CDATA[OPENID]]></FromUserName><CreateTime>%d</CreateTime>`+
+		`<MsgType><![CDATA[event]]></MsgType><Event><![CDATA[%s]]></Event>`+
+		`<EventKey><![CDATA[%s]]></EventKey></xml>`, createTime, event, eventKey)
+	_, err := s.HandleMessage(nil, &PushRequest{Body: []byte(body)})
+	return err
+}
+
+func TestTrackFollower(t *testing.T) {
+
+	s, _ := NewWXService(&Option{Token: "token"})
+
+	if _, err := s.GetFollower("OPENID"); !assert.Equal(t, ErrFollowerNotFound, err) {
+		return
+	}
+
+	if !assert.Nil(t, pushEvent(s, EventSubscribe, "qrscene_123", 1000)) {
+		return
+	}
+	f, err := s.GetFollower("OPENID")
+	if !assert.Nil(t, err) || !assert.True(t, f.Subscribed) {
+		return
+	}
+	if !assert.Equal(t, time.Unix(1000, 0), f.SubscribeTime) ||
+		!assert.Equal(t, SubscribeSceneQRCode, f.SubscribeScene) || !assert.Equal(t, "123", f.QRScene) {
+		return
+	}
+
+	if !assert.Nil(t, pushEvent(s, EventScan, "456", 1010)) {
+		return
+	}
+	if !assert.Nil(t, pushEvent(s, EventUnsubscribe, "", 1020)) {
+		return
+	}
+	f, _ = s.GetFollower("OPENID")
+	if !assert.False(t, f.Subscribed) || !assert.Equal(t, time.Unix(1020, 0), f.UnsubscribeTime) {
+		return
+	}
+	if !assert.Equal(t, "456", f.LastScanScene) || !assert.Equal(t, time.Unix(1010, 0), f.LastScanTime) {
+		return
+	}
+
+	// late event is ignored
+	if !assert.Nil(t, pushEvent(s, EventScan, "789", 1015)) {
+		return
+	}
+	f, _ = s.GetFollower("OPENID")
+	if !assert.False(t, f.Subscribed) || !assert.Equal(t, "456", f.LastScanScene) {
+		return
+	}
+
+	// subscribed again without QR code
+	if !assert.Nil(t, pushEvent(s, EventSubscribe, "", 1030)) {
+		return
+	}
+	f, _ = s.GetFollower("OPENID")
+	if !assert.True(t, f.Subscribed) || !assert.Equal(t, "", f.SubscribeScene) || !assert.Equal(t, "", f.QRScene) {
+		return
+	}
+}
+
+func TestFileFollowerStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "wxtest")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "followers.json")
+
+	fs, err := NewFileFollowerStore(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	if !assert.Nil(t, fs.Put(&Follower{OpenID: "OPENID", Subscribed: true, QRScene: "123"})) {
+		return
+	}
+
+	// saved in background
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !assert.Nil(t, fs.Put(&Follower{OpenID: "OPENID2", Subscribed: true})) {
+		return
+	}
+	if !assert.Nil(t, fs.Flush()) {
+		return
+	}
+
+	fs, err = NewFileFollowerStore(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	f, err := fs.Get("OPENID")
+	if !assert.Nil(t, err) || !assert.True(t, f.Subscribed) || !assert.Equal(t, "123", f.QRScene) {
+		return
+	}
+	if _, err := fs.Get("OPENID2"); !assert.Nil(t, err) {
+		return
+	}
+}
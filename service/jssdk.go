@@ -0,0 +1,93 @@
+package service
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"golang.org/x/net/context"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// manager of jsapi_ticket used to sign JS-SDK config, cached and refreshed
+// in background like access_token
+type JSAPITicketManager struct {
+	*tokenCache
+	accessToken *AccessTokenManager
+}
+
+func NewJSAPITicketManager(accessToken *AccessTokenManager, margin time.Duration) *JSAPITicketManager {
+
+	if margin <= 0 {
+		margin = DefaultAccessTokenRefreshMargin
+	}
+
+	m := &JSAPITicketManager{
+		accessToken: accessToken,
+	}
+	m.tokenCache = newTokenCache("jsapi_ticket of "+accessToken.appID, "jsapi_ticket:"+accessToken.appID, m.fetchTicket, margin)
+
+	return m
+}
+
+func (m *JSAPITicketManager) fetchTicket(ctx context.Context) (*Token, error) {
+
+	params := url.Values{}
+	params.Set("type", "jsapi")
+
+	result := struct {
+		Ticket    string `json:"ticket"`
+		ExpiresIn int    `json:"expires_in"`
+	}{}
+	now := time.Now()
+	if err := m.accessToken.GetJSON(ctx, "/cgi-bin/ticket/getticket", params, &result); err != nil {
+		return nil, err
+	}
+
+	return &Token{
+		Value:     result.Ticket,
+		ExpiresAt: now.Add(time.Duration(result.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// parameters of wx.config on H5 pages
+type JSSDKConfig struct {
+	AppID     string `json:"appId"`
+	Timestamp int64  `json:"timestamp"`
+	NonceStr  string `json:"nonceStr"`
+	Signature string `json:"signature"`
+}
+
+// sign JS-SDK config for page at pageURL, fragment of the URL is ignored
+func (s *WXService) JSSDKConfig(ctx context.Context, pageURL string) (*JSSDKConfig, error) {
+
+	ticket, err := s.jsapiTicket.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if i := strings.Index(pageURL, "#"); i >= 0 {
+		pageURL = pageURL[:i]
+	}
+
+	config := &JSSDKConfig{
+		AppID:     s.option.AppID,
+		Timestamp: time.Now().Unix(),
+		NonceStr:  randomHex(8),
+	}
+	config.Signature = JSSDKSignature(ticket.Value, config.NonceStr, config.Timestamp, pageURL)
+
+	return config, nil
+}
+
+// signature of JS-SDK config, which is SHA1 of the parameters sorted by name
+func JSSDKSignature(ticket, nonceStr string, timestamp int64, pageURL string) string {
+
+	h := sha1.New()
+	h.Write([]byte("jsapi_ticket=" + ticket +
+		"&noncestr=" + nonceStr +
+		"&timestamp=" + strconv.FormatInt(timestamp, 10) +
+		"&url=" + pageURL))
+	return hex.EncodeToString(h.Sum(nil))
+}
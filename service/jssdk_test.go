@@ -0,0 +1,56 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestJSSDKSignature(t *testing.T) {
+	// example in WeChat JS-SDK document
+	sig := JSSDKSignature("sM4AOVdWfPE4DxkXGEs8VMCPGGVi4C3VM0P37wVUCFvkVAy_90u5h9nbSlYy3-Sl-HhTdfl2fzFy1AOcHKP7qg",
+		"Wm3WZYTPz0wzccnW", 1414587457, "http://mp.weixin.qq.com?params=value")
+	if !assert.Equal(t, "0f9de62fce790f9a083d5c99e95740ceb90c27ed", sig) {
+		return
+	}
+}
+
+func TestJSSDKConfig(t *testing.T) {
+
+	fetchCnt := 0
+	s, ts := newTestService(
+		&Option{AppID: "wx123", AppSecret: "secret"},
+		func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			switch r.URL.Path {
+			case "/cgi-bin/token":
+				w.Write([]byte(`{"access_token":"TOKEN","expires_in":7200}`))
+			case "/cgi-bin/ticket/getticket":
+				if q.Get("access_token") != "TOKEN" || q.Get("type") != "jsapi" {
+					w.Write([]byte(`{"errcode":40001,"errmsg":"invalid credential"}`))
+					return
+				}
+				fetchCnt += 1
+				w.Write([]byte(`{"errcode":0,"errmsg":"ok","ticket":"TICKET","expires_in":7200}`))
+			}
+		},
+	)
+	defer ts.Close()
+
+	for i := 0; i < 2; i++ {
+		config, err := s.JSSDKConfig(nil, "https://m.example.com/page?a=b#hash")
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, "wx123", config.AppID) {
+			return
+		}
+		sig := JSSDKSignature("TICKET", config.NonceStr, config.Timestamp, "https://m.example.com/page?a=b")
+		if !assert.Equal(t, sig, config.Signature) {
+			return
+		}
+	}
+	if !assert.Equal(t, 1, fetchCnt) {
+		return
+	}
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"bytes"
+	"github.com/hyt-hz/wxOpenID/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lock shared by replicas, so that only one of them refreshes a token
+type Locker interface {
+	// try to acquire lock of key for at most ttl, ok is false if the lock is
+	// held by someone else, unlock releases the lock if it's still ours
+	TryLock(key string, ttl time.Duration) (unlock func(), ok bool, err error)
+}
+
+// Locker with lock files in a directory, for replicas on the same host, lock
+// file holds its owner and expiry, and is removed by others once expired
+type FileLocker struct {
+	dir string
+}
+
+func NewFileLocker(dir string) (*FileLocker, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileLocker{
+		dir: dir,
+	}, nil
+}
+
+func (fl *FileLocker) TryLock(key string, ttl time.Duration) (unlock func(), ok bool, err error) {
+
+	path := filepath.Join(fl.dir, strings.Replace(key, "/", "_", -1)+".lock")
+	owner := randomHex(16)
+	content := []byte(owner + " " + strconv.FormatInt(time.Now().Add(ttl).UnixNano(), 10))
+
+	for i := 0; i < 2; i++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = f.Write(content)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, false, err
+			}
+
+			unlock = func() {
+				removeLockFile(path, func(data []byte, modTime time.Time) bool {
+					lockOwner, _ := parseLockFile(data)
+					return lockOwner == owner
+				})
+			}
+			return unlock, true, nil
+		}
+		if !os.IsExist(err) {
+			return nil, false, err
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			// released in the meantime
+			continue
+		}
+		data, _ := ioutil.ReadFile(path)
+		lockOwner, expiry := parseLockFile(data)
+		if lockOwner != "" && time.Now().Before(expiry) {
+			return nil, false, nil
+		}
+		// expired, or the owner has not finished writing it yet
+		if lockOwner == "" && time.Since(fi.ModTime()) < ttl {
+			return nil, false, nil
+		}
+
+		// other replica may have removed it and locked again since we read it,
+		// so it's removed only if it's still the expired one
+		log.Warning("Removing expired lock file %s", path)
+		removed := removeLockFile(path, func(current []byte, modTime time.Time) bool {
+			return bytes.Equal(current, data) && modTime.Equal(fi.ModTime())
+		})
+		if !removed {
+			return nil, false, nil
+		}
+	}
+
+	return nil, false, nil
+}
+
+// remove lock file if it's still the one expected, the file is renamed to a
+// unique tombstone first, so that it can be checked without racing with
+// others, and is put back if it turns out to be a new lock
+func removeLockFile(path string, expected func(data []byte, modTime time.Time) bool) bool {
+
+	tombstone := path + "." + randomHex(8) + ".removed"
+	if err := os.Rename(path, tombstone); err != nil {
+		return false
+	}
+	defer os.Remove(tombstone)
+
+	if fi, err := os.Stat(tombstone); err == nil {
+		if data, err := ioutil.ReadFile(tombstone); err == nil && expected(data, fi.ModTime()) {
+			return true
+		}
+	}
+
+	// link fails if yet another lock has been created
+	if err := os.Link(tombstone, path); err != nil {
+		log.Warning("Failed to restore lock file %s: %s", path, err)
+	}
+	return false
+}
+
+// owner and expiry in lock file, owner is empty if lock file is not valid
+func parseLockFile(data []byte) (owner string, expiry time.Time) {
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return "", time.Time{}
+	}
+	nsec, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}
+	}
+
+	return fields[0], time.Unix(0, nsec)
+}
+
+// release lock only if it's still held by the owner
+const redisUnlockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+
+// Locker with Redis SET NX PX, for replicas on different hosts
+type RedisLocker struct {
+	client *redisClient
+	prefix string
+}
+
+func NewRedisLocker(option *RedisOption) *RedisLocker {
+	return &RedisLocker{
+		client: newRedisClient(option),
+		prefix: option.Prefix,
+	}
+}
+
+func (rl *RedisLocker) TryLock(key string, ttl time.Duration) (unlock func(), ok bool, err error) {
+
+	lockKey := rl.prefix + "lock:" + key
+	owner := randomHex(16)
+
+	reply, err := rl.client.Do("SET", lockKey, owner, "NX", "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	if err != nil {
+		return nil, false, err
+	}
+	if reply == nil {
+		return nil, false, nil
+	}
+
+	unlock = func() {
+		if _, err := rl.client.Do("EVAL", redisUnlockScript, "1", lockKey, owner); err != nil {
+			log.Warning("Failed to release lock %s: %s", lockKey, err)
+		}
+	}
+	return unlock, true, nil
+}
@@ -0,0 +1,316 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stand-in of Redis server, supporting only commands we use
+type fakeRedis struct {
+	sync.Mutex
+	listener net.Listener
+	values   map[string]string
+	expiry   map[string]time.Time
+}
+
+func startFakeRedis() *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	fr := &fakeRedis{
+		listener: l,
+		values:   make(map[string]string),
+		expiry:   make(map[string]time.Time),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(conn)
+		}
+	}()
+	return fr
+}
+
+func (fr *fakeRedis) Addr() string {
+	return fr.listener.Addr().String()
+}
+
+func (fr *fakeRedis) Close() {
+	fr.listener.Close()
+}
+
+func (fr *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		reply, err := readRedisReply(r)
+		if err != nil {
+			return
+		}
+		items := reply.([]interface{})
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i] = item.(string)
+		}
+		conn.Write([]byte(fr.exec(args)))
+	}
+}
+
+func (fr *fakeRedis) get(key string) (string, bool) {
+	if exp, ok := fr.expiry[key]; ok && time.Now().After(exp) {
+		delete(fr.values, key)
+		delete(fr.expiry, key)
+	}
+	v, ok := fr.values[key]
+	return v, ok
+}
+
+func (fr *fakeRedis) exec(args []string) string {
+	fr.Lock()
+	defer fr.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "AUTH":
+		if args[1] != "pass" {
+			return "-ERR invalid password\r\n"
+		}
+		return "+OK\r\n"
+	case "GET":
+		v, ok := fr.get(args[1])
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "SET":
+		key := args[1]
+		_, exists := fr.get(key)
+		for _, arg := range args[3:] {
+			if (strings.ToUpper(arg) == "NX" && exists) || (strings.ToUpper(arg) == "XX" && !exists) {
+				return "$-1\r\n"
+			}
+		}
+		fr.values[key] = args[2]
+		delete(fr.expiry, key)
+		for i := 3; i < len(args)-1; i++ {
+			if strings.ToUpper(args[i]) == "PX" {
+				ms, _ := strconv.Atoi(args[i+1])
+				fr.expiry[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			}
+		}
+		return "+OK\r\n"
+	case "DEL":
+		if _, ok := fr.get(args[1]); ok {
+			delete(fr.values, args[1])
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "EVAL":
+		// only the unlock script is supported
+		if v, ok := fr.get(args[3]); ok && v == args[4] {
+			delete(fr.values, args[3])
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func testLocker(t *testing.T, l Locker) {
+
+	unlock, ok, err := l.TryLock("access_token:wx123", time.Second)
+	if !assert.Nil(t, err) || !assert.True(t, ok) {
+		return
+	}
+
+	{
+		_, ok, err := l.TryLock("access_token:wx123", time.Second)
+		if !assert.Nil(t, err) || !assert.False(t, ok) {
+			return
+		}
+		unlock2, ok, err := l.TryLock("jsapi_ticket:wx123", time.Second)
+		if !assert.Nil(t, err) || !assert.True(t, ok) {
+			return
+		}
+		unlock2()
+	}
+
+	unlock()
+	unlock, ok, err = l.TryLock("access_token:wx123", 100*time.Millisecond)
+	if !assert.Nil(t, err) || !assert.True(t, ok) {
+		return
+	}
+
+	// lock expires after ttl
+	time.Sleep(150 * time.Millisecond)
+	unlock2, ok, err := l.TryLock("access_token:wx123", time.Second)
+	if !assert.Nil(t, err) || !assert.True(t, ok) {
+		return
+	}
+
+	// expired lock is taken by others, unlock does not release it
+	unlock()
+	_, ok, err = l.TryLock("access_token:wx123", time.Second)
+	if !assert.Nil(t, err) || !assert.False(t, ok) {
+		return
+	}
+	unlock2()
+}
+
+func TestFileLocker(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "wxtest")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := NewFileLocker(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	testLocker(t, l)
+
+	{
+		// lock file replaced by new lock after it's found expired is put back
+		path := filepath.Join(dir, "replaced.lock")
+		if !assert.Nil(t, ioutil.WriteFile(path, []byte("new 1"), 0600)) {
+			return
+		}
+		removed := removeLockFile(path, func(data []byte, modTime time.Time) bool {
+			return string(data) == "old 1"
+		})
+		if !assert.False(t, removed) {
+			return
+		}
+		data, err := ioutil.ReadFile(path)
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, "new 1", string(data)) {
+			return
+		}
+		tombstones, _ := filepath.Glob(path + ".*")
+		if !assert.Empty(t, tombstones) {
+			return
+		}
+	}
+}
+
+func TestRedisLocker(t *testing.T) {
+
+	fr := startFakeRedis()
+	defer fr.Close()
+
+	testLocker(t, NewRedisLocker(&RedisOption{Addr: fr.Addr(), Password: "pass", Prefix: "wx:"}))
+
+	{
+		l := NewRedisLocker(&RedisOption{Addr: fr.Addr(), Password: "wrong"})
+		_, _, err := l.TryLock("access_token:wx123", time.Second)
+		if !assert.IsType(t, RedisError(""), err) {
+			return
+		}
+	}
+}
+
+func TestRedisTokenStore(t *testing.T) {
+
+	fr := startFakeRedis()
+	defer fr.Close()
+
+	store := NewRedisTokenStore(&RedisOption{Addr: fr.Addr(), Password: "pass", Prefix: "wx:"})
+
+	_, err := store.Load("access_token:wx123")
+	if !assert.Equal(t, ErrTokenNotFound, err) {
+		return
+	}
+
+	expiresAt := time.Now().Add(time.Hour).Round(time.Second)
+	err = store.Save("access_token:wx123", &Token{Value: "TOKEN", ExpiresAt: expiresAt})
+	if !assert.Nil(t, err) {
+		return
+	}
+	token, err := store.Load("access_token:wx123")
+	if !assert.Nil(t, err) {
+		return
+	}
+	if !assert.Equal(t, "TOKEN", token.Value) {
+		return
+	}
+	if !assert.True(t, expiresAt.Equal(token.ExpiresAt)) {
+		return
+	}
+	if _, ok := fr.values["wx:access_token:wx123"]; !assert.True(t, ok) {
+		return
+	}
+}
+
+func TestAccessTokenSharedByReplicas(t *testing.T) {
+
+	fr := startFakeRedis()
+	defer fr.Close()
+	option := &RedisOption{Addr: fr.Addr(), Password: "pass", Prefix: "wx:"}
+
+	var fetchCnt int32
+	s, stop := startTokenServer(&fetchCnt, 100*time.Millisecond, 7200)
+	defer stop()
+
+	replicas := make([]*AccessTokenManager, 3)
+	for i := range replicas {
+		replicas[i] = NewAccessTokenManager("wx123", "secret", s.client, s.apiBase, 0)
+		replicas[i].SetStore(NewRedisTokenStore(option))
+		replicas[i].SetLocker(NewRedisLocker(option))
+	}
+
+	{
+		// only one replica fetches, the others read it from the store
+		wg := sync.WaitGroup{}
+		for _, m := range replicas {
+			wg.Add(1)
+			go func(m *AccessTokenManager) {
+				defer wg.Done()
+				token, err := m.AccessToken(nil)
+				assert.Nil(t, err)
+				assert.Equal(t, "TOKEN1", token)
+			}(m)
+		}
+		wg.Wait()
+		if !assert.Equal(t, int32(1), atomic.LoadInt32(&fetchCnt)) {
+			return
+		}
+	}
+
+	{
+		// token rejected by WeChat is refreshed once for all replicas
+		wg := sync.WaitGroup{}
+		for _, m := range replicas {
+			wg.Add(1)
+			go func(m *AccessTokenManager) {
+				defer wg.Done()
+				m.Invalidate("TOKEN1")
+				token, err := m.AccessToken(nil)
+				assert.Nil(t, err)
+				assert.Equal(t, "TOKEN2", token)
+			}(m)
+		}
+		wg.Wait()
+		if !assert.Equal(t, int32(2), atomic.LoadInt32(&fetchCnt)) {
+			return
+		}
+	}
+}
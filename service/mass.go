@@ -0,0 +1,615 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hyt-hz/wxOpenID/log"
+	"golang.org/x/net/context"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrMassJobNotFound  = errors.New("Mass job not found")
+	ErrNoMassRecipients = errors.New("Either OpenIDs or tag of mass message must be given")
+)
+
+// types of mass messages
+const (
+	MassTypeMPNews  = "mpnews"
+	MassTypeText    = "text"
+	MassTypeVoice   = "voice"
+	MassTypeImage   = "image"
+	MassTypeMPVideo = "mpvideo"
+	MassTypeWXCard  = "wxcard"
+)
+
+// status of mass jobs and their batches, batch status reported by
+// MASSSENDJOBFINISH event is kept as is
+const (
+	MassStatusPending   = "pending"
+	MassStatusSending   = "sending"
+	MassStatusSubmitted = "submitted"
+	MassStatusFailed    = "failed"
+	MassStatusDeleted   = "deleted"
+)
+
+const (
+	// OpenIDs per call of message/mass/send, which requires at least 2
+	MaxMassBatchSize = 10000
+	minMassBatchSize = 2
+	// wait between batches of a job
+	DefaultMassSendInterval = time.Second
+	// finished mass jobs are kept this long
+	massJobRetention = 30 * 24 * time.Hour
+)
+
+const (
+	// batch with the same clientmsgid was sent, e.g. before restart
+	ECMassClientMsgIDUsed = 45065
+)
+
+// images of mass message, at most 8
+type MassImages struct {
+	MediaIDs           []string `json:"media_ids"`
+	Recommend          string   `json:"recommend,omitempty"`
+	NeedOpenComment    int      `json:"need_open_comment,omitempty"`
+	OnlyFansCanComment int      `json:"only_fans_can_comment,omitempty"`
+}
+
+type MassCard struct {
+	CardID string `json:"card_id"`
+}
+
+// content of mass message, in the format of message/mass/send
+type MassMessage struct {
+	MsgType string       `json:"msgtype"`
+	MPNews  *CustomMedia `json:"mpnews,omitempty"`
+	Text    *CustomText  `json:"text,omitempty"`
+	Voice   *CustomMedia `json:"voice,omitempty"`
+	Images  *MassImages  `json:"images,omitempty"`
+	MPVideo *CustomMedia `json:"mpvideo,omitempty"`
+	WXCard  *MassCard    `json:"wxcard,omitempty"`
+	// send mpnews even if it's judged as reprint, 1 to send
+	SendIgnoreReprint int `json:"send_ignore_reprint"`
+}
+
+// mass message not valid for its type
+type MassMessageError string
+
+func (err MassMessageError) Error() string {
+	return "Invalid mass message: " + string(err)
+}
+
+// check that msg has what its type requires
+func (msg *MassMessage) Validate() error {
+	switch msg.MsgType {
+	case MassTypeMPNews:
+		if msg.MPNews == nil || msg.MPNews.MediaID == "" {
+			return MassMessageError("mpnews.media_id missing")
+		}
+	case MassTypeText:
+		if msg.Text == nil || msg.Text.Content == "" {
+			return MassMessageError("text.content missing")
+		}
+	case MassTypeVoice:
+		if msg.Voice == nil || msg.Voice.MediaID == "" {
+			return MassMessageError("voice.media_id missing")
+		}
+	case MassTypeImage:
+		if msg.Images == nil || len(msg.Images.MediaIDs) == 0 || len(msg.Images.MediaIDs) > 8 {
+			return MassMessageError("images.media_ids must have 1 to 8 images")
+		}
+	case MassTypeMPVideo:
+		if msg.MPVideo == nil || msg.MPVideo.MediaID == "" {
+			return MassMessageError("mpvideo.media_id missing")
+		}
+	case MassTypeWXCard:
+		if msg.WXCard == nil || msg.WXCard.CardID == "" {
+			return MassMessageError("wxcard.card_id missing")
+		}
+	default:
+		return MassMessageError("unknown msgtype " + msg.MsgType)
+	}
+	return nil
+}
+
+// a call of message/mass/send or sendall, and its result reported by
+// MASSSENDJOBFINISH event
+type MassBatch struct {
+	// number of OpenIDs, 0 if sent by tag
+	Count       int       `json:"count"`
+	MsgID       int64     `json:"msg_id"`
+	MsgDataID   int64     `json:"msg_data_id"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	TotalCount  int       `json:"total_count"`
+	FilterCount int       `json:"filter_count"`
+	SentCount   int       `json:"sent_count"`
+	ErrorCount  int       `json:"error_count"`
+	FinishedAt  time.Time `json:"finished_at"`
+}
+
+// mass message sent to OpenIDs or followers with a tag, or all followers
+type MassJob struct {
+	ID      string      `json:"id"`
+	Message MassMessage `json:"message"`
+	// recipients, OpenIDs are kept until all batches are sent, so the job can
+	// be resumed after restart
+	OpenIDs []string    `json:"openids,omitempty"`
+	TagID   int64       `json:"tag_id,omitempty"`
+	IsToAll bool        `json:"is_to_all,omitempty"`
+	Status  string      `json:"status"`
+	Error   string      `json:"error,omitempty"`
+	Batches []MassBatch `json:"batches"`
+	// sum of results reported of all batches
+	TotalCount  int       `json:"total_count"`
+	FilterCount int       `json:"filter_count"`
+	SentCount   int       `json:"sent_count"`
+	ErrorCount  int       `json:"error_count"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// all batches are sent or the job is deleted
+func (job *MassJob) finished() bool {
+	return job.Status != MassStatusPending && job.Status != MassStatusSending
+}
+
+func (job *MassJob) sumCounts() {
+	job.TotalCount, job.FilterCount, job.SentCount, job.ErrorCount = 0, 0, 0, 0
+	for _, b := range job.Batches {
+		job.TotalCount += b.TotalCount
+		job.FilterCount += b.FilterCount
+		job.SentCount += b.SentCount
+		job.ErrorCount += b.ErrorCount
+	}
+}
+
+// storage of mass jobs, keyed by job ID
+type MassJobStore interface {
+	Get(id string) (*MassJob, error)
+	Put(job *MassJob) error
+	// job with a batch of msgID
+	FindByMsgID(msgID int64) (*MassJob, error)
+	// all jobs, the latest first
+	List() ([]*MassJob, error)
+}
+
+// MassJobStore in memory, jobs are lost when process exits, finished jobs
+// older than retention are swept when job is put
+type MemoryMassJobStore struct {
+	sync.Mutex
+	jobs      map[string]*MassJob
+	lastSweep time.Time
+}
+
+func NewMemoryMassJobStore() *MemoryMassJobStore {
+	return &MemoryMassJobStore{
+		jobs:      make(map[string]*MassJob),
+		lastSweep: time.Now(),
+	}
+}
+
+// deep copy, as batches are slice
+func copyMassJob(job *MassJob) *MassJob {
+	c := *job
+	c.Batches = append([]MassBatch(nil), job.Batches...)
+	return &c
+}
+
+func (ms *MemoryMassJobStore) Get(id string) (*MassJob, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	job, ok := ms.jobs[id]
+	if !ok {
+		return nil, ErrMassJobNotFound
+	}
+	return copyMassJob(job), nil
+}
+
+func (ms *MemoryMassJobStore) Put(job *MassJob) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	ms.put(job)
+	return nil
+}
+
+func (ms *MemoryMassJobStore) put(job *MassJob) {
+
+	now := time.Now()
+	if now.Sub(ms.lastSweep) > time.Hour {
+		for id, j := range ms.jobs {
+			if j.finished() && now.Sub(j.UpdatedAt) > massJobRetention {
+				delete(ms.jobs, id)
+			}
+		}
+		ms.lastSweep = now
+	}
+
+	ms.jobs[job.ID] = copyMassJob(job)
+}
+
+func (ms *MemoryMassJobStore) FindByMsgID(msgID int64) (*MassJob, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for _, job := range ms.jobs {
+		for _, b := range job.Batches {
+			if b.MsgID == msgID {
+				return copyMassJob(job), nil
+			}
+		}
+	}
+	return nil, ErrMassJobNotFound
+}
+
+func (ms *MemoryMassJobStore) List() ([]*MassJob, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	jobs := make([]*MassJob, 0, len(ms.jobs))
+	for _, job := range ms.jobs {
+		jobs = append(jobs, copyMassJob(job))
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+	})
+	return jobs, nil
+}
+
+// MassJobStore persisted in a JSON file, the whole file is rewritten in
+// background after changes
+type FileMassJobStore struct {
+	MemoryMassJobStore
+	file *jsonFile
+}
+
+func NewFileMassJobStore(path string) (*FileMassJobStore, error) {
+
+	fs := &FileMassJobStore{
+		MemoryMassJobStore: *NewMemoryMassJobStore(),
+		file:               newJSONFile("mass job", path),
+	}
+
+	if err := fs.file.Load(&fs.jobs); err != nil {
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+func (fs *FileMassJobStore) Put(job *MassJob) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	fs.put(job)
+	fs.file.SaveLater(fs, fs.jobs)
+	return nil
+}
+
+// write jobs saved in background to the file
+func (fs *FileMassJobStore) Flush() error {
+	return fs.file.Flush()
+}
+
+// split OpenIDs into batches of message/mass/send, the last batch is never
+// smaller than the minimum
+func splitMassBatches(openIDs []string) [][]string {
+
+	var batches [][]string
+	for start := 0; start < len(openIDs); start += MaxMassBatchSize {
+		end := start + MaxMassBatchSize
+		if end > len(openIDs) {
+			end = len(openIDs)
+		}
+		batches = append(batches, openIDs[start:end])
+	}
+
+	n := len(batches)
+	if n > 1 && len(batches[n-1]) < minMassBatchSize {
+		// move some from the previous batch
+		moved := minMassBatchSize - len(batches[n-1])
+		prev := batches[n-2]
+		batches[n-2] = prev[:len(prev)-moved]
+		batches[n-1] = openIDs[len(openIDs)-len(batches[n-1])-moved:]
+	}
+	return batches
+}
+
+// start to send mass message to OpenIDs, followers with tagID, or all
+// followers, in background, the job is returned with its ID to query it
+func (s *WXService) StartMassJob(msg *MassMessage, openIDs []string, tagID int64, isToAll bool) (*MassJob, error) {
+
+	if err := msg.Validate(); err != nil {
+		return nil, err
+	}
+	if len(openIDs) == 0 && tagID == 0 && !isToAll {
+		return nil, ErrNoMassRecipients
+	}
+	if len(openIDs) == 1 {
+		return nil, MassMessageError(fmt.Sprintf("at least %d OpenIDs required", minMassBatchSize))
+	}
+
+	now := time.Now()
+	job := &MassJob{
+		ID:        randomHex(8),
+		Message:   *msg,
+		OpenIDs:   openIDs,
+		TagID:     tagID,
+		IsToAll:   isToAll,
+		Status:    MassStatusPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := s.massJobs.Put(job); err != nil {
+		return nil, err
+	}
+
+	go s.runMassJob(job.ID)
+	return job, nil
+}
+
+// send batches of mass job not sent yet, it's started by StartMassJob, or
+// resumed after restart
+func (s *WXService) runMassJob(id string) {
+
+	ctx := context.Background()
+	var batches [][]string
+	err := s.updateMassJob(id, func(job *MassJob) {
+		// split again the same way if resumed
+		if len(job.OpenIDs) > 0 {
+			batches = splitMassBatches(job.OpenIDs)
+		}
+		if job.Status != MassStatusPending {
+			return
+		}
+		job.Status = MassStatusSending
+		if batches == nil {
+			job.Batches = []MassBatch{{Status: MassStatusPending}}
+			return
+		}
+		job.Batches = make([]MassBatch, len(batches))
+		for i, b := range batches {
+			job.Batches[i] = MassBatch{Count: len(b), Status: MassStatusPending}
+		}
+	})
+	if err != nil {
+		log.Error("Failed to start mass job %s: %s", id, err)
+		return
+	}
+	job, err := s.massJobs.Get(id)
+	if err != nil {
+		log.Error("Failed to load mass job %s: %s", id, err)
+		return
+	}
+	if job.Status == MassStatusDeleted {
+		log.Info("Mass job %s deleted before sending", id)
+		return
+	}
+
+	interval := s.option.MassSendInterval
+	if interval <= 0 {
+		interval = DefaultMassSendInterval
+	}
+
+	sent := 0
+	for i := range job.Batches {
+		if job.Batches[i].Status != MassStatusPending {
+			// sent before restart
+			continue
+		}
+		if sent > 0 {
+			time.Sleep(interval)
+		}
+		// deleted while sending
+		if current, err := s.massJobs.Get(id); err != nil || current.Status == MassStatusDeleted {
+			log.Info("Mass job %s deleted, %d batches sent", id, sent)
+			return
+		}
+		sent++
+
+		var result struct {
+			MsgID     int64 `json:"msg_id"`
+			MsgDataID int64 `json:"msg_data_id"`
+		}
+		var err error
+		// WeChat rejects the same clientmsgid, so batch sent but not saved
+		// before restart is not sent again
+		clientMsgID := fmt.Sprintf("%s-%d", id, i)
+		if batches != nil {
+			body := struct {
+				ToUser []string `json:"touser"`
+				MassMessage
+				ClientMsgID string `json:"clientmsgid"`
+			}{batches[i], job.Message, clientMsgID}
+			err = s.accessToken.PostJSON(ctx, "/cgi-bin/message/mass/send", nil, &body, &result)
+		} else {
+			type filter struct {
+				IsToAll bool  `json:"is_to_all"`
+				TagID   int64 `json:"tag_id,omitempty"`
+			}
+			body := struct {
+				Filter filter `json:"filter"`
+				MassMessage
+				ClientMsgID string `json:"clientmsgid"`
+			}{filter{job.IsToAll, job.TagID}, job.Message, clientMsgID}
+			err = s.accessToken.PostJSON(ctx, "/cgi-bin/message/mass/sendall", nil, &body, &result)
+		}
+
+		resent := IsWXError(err, ECMassClientMsgIDUsed)
+		if resent {
+			log.Warning("Batch %d of mass job %s was sent before restart, msg_id %d", i, id, result.MsgID)
+		} else if err != nil {
+			log.Error("Failed to send batch %d of mass job %s: %s", i, id, err)
+		}
+		s.updateMassJob(id, func(job *MassJob) {
+			// result is kept even if deleted meanwhile, for the articles to
+			// be deleted
+			if i >= len(job.Batches) {
+				return
+			}
+			b := &job.Batches[i]
+			if err != nil && !resent {
+				b.Status = MassStatusFailed
+				b.Error = err.Error()
+				return
+			}
+			b.Status = MassStatusSubmitted
+			b.MsgID = result.MsgID
+			b.MsgDataID = result.MsgDataID
+		})
+	}
+
+	failed, deleted := 0, false
+	s.updateMassJob(id, func(job *MassJob) {
+		// never moved back from deleted
+		if job.Status == MassStatusDeleted || len(job.Batches) == 0 {
+			deleted = true
+			return
+		}
+		for _, b := range job.Batches {
+			if b.Status == MassStatusFailed {
+				failed++
+			}
+		}
+		if failed == len(job.Batches) {
+			job.Status = MassStatusFailed
+			job.Error = job.Batches[0].Error
+		} else {
+			job.Status = MassStatusSubmitted
+		}
+		job.OpenIDs = nil
+	})
+	if deleted {
+		log.Info("Mass job %s deleted while sending", id)
+		return
+	}
+	log.Info("Mass job %s submitted in %d batches, %d failed", id, len(job.Batches), failed)
+}
+
+// resume mass jobs not finished before restart
+func (s *WXService) resumeMassJobs() {
+
+	jobs, err := s.massJobs.List()
+	if err != nil {
+		log.Error("Failed to load mass jobs to resume: %s", err)
+		return
+	}
+	for _, job := range jobs {
+		if !job.finished() {
+			log.Info("Resume mass job %s", job.ID)
+			go s.runMassJob(job.ID)
+		}
+	}
+}
+
+func (s *WXService) updateMassJob(id string, update func(job *MassJob)) error {
+	s.massLock.Lock()
+	defer s.massLock.Unlock()
+
+	job, err := s.massJobs.Get(id)
+	if err != nil {
+		return err
+	}
+	update(job)
+	job.UpdatedAt = time.Now()
+	return s.massJobs.Put(job)
+}
+
+// update result of mass job batch with MASSSENDJOBFINISH event, observed by
+// router middleware
+func (s *WXService) trackMassJob(ctx context.Context, msg Message) {
+
+	e, ok := msg.(*MassSendJobFinishEvent)
+	if !ok {
+		return
+	}
+
+	s.massLock.Lock()
+	defer s.massLock.Unlock()
+
+	job, err := s.massJobs.FindByMsgID(e.MsgID)
+	if err != nil {
+		log.Warning("Mass message %d finished but its job not found: %s", e.MsgID, err)
+		return
+	}
+
+	for i := range job.Batches {
+		b := &job.Batches[i]
+		if b.MsgID != e.MsgID {
+			continue
+		}
+		b.Status = e.Status
+		b.TotalCount = e.TotalCount
+		b.FilterCount = e.FilterCount
+		b.SentCount = e.SentCount
+		b.ErrorCount = e.ErrorCount
+		b.FinishedAt = time.Unix(e.CreateTime, 0)
+	}
+	job.sumCounts()
+	job.UpdatedAt = time.Now()
+	if err := s.massJobs.Put(job); err != nil {
+		log.Error("Failed to save result of mass job %s: %s", job.ID, err)
+	}
+}
+
+func (s *WXService) GetMassJob(id string) (*MassJob, error) {
+	return s.massJobs.Get(id)
+}
+
+func (s *WXService) ListMassJobs() ([]*MassJob, error) {
+	return s.massJobs.List()
+}
+
+// delete articles of mass job, only mpnews and mpvideo can be deleted, in
+// half an hour after they are sent
+func (s *WXService) DeleteMassJob(ctx context.Context, id string) (*MassJob, error) {
+
+	// marked first, so that batches not sent yet are never sent
+	err := s.updateMassJob(id, func(job *MassJob) {
+		job.Status = MassStatusDeleted
+		job.OpenIDs = nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	job, err := s.massJobs.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range job.Batches {
+		if b.MsgID == 0 {
+			continue
+		}
+		body := struct {
+			MsgID int64 `json:"msg_id"`
+		}{b.MsgID}
+		if err := s.accessToken.PostJSON(ctx, "/cgi-bin/message/mass/delete", nil, &body, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return job, nil
+}
+
+// send mass message to a follower for preview
+func (s *WXService) PreviewMassMessage(ctx context.Context, openID string, msg *MassMessage) error {
+
+	if err := msg.Validate(); err != nil {
+		return err
+	}
+	if openID == "" {
+		return ErrNoMassRecipients
+	}
+
+	body := struct {
+		ToUser string `json:"touser"`
+		MassMessage
+	}{openID, *msg}
+	return s.accessToken.PostJSON(ctx, "/cgi-bin/message/mass/preview", nil, &body, nil)
+}
@@ -0,0 +1,424 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func pushMassSendJobFinish(s *WXService, msgID int64, total, filter, sent, errs int) error {
+	body := fmt.Sprintf(`<xml><ToUserName><![CDATA[gh_account]]></ToUserName>`+
+		`<FromUserName><![CDATA[oR5Gjjl_eiZoUpGozMo7dbBJ362A]]></FromUserName><CreateTime>1394524295</CreateTime>`+
+		`<MsgType><![CDATA[event]]></MsgType><Event><![CDATA[MASSSENDJOBFINISH]]></Event>`+
+		`<MsgID>%d</MsgID><Status><![CDATA[send success]]></Status><TotalCount>%d</TotalCount>`+
+		`<FilterCount>%d</FilterCount><SentCount>%d</SentCount><ErrorCount>%d</ErrorCount></xml>`,
+		msgID, total, filter, sent, errs)
+	_, err := s.HandleMessage(nil, &PushRequest{Body: []byte(body)})
+	return err
+}
+
+// wait until mass job is submitted or failed
+func waitMassJob(s *WXService, id string) (*MassJob, error) {
+	for i := 0; i < 100; i++ {
+		job, err := s.GetMassJob(id)
+		if err != nil {
+			return nil, err
+		}
+		if job.Status == MassStatusSubmitted || job.Status == MassStatusFailed {
+			return job, nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("mass job %s not finished", id)
+}
+
+func TestSplitMassBatches(t *testing.T) {
+
+	openIDs := make([]string, 2*MaxMassBatchSize+1)
+	for i := range openIDs {
+		openIDs[i] = fmt.Sprintf("OPENID%d", i)
+	}
+
+	batches := splitMassBatches(openIDs)
+	if !assert.Len(t, batches, 3) || !assert.Len(t, batches[0], MaxMassBatchSize) ||
+		!assert.Len(t, batches[1], MaxMassBatchSize-1) || !assert.Len(t, batches[2], 2) {
+		return
+	}
+	if !assert.Equal(t, openIDs[2*MaxMassBatchSize-1], batches[2][0]) ||
+		!assert.Equal(t, openIDs[2*MaxMassBatchSize], batches[2][1]) {
+		return
+	}
+
+	batches = splitMassBatches(openIDs[:MaxMassBatchSize])
+	if !assert.Len(t, batches, 1) {
+		return
+	}
+}
+
+func TestValidateMassMessage(t *testing.T) {
+
+	valid := []MassMessage{
+		{MsgType: MassTypeMPNews, MPNews: &CustomMedia{MediaID: "MEDIA"}},
+		{MsgType: MassTypeText, Text: &CustomText{Content: "hello"}},
+		{MsgType: MassTypeImage, Images: &MassImages{MediaIDs: []string{"MEDIA"}}},
+		{MsgType: MassTypeWXCard, WXCard: &MassCard{CardID: "CARD"}},
+	}
+	for _, msg := range valid {
+		if !assert.Nil(t, msg.Validate(), msg.MsgType) {
+			return
+		}
+	}
+
+	invalid := []MassMessage{
+		{MsgType: MassTypeMPNews},
+		{MsgType: MassTypeText, Text: &CustomText{}},
+		{MsgType: MassTypeImage, Images: &MassImages{MediaIDs: make([]string, 9)}},
+		{MsgType: "news", MPNews: &CustomMedia{MediaID: "MEDIA"}},
+	}
+	for _, msg := range invalid {
+		_, ok := msg.Validate().(MassMessageError)
+		if !assert.True(t, ok, msg.MsgType) {
+			return
+		}
+	}
+}
+
+func TestMassJob(t *testing.T) {
+
+	var lock sync.Mutex
+	var sent [][]string
+	deleted := []int64{}
+	s, ts := newTestService(&Option{AppID: "wx123", AppSecret: "secret", MassSendInterval: time.Millisecond},
+		func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			switch r.URL.Path {
+			case "/cgi-bin/token":
+				w.Write([]byte(`{"access_token": "TOKEN", "expires_in": 7200}`))
+			case "/cgi-bin/message/mass/send":
+				req := struct {
+					ToUser      []string `json:"touser"`
+					MsgType     string   `json:"msgtype"`
+					ClientMsgID string   `json:"clientmsgid"`
+				}{}
+				json.NewDecoder(r.Body).Decode(&req)
+				if req.MsgType != MassTypeText || req.ClientMsgID == "" {
+					w.Write([]byte(`{"errcode": 40004, "errmsg": "invalid media type"}`))
+					return
+				}
+				sent = append(sent, req.ToUser)
+				fmt.Fprintf(w, `{"errcode": 0, "errmsg": "send job submission success", "msg_id": %d, "msg_data_id": 0}`, 1000+len(sent))
+			case "/cgi-bin/message/mass/delete":
+				req := struct {
+					MsgID int64 `json:"msg_id"`
+				}{}
+				json.NewDecoder(r.Body).Decode(&req)
+				deleted = append(deleted, req.MsgID)
+				w.Write([]byte(`{"errcode": 0, "errmsg": "ok"}`))
+			}
+		})
+	defer ts.Close()
+
+	msg := &MassMessage{MsgType: MassTypeText, Text: &CustomText{Content: "hello"}}
+	if _, err := s.StartMassJob(msg, nil, 0, false); !assert.Equal(t, ErrNoMassRecipients, err) {
+		return
+	}
+
+	openIDs := make([]string, MaxMassBatchSize+5)
+	for i := range openIDs {
+		openIDs[i] = fmt.Sprintf("OPENID%d", i)
+	}
+	job, err := s.StartMassJob(msg, openIDs, 0, false)
+	if !assert.Nil(t, err) {
+		return
+	}
+	job, err = waitMassJob(s, job.ID)
+	if !assert.Nil(t, err) || !assert.Equal(t, MassStatusSubmitted, job.Status) ||
+		!assert.Len(t, job.Batches, 2) || !assert.Empty(t, job.OpenIDs) {
+		return
+	}
+	if !assert.Equal(t, int64(1001), job.Batches[0].MsgID) || !assert.Equal(t, MaxMassBatchSize, job.Batches[0].Count) ||
+		!assert.Equal(t, int64(1002), job.Batches[1].MsgID) || !assert.Equal(t, 5, job.Batches[1].Count) {
+		return
+	}
+	lock.Lock()
+	if !assert.Len(t, sent, 2) || !assert.Len(t, sent[1], 5) {
+		lock.Unlock()
+		return
+	}
+	lock.Unlock()
+
+	if !assert.Nil(t, pushMassSendJobFinish(s, 1001, 10000, 9990, 9980, 10)) ||
+		!assert.Nil(t, pushMassSendJobFinish(s, 1002, 5, 5, 4, 1)) {
+		return
+	}
+	job, err = s.GetMassJob(job.ID)
+	if !assert.Nil(t, err) || !assert.Equal(t, "send success", job.Batches[1].Status) ||
+		!assert.Equal(t, 10005, job.TotalCount) || !assert.Equal(t, 9995, job.FilterCount) ||
+		!assert.Equal(t, 9984, job.SentCount) || !assert.Equal(t, 11, job.ErrorCount) {
+		return
+	}
+
+	job, err = s.DeleteMassJob(nil, job.ID)
+	if !assert.Nil(t, err) || !assert.Equal(t, MassStatusDeleted, job.Status) ||
+		!assert.Equal(t, []int64{1001, 1002}, deleted) {
+		return
+	}
+
+	if _, err := s.GetMassJob("unknown"); !assert.Equal(t, ErrMassJobNotFound, err) {
+		return
+	}
+}
+
+func TestDeleteSendingMassJob(t *testing.T) {
+
+	var lock sync.Mutex
+	sent := 0
+	s, ts := newTestService(&Option{AppID: "wx123", AppSecret: "secret", MassSendInterval: 100 * time.Millisecond},
+		func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			switch r.URL.Path {
+			case "/cgi-bin/token":
+				w.Write([]byte(`{"access_token": "TOKEN", "expires_in": 7200}`))
+			case "/cgi-bin/message/mass/send":
+				sent++
+				fmt.Fprintf(w, `{"errcode": 0, "errmsg": "send job submission success", "msg_id": %d}`, 1000+sent)
+			case "/cgi-bin/message/mass/delete":
+				w.Write([]byte(`{"errcode": 0, "errmsg": "ok"}`))
+			}
+		})
+	defer ts.Close()
+
+	// deleted before it's started
+	msg := MassMessage{MsgType: MassTypeText, Text: &CustomText{Content: "hello"}}
+	s.massJobs.Put(&MassJob{ID: "DELETED", Message: msg, TagID: 2, Status: MassStatusDeleted, CreatedAt: time.Now()})
+	s.runMassJob("DELETED")
+	if job, err := s.GetMassJob("DELETED"); !assert.Nil(t, err) || !assert.Equal(t, MassStatusDeleted, job.Status) {
+		return
+	}
+
+	openIDs := make([]string, 3*MaxMassBatchSize)
+	for i := range openIDs {
+		openIDs[i] = fmt.Sprintf("OPENID%d", i)
+	}
+	job, err := s.StartMassJob(&msg, openIDs, 0, false)
+	if !assert.Nil(t, err) {
+		return
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := s.DeleteMassJob(nil, job.ID); !assert.Nil(t, err) {
+		return
+	}
+	time.Sleep(300 * time.Millisecond)
+	job, err = s.GetMassJob(job.ID)
+	if !assert.Nil(t, err) || !assert.Equal(t, MassStatusDeleted, job.Status) || !assert.Empty(t, job.OpenIDs) {
+		return
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if !assert.Equal(t, 1, sent) {
+		return
+	}
+}
+
+func TestMassJobByTag(t *testing.T) {
+
+	s, ts := newTestService(&Option{AppID: "wx123", AppSecret: "secret"}, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cgi-bin/token":
+			w.Write([]byte(`{"access_token": "TOKEN", "expires_in": 7200}`))
+		case "/cgi-bin/message/mass/sendall":
+			req := struct {
+				Filter struct {
+					IsToAll bool  `json:"is_to_all"`
+					TagID   int64 `json:"tag_id"`
+				} `json:"filter"`
+				MPNews *CustomMedia `json:"mpnews"`
+			}{}
+			json.NewDecoder(r.Body).Decode(&req)
+			if req.Filter.IsToAll || req.Filter.TagID != 2 || req.MPNews == nil || req.MPNews.MediaID != "MEDIA" {
+				w.Write([]byte(`{"errcode": 40130, "errmsg": "invalid openid list size"}`))
+				return
+			}
+			w.Write([]byte(`{"errcode": 0, "errmsg": "send job submission success", "msg_id": 34182, "msg_data_id": 206227730}`))
+		}
+	})
+	defer ts.Close()
+
+	msg := &MassMessage{MsgType: MassTypeMPNews, MPNews: &CustomMedia{MediaID: "MEDIA"}, SendIgnoreReprint: 1}
+	job, err := s.StartMassJob(msg, nil, 2, false)
+	if !assert.Nil(t, err) {
+		return
+	}
+	job, err = waitMassJob(s, job.ID)
+	if !assert.Nil(t, err) || !assert.Equal(t, MassStatusSubmitted, job.Status) || !assert.Len(t, job.Batches, 1) ||
+		!assert.Equal(t, int64(34182), job.Batches[0].MsgID) || !assert.Equal(t, int64(206227730), job.Batches[0].MsgDataID) {
+		return
+	}
+
+	// rejected by WeChat
+	job, err = s.StartMassJob(msg, nil, 3, false)
+	if !assert.Nil(t, err) {
+		return
+	}
+	job, err = waitMassJob(s, job.ID)
+	if !assert.Nil(t, err) || !assert.Equal(t, MassStatusFailed, job.Status) || !assert.NotEmpty(t, job.Error) {
+		return
+	}
+
+	jobs, err := s.ListMassJobs()
+	if !assert.Nil(t, err) || !assert.Len(t, jobs, 2) {
+		return
+	}
+}
+
+func TestPreviewMassMessage(t *testing.T) {
+
+	s, ts := newTestService(&Option{AppID: "wx123", AppSecret: "secret"}, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cgi-bin/token":
+			w.Write([]byte(`{"access_token": "TOKEN", "expires_in": 7200}`))
+		case "/cgi-bin/message/mass/preview":
+			req := map[string]interface{}{}
+			json.NewDecoder(r.Body).Decode(&req)
+			if req["touser"] != "OPENID" {
+				w.Write([]byte(`{"errcode": 40003, "errmsg": "invalid openid"}`))
+				return
+			}
+			w.Write([]byte(`{"errcode": 0, "errmsg": "preview success", "msg_id": 34182}`))
+		}
+	})
+	defer ts.Close()
+
+	msg := &MassMessage{MsgType: MassTypeText, Text: &CustomText{Content: "hello"}}
+	if !assert.Nil(t, s.PreviewMassMessage(nil, "OPENID", msg)) {
+		return
+	}
+	if err := s.PreviewMassMessage(nil, "UNKNOWN", msg); !assert.True(t, IsWXError(err, ECInvalidOpenID)) {
+		return
+	}
+	if err := s.PreviewMassMessage(nil, "", msg); !assert.Equal(t, ErrNoMassRecipients, err) {
+		return
+	}
+}
+
+func TestFileMassJobStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "wxtest")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mass.json")
+
+	fs, err := NewFileMassJobStore(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	job := &MassJob{ID: "JOB", TagID: 2, Status: MassStatusSubmitted, Batches: []MassBatch{{MsgID: 1001}}}
+	if !assert.Nil(t, fs.Put(job)) {
+		return
+	}
+	if !assert.Nil(t, fs.Flush()) {
+		return
+	}
+
+	fs, err = NewFileMassJobStore(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	loaded, err := fs.FindByMsgID(1001)
+	if !assert.Nil(t, err) || !assert.Equal(t, job, loaded) {
+		return
+	}
+	if _, err := fs.FindByMsgID(1002); !assert.Equal(t, ErrMassJobNotFound, err) {
+		return
+	}
+}
+
+func TestResumeMassJobs(t *testing.T) {
+
+	var lock sync.Mutex
+	var sent []string
+	s, ts := newTestService(&Option{AppID: "wx123", AppSecret: "secret", MassSendInterval: time.Millisecond},
+		func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			switch r.URL.Path {
+			case "/cgi-bin/token":
+				w.Write([]byte(`{"access_token": "TOKEN", "expires_in": 7200}`))
+			case "/cgi-bin/message/mass/send", "/cgi-bin/message/mass/sendall":
+				req := struct {
+					ClientMsgID string `json:"clientmsgid"`
+				}{}
+				json.NewDecoder(r.Body).Decode(&req)
+				sent = append(sent, req.ClientMsgID)
+				if req.ClientMsgID == "TAG-0" {
+					w.Write([]byte(`{"errcode": 45065, "errmsg": "clientmsgid exist", "msg_id": 1003, "msg_data_id": 2003}`))
+					return
+				}
+				w.Write([]byte(`{"errcode": 0, "errmsg": "send job submission success", "msg_id": 1002}`))
+			}
+		})
+	defer ts.Close()
+
+	openIDs := make([]string, MaxMassBatchSize+5)
+	for i := range openIDs {
+		openIDs[i] = fmt.Sprintf("OPENID%d", i)
+	}
+	msg := MassMessage{MsgType: MassTypeText, Text: &CustomText{Content: "hello"}}
+	old := time.Now().Add(-massJobRetention - time.Hour)
+	for _, job := range []*MassJob{
+		// stopped after the first batch
+		{ID: "OPENIDS", Message: msg, OpenIDs: openIDs, Status: MassStatusSending, CreatedAt: old,
+			Batches: []MassBatch{{Count: MaxMassBatchSize, Status: MassStatusSubmitted, MsgID: 1001}, {Count: 5, Status: MassStatusPending}}},
+		// sent but not saved
+		{ID: "TAG", Message: msg, TagID: 2, Status: MassStatusPending, CreatedAt: old},
+		{ID: "DONE", Message: msg, TagID: 2, Status: MassStatusSubmitted, CreatedAt: old, UpdatedAt: old},
+	} {
+		s.massJobs.Put(job)
+	}
+
+	s.resumeMassJobs()
+	for _, id := range []string{"OPENIDS", "TAG"} {
+		job, err := waitMassJob(s, id)
+		if !assert.Nil(t, err) || !assert.Equal(t, MassStatusSubmitted, job.Status, id) || !assert.Empty(t, job.OpenIDs) {
+			return
+		}
+	}
+	lock.Lock()
+	sort.Strings(sent)
+	if !assert.Equal(t, []string{"OPENIDS-1", "TAG-0"}, sent) {
+		lock.Unlock()
+		return
+	}
+	lock.Unlock()
+	if job, _ := s.GetMassJob("OPENIDS"); !assert.Equal(t, int64(1002), job.Batches[1].MsgID) {
+		return
+	}
+	// msg_id returned with 45065 is kept
+	if job, _ := s.GetMassJob("TAG"); !assert.Equal(t, int64(1003), job.Batches[0].MsgID) ||
+		!assert.Equal(t, int64(2003), job.Batches[0].MsgDataID) {
+		return
+	}
+
+	// finished job is swept after retention
+	store := s.massJobs.(*MemoryMassJobStore)
+	store.lastSweep = old
+	s.massJobs.Put(&MassJob{ID: "NEW", Status: MassStatusPending, CreatedAt: time.Now()})
+	if _, err := s.GetMassJob("DONE"); !assert.Equal(t, ErrMassJobNotFound, err) {
+		return
+	}
+	if _, err := s.GetMassJob("OPENIDS"); !assert.Nil(t, err) {
+		return
+	}
+}
@@ -0,0 +1,400 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hyt-hz/wxOpenID/log"
+	"github.com/hyt-hz/wxOpenID/utils"
+	"golang.org/x/net/context"
+	"reflect"
+	"strconv"
+)
+
+var (
+	ErrMenuFileNotConfigured = errors.New("Menu file not configured")
+)
+
+// menu of the Official Account not created yet
+const ECMenuNotExist = 46003
+
+// limits of menus set by WeChat, lengths are in bytes
+const (
+	MaxMenuButtons       = 3
+	MaxMenuSubButtons    = 5
+	MaxMenuNameLength    = 16
+	MaxMenuSubNameLength = 60
+	MaxMenuKeyLength     = 128
+	MaxMenuURLLength     = 1024
+)
+
+// types of menu buttons
+const (
+	MenuTypeClick              = "click"
+	MenuTypeView               = "view"
+	MenuTypeScanCodePush       = "scancode_push"
+	MenuTypeScanCodeWaitMsg    = "scancode_waitmsg"
+	MenuTypePicSysPhoto        = "pic_sysphoto"
+	MenuTypePicPhotoOrAlbum    = "pic_photo_or_album"
+	MenuTypePicWeixin          = "pic_weixin"
+	MenuTypeLocationSelect     = "location_select"
+	MenuTypeMediaID            = "media_id"
+	MenuTypeViewLimited        = "view_limited"
+	MenuTypeArticleID          = "article_id"
+	MenuTypeArticleViewLimited = "article_view_limited"
+	MenuTypeMiniProgram        = "miniprogram"
+)
+
+// menu button, a top-level button either has sub-buttons or acts itself
+type MenuButton struct {
+	Type       string       `yaml:"type" json:"type,omitempty"`
+	Name       string       `yaml:"name" json:"name"`
+	Key        string       `yaml:"key" json:"key,omitempty"`
+	URL        string       `yaml:"url" json:"url,omitempty"`
+	MediaID    string       `yaml:"media_id" json:"media_id,omitempty"`
+	ArticleID  string       `yaml:"article_id" json:"article_id,omitempty"`
+	AppID      string       `yaml:"appid" json:"appid,omitempty"`
+	PagePath   string       `yaml:"pagepath" json:"pagepath,omitempty"`
+	SubButtons []MenuButton `yaml:"sub_button" json:"sub_button,omitempty"`
+}
+
+// followers a conditional menu is shown to, empty fields match anyone
+type MenuMatchRule struct {
+	TagID string `yaml:"tag_id" json:"tag_id,omitempty"`
+	// 1 for male, 2 for female
+	Sex string `yaml:"sex" json:"sex,omitempty"`
+	// 1 for iOS, 2 for Android, 3 for others
+	ClientPlatformType string `yaml:"client_platform_type" json:"client_platform_type,omitempty"`
+	// e.g. zh_CN, zh_TW, en
+	Language string `yaml:"language" json:"language,omitempty"`
+}
+
+// default menu, or conditional menu with match rule
+type Menu struct {
+	Buttons   []MenuButton   `yaml:"button" json:"button"`
+	MatchRule *MenuMatchRule `yaml:"matchrule" json:"matchrule,omitempty"`
+	MenuID    int64          `yaml:"-" json:"menuid,omitempty"`
+}
+
+// menus declared in YAML file, e.g.
+//
+//	button:
+//	  - type: click
+//	    name: Today
+//	    key: V1001_TODAY
+//	conditional:
+//	  - matchrule:
+//	      tag_id: "2"
+//	    button:
+//	      - ...
+type MenuDefinition struct {
+	Buttons     []MenuButton `yaml:"button"`
+	Conditional []Menu       `yaml:"conditional"`
+}
+
+// menu not accepted by WeChat
+type MenuError string
+
+func (err MenuError) Error() string {
+	return "Invalid menu: " + string(err)
+}
+
+// load menu definition from YAML file, path can be either the file or the
+// directory of menu.yaml
+func LoadMenuDefinition(path string) (*MenuDefinition, error) {
+
+	def := &MenuDefinition{}
+	if err := utils.ParseConfigFile(path, "menu.yaml", def); err != nil {
+		return nil, err
+	}
+	if err := def.Validate(); err != nil {
+		return nil, err
+	}
+	return def, nil
+}
+
+// check menus against limits of WeChat
+func (def *MenuDefinition) Validate() error {
+
+	if err := validateMenuButtons(def.Buttons, "button"); err != nil {
+		return err
+	}
+	for i, menu := range def.Conditional {
+		path := fmt.Sprintf("conditional[%d]", i)
+		rule := menu.MatchRule
+		if rule == nil || *rule == (MenuMatchRule{}) {
+			return MenuError(path + ".matchrule missing")
+		}
+		if rule.TagID != "" {
+			if _, err := strconv.ParseInt(rule.TagID, 10, 64); err != nil {
+				return MenuError(path + ".matchrule.tag_id must be a number")
+			}
+		}
+		if rule.Sex != "" && rule.Sex != "1" && rule.Sex != "2" {
+			return MenuError(path + ".matchrule.sex must be 1 or 2")
+		}
+		if rule.ClientPlatformType != "" && rule.ClientPlatformType != "1" &&
+			rule.ClientPlatformType != "2" && rule.ClientPlatformType != "3" {
+			return MenuError(path + ".matchrule.client_platform_type must be 1, 2 or 3")
+		}
+		if err := validateMenuButtons(menu.Buttons, path+".button"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateMenuButtons(buttons []MenuButton, path string) error {
+
+	if len(buttons) == 0 || len(buttons) > MaxMenuButtons {
+		return MenuError(fmt.Sprintf("%s must have 1 to %d buttons", path, MaxMenuButtons))
+	}
+	for i, b := range buttons {
+		bpath := fmt.Sprintf("%s[%d]", path, i)
+		if b.Name == "" || len(b.Name) > MaxMenuNameLength {
+			return MenuError(fmt.Sprintf("%s.name must be 1 to %d bytes", bpath, MaxMenuNameLength))
+		}
+		if len(b.SubButtons) == 0 {
+			if err := validateMenuAction(&b, bpath); err != nil {
+				return err
+			}
+			continue
+		}
+		if b.Type != "" {
+			return MenuError(bpath + ".type must be empty with sub_button")
+		}
+		if len(b.SubButtons) > MaxMenuSubButtons {
+			return MenuError(fmt.Sprintf("%s.sub_button must have at most %d buttons", bpath, MaxMenuSubButtons))
+		}
+		for j, sb := range b.SubButtons {
+			sbpath := fmt.Sprintf("%s.sub_button[%d]", bpath, j)
+			if sb.Name == "" || len(sb.Name) > MaxMenuSubNameLength {
+				return MenuError(fmt.Sprintf("%s.name must be 1 to %d bytes", sbpath, MaxMenuSubNameLength))
+			}
+			if len(sb.SubButtons) > 0 {
+				return MenuError(sbpath + ".sub_button not allowed")
+			}
+			if err := validateMenuAction(&sb, sbpath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// check button has what its type requires
+func validateMenuAction(b *MenuButton, path string) error {
+
+	if len(b.Key) > MaxMenuKeyLength {
+		return MenuError(fmt.Sprintf("%s.key must be at most %d bytes", path, MaxMenuKeyLength))
+	}
+	if len(b.URL) > MaxMenuURLLength {
+		return MenuError(fmt.Sprintf("%s.url must be at most %d bytes", path, MaxMenuURLLength))
+	}
+
+	switch b.Type {
+	case MenuTypeClick, MenuTypeScanCodePush, MenuTypeScanCodeWaitMsg, MenuTypePicSysPhoto,
+		MenuTypePicPhotoOrAlbum, MenuTypePicWeixin, MenuTypeLocationSelect:
+		if b.Key == "" {
+			return MenuError(path + ".key missing")
+		}
+	case MenuTypeView:
+		if b.URL == "" {
+			return MenuError(path + ".url missing")
+		}
+	case MenuTypeMediaID, MenuTypeViewLimited:
+		if b.MediaID == "" {
+			return MenuError(path + ".media_id missing")
+		}
+	case MenuTypeArticleID, MenuTypeArticleViewLimited:
+		if b.ArticleID == "" {
+			return MenuError(path + ".article_id missing")
+		}
+	case MenuTypeMiniProgram:
+		// url is opened by clients not supporting mini-programs
+		if b.URL == "" || b.AppID == "" || b.PagePath == "" {
+			return MenuError(path + " requires url, appid and pagepath")
+		}
+	case "":
+		return MenuError(path + ".type missing")
+	default:
+		return MenuError(path + ".type unknown " + b.Type)
+	}
+	return nil
+}
+
+// button returned by cgi-bin/get_current_selfmenu_info, sub-buttons are
+// wrapped in list, and media_id or article_id is returned as value
+type selfMenuButton struct {
+	Type      string `json:"type"`
+	Name      string `json:"name"`
+	Key       string `json:"key"`
+	URL       string `json:"url"`
+	Value     string `json:"value"`
+	AppID     string `json:"appid"`
+	PagePath  string `json:"pagepath"`
+	SubButton *struct {
+		List []selfMenuButton `json:"list"`
+	} `json:"sub_button"`
+}
+
+func (sb *selfMenuButton) menuButton() MenuButton {
+	b := MenuButton{
+		Type:     sb.Type,
+		Name:     sb.Name,
+		Key:      sb.Key,
+		URL:      sb.URL,
+		AppID:    sb.AppID,
+		PagePath: sb.PagePath,
+	}
+	switch sb.Type {
+	case MenuTypeMediaID, MenuTypeViewLimited:
+		b.MediaID = sb.Value
+	case MenuTypeArticleID, MenuTypeArticleViewLimited:
+		b.ArticleID = sb.Value
+	}
+	if sb.SubButton != nil {
+		for _, sub := range sb.SubButton.List {
+			b.SubButtons = append(b.SubButtons, sub.menuButton())
+		}
+	}
+	return b
+}
+
+// default menu currently in effect, nil if no menu is open
+func (s *WXService) GetCurrentMenu(ctx context.Context) (*Menu, error) {
+
+	result := struct {
+		IsMenuOpen   int `json:"is_menu_open"`
+		SelfMenuInfo struct {
+			Button []selfMenuButton `json:"button"`
+		} `json:"selfmenu_info"`
+	}{}
+	if err := s.accessToken.GetJSON(ctx, "/cgi-bin/get_current_selfmenu_info", nil, &result); err != nil {
+		return nil, err
+	}
+	if result.IsMenuOpen == 0 {
+		return nil, nil
+	}
+
+	menu := &Menu{}
+	for _, b := range result.SelfMenuInfo.Button {
+		menu.Buttons = append(menu.Buttons, b.menuButton())
+	}
+	return menu, nil
+}
+
+// conditional menus created by API
+func (s *WXService) GetConditionalMenus(ctx context.Context) ([]Menu, error) {
+
+	result := struct {
+		ConditionalMenu []Menu `json:"conditionalmenu"`
+	}{}
+	err := s.accessToken.GetJSON(ctx, "/cgi-bin/menu/get", nil, &result)
+	if err != nil {
+		if IsWXError(err, ECMenuNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return result.ConditionalMenu, nil
+}
+
+// compare buttons ignoring difference between empty and missing sub-buttons
+func sameMenuButtons(a, b []MenuButton) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, y := a[i], b[i]
+		if !sameMenuButtons(x.SubButtons, y.SubButtons) {
+			return false
+		}
+		x.SubButtons, y.SubButtons = nil, nil
+		if !reflect.DeepEqual(x, y) {
+			return false
+		}
+	}
+	return true
+}
+
+// create the default menu and conditional menus declared which differ from
+// those in effect, conditional menus not declared are deleted, returns
+// whether anything is changed
+func (s *WXService) ApplyMenu(ctx context.Context, def *MenuDefinition) (changed bool, err error) {
+
+	if err = def.Validate(); err != nil {
+		return false, err
+	}
+
+	current, err := s.GetCurrentMenu(ctx)
+	if err != nil {
+		return false, err
+	}
+	if current == nil || !sameMenuButtons(current.Buttons, def.Buttons) {
+		body := &Menu{Buttons: def.Buttons}
+		if err = s.accessToken.PostJSON(ctx, "/cgi-bin/menu/create", nil, body, nil); err != nil {
+			return false, err
+		}
+		log.Info("Menu created with %d buttons", len(def.Buttons))
+		changed = true
+	}
+
+	conditional, err := s.GetConditionalMenus(ctx)
+	if err != nil {
+		return changed, err
+	}
+
+	// keep existing menus declared as is, delete the others
+	declared := make([]bool, len(def.Conditional))
+	for _, menu := range conditional {
+		kept := false
+		for i, d := range def.Conditional {
+			if !declared[i] && menu.MatchRule != nil && *menu.MatchRule == *d.MatchRule &&
+				sameMenuButtons(menu.Buttons, d.Buttons) {
+				declared[i], kept = true, true
+				break
+			}
+		}
+		if kept {
+			continue
+		}
+		body := struct {
+			MenuID string `json:"menuid"`
+		}{strconv.FormatInt(menu.MenuID, 10)}
+		if err = s.accessToken.PostJSON(ctx, "/cgi-bin/menu/delconditional", nil, &body, nil); err != nil {
+			return changed, err
+		}
+		log.Info("Conditional menu %d deleted", menu.MenuID)
+		changed = true
+	}
+
+	for i, d := range def.Conditional {
+		if declared[i] {
+			continue
+		}
+		result := struct {
+			MenuID string `json:"menuid"`
+		}{}
+		body := &Menu{Buttons: d.Buttons, MatchRule: d.MatchRule}
+		if err = s.accessToken.PostJSON(ctx, "/cgi-bin/menu/addconditional", nil, body, &result); err != nil {
+			return changed, err
+		}
+		log.Info("Conditional menu %s added for %+v", result.MenuID, *d.MatchRule)
+		changed = true
+	}
+
+	return changed, nil
+}
+
+// load menu file configured and apply it
+func (s *WXService) ApplyMenuFile(ctx context.Context) (changed bool, err error) {
+
+	if s.option.MenuFile == "" {
+		return false, ErrMenuFileNotConfigured
+	}
+	def, err := LoadMenuDefinition(s.option.MenuFile)
+	if err != nil {
+		return false, err
+	}
+	return s.ApplyMenu(ctx, def)
+}
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testMenuYAML = `
+button:
+  - type: click
+    name: 今日歌曲
+    key: V1001_TODAY_MUSIC
+  - name: 菜单
+    sub_button:
+      - type: view
+        name: 搜索
+        url: http://www.soso.com/
+      - type: miniprogram
+        name: wxa
+        url: http://mp.weixin.qq.com
+        appid: wx286b93c14bbf93aa
+        pagepath: pages/lunar/index
+conditional:
+  - matchrule:
+      tag_id: "2"
+      client_platform_type: "2"
+    button:
+      - type: click
+        name: 会员
+        key: MEMBER
+`
+
+func TestLoadMenuDefinition(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "wxtest")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	if !assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "menu.yaml"), []byte(testMenuYAML), 0600)) {
+		return
+	}
+
+	def, err := LoadMenuDefinition(dir)
+	if !assert.Nil(t, err) || !assert.Len(t, def.Buttons, 2) || !assert.Len(t, def.Buttons[1].SubButtons, 2) ||
+		!assert.Len(t, def.Conditional, 1) {
+		return
+	}
+	if !assert.Equal(t, "pages/lunar/index", def.Buttons[1].SubButtons[1].PagePath) ||
+		!assert.Equal(t, MenuMatchRule{TagID: "2", ClientPlatformType: "2"}, *def.Conditional[0].MatchRule) {
+		return
+	}
+}
+
+func TestValidateMenuDefinition(t *testing.T) {
+
+	click := MenuButton{Type: MenuTypeClick, Name: "click", Key: "KEY"}
+	valid := MenuDefinition{Buttons: []MenuButton{click}}
+	if !assert.Nil(t, valid.Validate()) {
+		return
+	}
+
+	invalid := []MenuDefinition{
+		{},
+		{Buttons: []MenuButton{click, click, click, click}},
+		// 18 bytes in UTF-8
+		{Buttons: []MenuButton{{Type: MenuTypeClick, Name: "一二三四五六", Key: "KEY"}}},
+		{Buttons: []MenuButton{{Type: MenuTypeClick, Name: "click", Key: strings.Repeat("k", MaxMenuKeyLength+1)}}},
+		{Buttons: []MenuButton{{Type: MenuTypeView, Name: "view", URL: "http://" + strings.Repeat("u", MaxMenuURLLength)}}},
+		{Buttons: []MenuButton{{Type: MenuTypeView, Name: "view"}}},
+		{Buttons: []MenuButton{{Type: MenuTypeMiniProgram, Name: "wxa", AppID: "wx123"}}},
+		{Buttons: []MenuButton{{Type: "news", Name: "news"}}},
+		{Buttons: []MenuButton{{Name: "menu", SubButtons: []MenuButton{click, click, click, click, click, click}}}},
+		{Buttons: []MenuButton{{Name: "menu", SubButtons: []MenuButton{{Name: "sub", SubButtons: []MenuButton{click}}}}}},
+		{Buttons: []MenuButton{click}, Conditional: []Menu{{Buttons: []MenuButton{click}}}},
+		{Buttons: []MenuButton{click}, Conditional: []Menu{{Buttons: []MenuButton{click}, MatchRule: &MenuMatchRule{Sex: "3"}}}},
+		{Buttons: []MenuButton{click}, Conditional: []Menu{{Buttons: []MenuButton{click}, MatchRule: &MenuMatchRule{TagID: "vip"}}}},
+	}
+	for i, def := range invalid {
+		_, ok := def.Validate().(MenuError)
+		if !assert.True(t, ok, "definition %d", i) {
+			return
+		}
+	}
+
+	// sub-buttons allow longer names
+	long := MenuDefinition{Buttons: []MenuButton{{Name: "menu", SubButtons: []MenuButton{
+		{Type: MenuTypeClick, Name: "一二三四五六", Key: "KEY"},
+	}}}}
+	if !assert.Nil(t, long.Validate()) {
+		return
+	}
+}
+
+func TestApplyMenu(t *testing.T) {
+
+	var lock sync.Mutex
+	created := 0
+	deleted := []string{}
+	added := []*MenuMatchRule{}
+	s, ts := newTestService(&Option{AppID: "wx123", AppSecret: "secret"}, func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch r.URL.Path {
+		case "/cgi-bin/token":
+			w.Write([]byte(`{"access_token": "TOKEN", "expires_in": 7200}`))
+		case "/cgi-bin/get_current_selfmenu_info":
+			if created == 0 {
+				w.Write([]byte(`{"is_menu_open": 0}`))
+				return
+			}
+			w.Write([]byte(`{"is_menu_open": 1, "selfmenu_info": {"button": [
+				{"type": "click", "name": "今日歌曲", "key": "V1001_TODAY_MUSIC"},
+				{"name": "菜单", "sub_button": {"list": [
+					{"type": "view", "name": "搜索", "url": "http://www.soso.com/"},
+					{"type": "media_id", "name": "图片", "value": "MEDIA"}
+				]}}
+			]}}`))
+		case "/cgi-bin/menu/get":
+			w.Write([]byte(`{"menu": {"button": [], "menuid": 100}, "conditionalmenu": [
+				{"button": [{"type": "click", "name": "会员", "key": "MEMBER", "sub_button": []}],
+				 "matchrule": {"tag_id": "2", "sex": "", "client_platform_type": "2", "country": ""}, "menuid": 101},
+				{"button": [{"type": "click", "name": "old", "key": "OLD", "sub_button": []}],
+				 "matchrule": {"sex": "1"}, "menuid": 102}
+			]}`))
+		case "/cgi-bin/menu/create":
+			menu := &Menu{}
+			json.NewDecoder(r.Body).Decode(menu)
+			if len(menu.Buttons) != 2 || menu.Buttons[1].SubButtons[1].MediaID != "MEDIA" {
+				w.Write([]byte(`{"errcode": 40016, "errmsg": "invalid button size"}`))
+				return
+			}
+			created++
+			w.Write([]byte(`{"errcode": 0, "errmsg": "ok"}`))
+		case "/cgi-bin/menu/delconditional":
+			req := map[string]string{}
+			json.NewDecoder(r.Body).Decode(&req)
+			deleted = append(deleted, req["menuid"])
+			w.Write([]byte(`{"errcode": 0, "errmsg": "ok"}`))
+		case "/cgi-bin/menu/addconditional":
+			menu := &Menu{}
+			json.NewDecoder(r.Body).Decode(menu)
+			added = append(added, menu.MatchRule)
+			w.Write([]byte(`{"menuid": "103"}`))
+		}
+	})
+	defer ts.Close()
+
+	def := &MenuDefinition{
+		Buttons: []MenuButton{
+			{Type: MenuTypeClick, Name: "今日歌曲", Key: "V1001_TODAY_MUSIC"},
+			{Name: "菜单", SubButtons: []MenuButton{
+				{Type: MenuTypeView, Name: "搜索", URL: "http://www.soso.com/"},
+				{Type: MenuTypeMediaID, Name: "图片", MediaID: "MEDIA"},
+			}},
+		},
+		Conditional: []Menu{
+			{MatchRule: &MenuMatchRule{TagID: "2", ClientPlatformType: "2"},
+				Buttons: []MenuButton{{Type: MenuTypeClick, Name: "会员", Key: "MEMBER"}}},
+			{MatchRule: &MenuMatchRule{Language: "en"},
+				Buttons: []MenuButton{{Type: MenuTypeClick, Name: "member", Key: "MEMBER"}}},
+		},
+	}
+
+	changed, err := s.ApplyMenu(nil, def)
+	if !assert.Nil(t, err) || !assert.True(t, changed) || !assert.Equal(t, 1, created) ||
+		!assert.Equal(t, []string{"102"}, deleted) || !assert.Len(t, added, 1) ||
+		!assert.Equal(t, MenuMatchRule{Language: "en"}, *added[0]) {
+		return
+	}
+
+	menu, err := s.GetCurrentMenu(nil)
+	if !assert.Nil(t, err) || !assert.Equal(t, def.Buttons, menu.Buttons) {
+		return
+	}
+
+	// default menu in effect is kept
+	def.Conditional = def.Conditional[:1]
+	deleted = deleted[:0]
+	changed, err = s.ApplyMenu(nil, def)
+	if !assert.Nil(t, err) || !assert.True(t, changed) || !assert.Equal(t, 1, created) ||
+		!assert.Equal(t, []string{"102"}, deleted) {
+		return
+	}
+
+	if _, err := s.ApplyMenuFile(nil); !assert.Equal(t, ErrMenuFileNotConfigured, err) {
+		return
+	}
+}
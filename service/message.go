@@ -0,0 +1,246 @@
+package service
+
+import (
+	"encoding/xml"
+	"errors"
+)
+
+var (
+	ErrInvalidMessage = errors.New("Invalid WeChat message")
+)
+
+// types of messages pushed by WeChat
+const (
+	MsgTypeText       = "text"
+	MsgTypeImage      = "image"
+	MsgTypeVoice      = "voice"
+	MsgTypeVideo      = "video"
+	MsgTypeShortVideo = "shortvideo"
+	MsgTypeLocation   = "location"
+	MsgTypeLink       = "link"
+	MsgTypeEvent      = "event"
+)
+
+// events pushed by WeChat with MsgType event
+const (
+	EventSubscribe   = "subscribe"
+	EventUnsubscribe = "unsubscribe"
+	EventScan        = "SCAN"
+	EventLocation    = "LOCATION"
+	EventClick       = "CLICK"
+	EventView        = "VIEW"
+	// result of template message sending
+	EventTemplateSendJobFinish = "TEMPLATESENDJOBFINISH"
+	// result of mass message sending
+	EventMassSendJobFinish = "MASSSENDJOBFINISH"
+)
+
+// message or event pushed by WeChat
+type Message interface {
+	Header() *MessageHeader
+}
+
+// fields common to all messages and events
+type MessageHeader struct {
+	ToUserName   string `xml:"ToUserName" json:"ToUserName"`
+	FromUserName string `xml:"FromUserName" json:"FromUserName"`
+	CreateTime   int64  `xml:"CreateTime" json:"CreateTime"`
+	MsgType      string `xml:"MsgType" json:"MsgType"`
+}
+
+func (h *MessageHeader) Header() *MessageHeader {
+	return h
+}
+
+type TextMessage struct {
+	MessageHeader
+	MsgID   int64  `xml:"MsgId" json:"MsgId"`
+	Content string `xml:"Content" json:"Content"`
+}
+
+type ImageMessage struct {
+	MessageHeader
+	MsgID   int64  `xml:"MsgId" json:"MsgId"`
+	PicURL  string `xml:"PicUrl" json:"PicUrl"`
+	MediaID string `xml:"MediaId" json:"MediaId"`
+}
+
+type VoiceMessage struct {
+	MessageHeader
+	MsgID   int64  `xml:"MsgId" json:"MsgId"`
+	MediaID string `xml:"MediaId" json:"MediaId"`
+	Format  string `xml:"Format" json:"Format"`
+	// result of speech recognition, if enabled in MP console
+	Recognition string `xml:"Recognition" json:"Recognition"`
+}
+
+// video or short video message
+type VideoMessage struct {
+	MessageHeader
+	MsgID        int64  `xml:"MsgId" json:"MsgId"`
+	MediaID      string `xml:"MediaId" json:"MediaId"`
+	ThumbMediaID string `xml:"ThumbMediaId" json:"ThumbMediaId"`
+}
+
+type LocationMessage struct {
+	MessageHeader
+	MsgID     int64   `xml:"MsgId" json:"MsgId"`
+	LocationX float64 `xml:"Location_X" json:"Location_X"`
+	LocationY float64 `xml:"Location_Y" json:"Location_Y"`
+	Scale     int     `xml:"Scale" json:"Scale"`
+	Label     string  `xml:"Label" json:"Label"`
+}
+
+type LinkMessage struct {
+	MessageHeader
+	MsgID       int64  `xml:"MsgId" json:"MsgId"`
+	Title       string `xml:"Title" json:"Title"`
+	Description string `xml:"Description" json:"Description"`
+	URL         string `xml:"Url" json:"Url"`
+}
+
+// fields common to all events
+type EventHeader struct {
+	MessageHeader
+	Event string `xml:"Event" json:"Event"`
+}
+
+// user followed us, EventKey is "qrscene_" followed by scene if followed by
+// scanning parametric QR code
+type SubscribeEvent struct {
+	EventHeader
+	EventKey string `xml:"EventKey" json:"EventKey"`
+	Ticket   string `xml:"Ticket" json:"Ticket"`
+}
+
+type UnsubscribeEvent struct {
+	EventHeader
+}
+
+// follower scanned parametric QR code, EventKey is the scene
+type ScanEvent struct {
+	EventHeader
+	EventKey string `xml:"EventKey" json:"EventKey"`
+	Ticket   string `xml:"Ticket" json:"Ticket"`
+}
+
+// location reported when user enters the conversation
+type LocationEvent struct {
+	EventHeader
+	Latitude  float64 `xml:"Latitude" json:"Latitude"`
+	Longitude float64 `xml:"Longitude" json:"Longitude"`
+	Precision float64 `xml:"Precision" json:"Precision"`
+}
+
+// user clicked menu of click type
+type ClickEvent struct {
+	EventHeader
+	EventKey string `xml:"EventKey" json:"EventKey"`
+}
+
+// user clicked menu of view type, EventKey is the URL
+type ViewEvent struct {
+	EventHeader
+	EventKey string `xml:"EventKey" json:"EventKey"`
+	MenuID   string `xml:"MenuId" json:"MenuId"`
+}
+
+// template message sent, Status is "success", "failed:user block" or
+// "failed:system failed"
+type TemplateSendJobFinishEvent struct {
+	EventHeader
+	MsgID  int64  `xml:"MsgID" json:"MsgID"`
+	Status string `xml:"Status" json:"Status"`
+}
+
+// mass message sent, Status is "send success", "send fail" or "err(num)",
+// FilterCount is the number of users the message is sent to after filtered
+// by their settings, of which SentCount succeeded and ErrorCount failed
+type MassSendJobFinishEvent struct {
+	EventHeader
+	MsgID       int64  `xml:"MsgID" json:"MsgID"`
+	Status      string `xml:"Status" json:"Status"`
+	TotalCount  int    `xml:"TotalCount" json:"TotalCount"`
+	FilterCount int    `xml:"FilterCount" json:"FilterCount"`
+	SentCount   int    `xml:"SentCount" json:"SentCount"`
+	ErrorCount  int    `xml:"ErrorCount" json:"ErrorCount"`
+}
+
+// message or event of type we don't know, kept in its raw XML
+type UnknownMessage struct {
+	EventHeader
+	Raw string `xml:"-" json:"Raw"`
+}
+
+// parse XML message pushed by WeChat into typed struct
+func ParseMessage(data []byte) (Message, error) {
+
+	header := &EventHeader{}
+	if err := xml.Unmarshal(data, header); err != nil {
+		return nil, ErrInvalidMessage
+	}
+	if header.MsgType == "" || header.FromUserName == "" {
+		return nil, ErrInvalidMessage
+	}
+
+	var msg Message
+	switch header.MsgType {
+	case MsgTypeText:
+		msg = &TextMessage{}
+	case MsgTypeImage:
+		msg = &ImageMessage{}
+	case MsgTypeVoice:
+		msg = &VoiceMessage{}
+	case MsgTypeVideo, MsgTypeShortVideo:
+		msg = &VideoMessage{}
+	case MsgTypeLocation:
+		msg = &LocationMessage{}
+	case MsgTypeLink:
+		msg = &LinkMessage{}
+	case MsgTypeEvent:
+		switch header.Event {
+		case EventSubscribe:
+			msg = &SubscribeEvent{}
+		case EventUnsubscribe:
+			msg = &UnsubscribeEvent{}
+		case EventScan:
+			msg = &ScanEvent{}
+		case EventLocation:
+			msg = &LocationEvent{}
+		case EventClick:
+			msg = &ClickEvent{}
+		case EventView:
+			msg = &ViewEvent{}
+		case EventTemplateSendJobFinish:
+			msg = &TemplateSendJobFinishEvent{}
+		case EventMassSendJobFinish:
+			msg = &MassSendJobFinishEvent{}
+		}
+	}
+
+	if msg == nil {
+		return &UnknownMessage{
+			EventHeader: *header,
+			Raw:         string(data),
+		}, nil
+	}
+
+	if err := xml.Unmarshal(data, msg); err != nil {
+		return nil, ErrInvalidMessage
+	}
+	return msg, nil
+}
+
+// event name of msg, empty if it's not an event
+func EventOf(msg Message) string {
+	if e, ok := msg.(interface {
+		eventHeader() *EventHeader
+	}); ok {
+		return e.eventHeader().Event
+	}
+	return ""
+}
+
+func (h *EventHeader) eventHeader() *EventHeader {
+	return h
+}
@@ -0,0 +1,211 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/hyt-hz/wxOpenID/wxcrypt"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+func TestParseMessage(t *testing.T) {
+
+	{
+		msg, err := ParseMessage([]byte(`<xml><ToUserName><![CDATA[toUser]]></ToUserName>
+			<FromUserName><![CDATA[fromUser]]></FromUserName><CreateTime>1348831860</CreateTime>
+			<MsgType><![CDATA[text]]></MsgType><Content><![CDATA[this is a test]]></Content>
+			<MsgId>1234567890123456</MsgId></xml>`))
+		if !assert.Nil(t, err) {
+			return
+		}
+		text, ok := msg.(*TextMessage)
+		if !assert.True(t, ok) {
+			return
+		}
+		if !assert.Equal(t, "fromUser", text.FromUserName) {
+			return
+		}
+		if !assert.Equal(t, "this is a test", text.Content) {
+			return
+		}
+		if !assert.Equal(t, int64(1234567890123456), text.MsgID) {
+			return
+		}
+		if !assert.Equal(t, "", EventOf(msg)) {
+			return
+		}
+	}
+
+	{
+		msg, err := ParseMessage([]byte(`<xml><ToUserName><![CDATA[toUser]]></ToUserName>
+			<FromUserName><![CDATA[FromUser]]></FromUserName><CreateTime>123456789</CreateTime>
+			<MsgType><![CDATA[location]]></MsgType><Location_X>23.134521</Location_X>
+			<Location_Y>113.358803</Location_Y><Scale>20</Scale><Label><![CDATA[place]]></Label>
+			<MsgId>1234567890123456</MsgId></xml>`))
+		if !assert.Nil(t, err) {
+			return
+		}
+		location, ok := msg.(*LocationMessage)
+		if !assert.True(t, ok) {
+			return
+		}
+		if !assert.Equal(t, 23.134521, location.LocationX) {
+			return
+		}
+		if !assert.Equal(t, 20, location.Scale) {
+			return
+		}
+		// forwarded to webhooks in JSON, named as in XML
+		data, _ := json.Marshal(msg)
+		fields := map[string]interface{}{}
+		if !assert.Nil(t, json.Unmarshal(data, &fields)) {
+			return
+		}
+		if !assert.Equal(t, 23.134521, fields["Location_X"]) || !assert.Equal(t, "FromUser", fields["FromUserName"]) ||
+			!assert.Equal(t, float64(1234567890123456), fields["MsgId"]) {
+			return
+		}
+	}
+
+	{
+		msg, err := ParseMessage([]byte(`<xml><ToUserName><![CDATA[toUser]]></ToUserName>
+			<FromUserName><![CDATA[FromUser]]></FromUserName><CreateTime>123456789</CreateTime>
+			<MsgType><![CDATA[event]]></MsgType><Event><![CDATA[subscribe]]></Event>
+			<EventKey><![CDATA[qrscene_123123]]></EventKey><Ticket><![CDATA[TICKET]]></Ticket></xml>`))
+		if !assert.Nil(t, err) {
+			return
+		}
+		subscribe, ok := msg.(*SubscribeEvent)
+		if !assert.True(t, ok) {
+			return
+		}
+		if !assert.Equal(t, "qrscene_123123", subscribe.EventKey) {
+			return
+		}
+		if !assert.Equal(t, EventSubscribe, EventOf(msg)) {
+			return
+		}
+	}
+
+	{
+		msg, err := ParseMessage([]byte(`<xml><ToUserName><![CDATA[toUser]]></ToUserName>
+			<FromUserName><![CDATA[FromUser]]></FromUserName><CreateTime>123456789</CreateTime>
+			<MsgType><![CDATA[event]]></MsgType><Event><![CDATA[scancode_push]]></Event></xml>`))
+		if !assert.Nil(t, err) {
+			return
+		}
+		unknown, ok := msg.(*UnknownMessage)
+		if !assert.True(t, ok) {
+			return
+		}
+		if !assert.Equal(t, "scancode_push", unknown.Event) {
+			return
+		}
+		data, _ := json.Marshal(msg)
+		fields := map[string]interface{}{}
+		if !assert.Nil(t, json.Unmarshal(data, &fields)) || !assert.Contains(t, fields["Raw"], "<Event><![CDATA[scancode_push]]></Event>") {
+			return
+		}
+	}
+
+	{
+		_, err := ParseMessage([]byte(`not xml`))
+		if !assert.Equal(t, ErrInvalidMessage, err) {
+			return
+		}
+	}
+}
+
+func TestHandleEncryptedMessage(t *testing.T) {
+
+	// test vector of WeChat message encryption sample code
+	encrypted := "hyzAe4OzmOMbd6TvGdIOO6uBmdJoD0Fk53REIHvxYtJlE2B655HuD0m8KUePWB3+LrPXo87wzQ1QLvbeUgmBM4x6" +
+		"F8PGHQHFVAFmOD2LdJF9FrXpbUAh0B5GIItb52sn896wVsMSHGuPE328HnRGBcrS7C41IzDWyWNlZkyyXwon8T332jisa+h6" +
+		"tEDYsVticbSnyU8dKOIbgU6ux5VTjg3yt+WGzjlpKn6NPhRjpA912xMezR4kw6KWwMrCVKSVCZciVGCgavjIQ6X8tCOp3yZb" +
+		"Gpy0VxpAe+77TszTfRd5RJSVO/HTnifJpXgCSUdUue1v6h0EIBYYI1BD1DlD+C0CR8e6OewpusjZ4uBl9FyJvnhvQl+q5rv1" +
+		"ixrcpCumEPo5MJSgM9ehVsNPfUM669WuMyVWQLCzpu9GhglF2PE="
+	safeBody := []byte(`<xml><ToUserName><![CDATA[gh_10f6c3c3ac5a]]></ToUserName>` +
+		`<Encrypt><![CDATA[` + encrypted + `]]></Encrypt></xml>`)
+	compatibleBody := []byte(`<xml><ToUserName><![CDATA[gh_10f6c3c3ac5a]]></ToUserName>` +
+		`<FromUserName><![CDATA[oyORnuP8q7ou2gfYjqLzSIWZf0rs]]></FromUserName>` +
+		`<CreateTime>1409735668</CreateTime><MsgType><![CDATA[text]]></MsgType>` +
+		`<Content><![CDATA[plain]]></Content><MsgId>6054768590064713728</MsgId>` +
+		`<Encrypt><![CDATA[` + encrypted + `]]></Encrypt></xml>`)
+
+	s, _ := NewWXService(&Option{Token: "spamtest", AppID: "wx2c2769f8efd9abc2"})
+	content := make(chan string, 1)
+	s.Router().HandleMsgType(MsgTypeText, func(ctx context.Context, msg Message) Reply {
+		content <- msg.(*TextMessage).Content
+		return nil
+	})
+
+	req := &PushRequest{
+		Timestamp:    "1409735669",
+		Nonce:        "1320562132",
+		EncryptType:  EncryptTypeAES,
+		MsgSignature: "5d197aaffba7e9b25a30732f161a50dee96bd5fa",
+		Body:         safeBody,
+	}
+
+	{
+		// not configured
+		_, err := s.HandleMessage(nil, req)
+		if !assert.Equal(t, ErrEncryptionNotConfigured, err) {
+			return
+		}
+	}
+
+	{
+		// compatible mode falls back to plaintext if not configured
+		req := *req
+		req.Body = compatibleBody
+		_, err := s.HandleMessage(nil, &req)
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, "plain", <-content) {
+			return
+		}
+	}
+
+	crypter, err := wxcrypt.NewCrypter("spamtest", "abcdefghijklmnopqrstuvwxyz0123456789ABCDEFG", "wx2c2769f8efd9abc2")
+	if !assert.Nil(t, err) {
+		return
+	}
+	s.SetCrypter(crypter)
+
+	{
+		// the same message is pushed in every case, forget it to handle again
+		s.SetDedupStore(NewMemoryDedupStore(0, 0))
+		_, err := s.HandleMessage(nil, req)
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, "abcdteT", <-content) {
+			return
+		}
+	}
+
+	{
+		// ciphertext is preferred in compatible mode
+		s.SetDedupStore(NewMemoryDedupStore(0, 0))
+		req := *req
+		req.Body = compatibleBody
+		_, err := s.HandleMessage(nil, &req)
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, "abcdteT", <-content) {
+			return
+		}
+	}
+
+	{
+		req := *req
+		req.Nonce = "1320562133"
+		_, err := s.HandleMessage(nil, &req)
+		if !assert.Equal(t, wxcrypt.ErrInvalidSignature, err) {
+			return
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownMiniProgram = errors.New("Mini-program not configured")
+	ErrSessionNotFound    = errors.New("Mini-program session not found or expired")
+)
+
+const (
+	DefaultMiniProgramSessionTTL = 2 * time.Hour
+)
+
+// AppID and AppSecret of a mini-program
+type MiniProgramOption struct {
+	AppID     string `yaml:"app_id"`
+	AppSecret string `yaml:"app_secret"`
+	// field schemas of subscribe message templates by template ID, mapping
+	// field keys to types, e.g. thing1: thing
+	SubscribeTemplates map[string]map[string]string `yaml:"subscribe_templates"`
+}
+
+func (o MiniProgramOption) String() string {
+	type option MiniProgramOption
+	c := option(o)
+	c.AppSecret = RedactSecret(c.AppSecret)
+	return fmt.Sprintf("%+v", c)
+}
+
+// mini-program login session, session_key must never be sent to client
+type MiniProgramSession struct {
+	ID         string    `json:"id"`
+	AppID      string    `json:"appid"`
+	OpenID     string    `json:"openid"`
+	UnionID    string    `json:"unionid"`
+	SessionKey string    `json:"session_key"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// storage of mini-program sessions, keyed by session ID
+type SessionStore interface {
+	Get(id string) (*MiniProgramSession, error)
+	Put(session *MiniProgramSession) error
+}
+
+// SessionStore in memory, expired sessions are swept when new session is put
+type MemorySessionStore struct {
+	sync.Mutex
+	sessions  map[string]MiniProgramSession
+	lastSweep time.Time
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions:  make(map[string]MiniProgramSession),
+		lastSweep: time.Now(),
+	}
+}
+
+func (ms *MemorySessionStore) Get(id string) (*MiniProgramSession, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	session, ok := ms.sessions[id]
+	if !ok || time.Now().After(session.ExpiresAt) {
+		return nil, ErrSessionNotFound
+	}
+	return &session, nil
+}
+
+func (ms *MemorySessionStore) Put(session *MiniProgramSession) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	now := time.Now()
+	if now.Sub(ms.lastSweep) > time.Minute {
+		for id, s := range ms.sessions {
+			if now.After(s.ExpiresAt) {
+				delete(ms.sessions, id)
+			}
+		}
+		ms.lastSweep = now
+	}
+
+	ms.sessions[session.ID] = *session
+	return nil
+}
+
+// exchange js_code got from wx.login for OpenID and session_key, and create
+// a session keeping the session_key on server side
+func (s *WXService) Code2Session(ctx context.Context, appID string, jsCode string) (*MiniProgramSession, error) {
+
+	mp, ok := s.miniPrograms[appID]
+	if !ok {
+		return nil, ErrUnknownMiniProgram
+	}
+
+	params := url.Values{}
+	params.Set("appid", mp.AppID)
+	params.Set("secret", mp.AppSecret)
+	params.Set("js_code", jsCode)
+	params.Set("grant_type", "authorization_code")
+
+	result := struct {
+		OpenID     string `json:"openid"`
+		UnionID    string `json:"unionid"`
+		SessionKey string `json:"session_key"`
+	}{}
+	if err := getJSON(ctx, s.client, s.apiBase+"/sns/jscode2session", params, &result); err != nil {
+		return nil, err
+	}
+
+	ttl := s.option.MiniProgramSessionTTL
+	if ttl <= 0 {
+		ttl = DefaultMiniProgramSessionTTL
+	}
+	session := &MiniProgramSession{
+		ID:         randomHex(16),
+		AppID:      appID,
+		OpenID:     result.OpenID,
+		UnionID:    result.UnionID,
+		SessionKey: result.SessionKey,
+		ExpiresAt:  time.Now().Add(ttl),
+	}
+	if err := s.sessions.Put(session); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
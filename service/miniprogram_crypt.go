@@ -0,0 +1,122 @@
+package service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var (
+	ErrInvalidEncryptedData = errors.New("Invalid mini-program encrypted data")
+	ErrWatermarkMismatch    = errors.New("Mini-program data watermark mismatch")
+	ErrWatermarkExpired     = errors.New("Mini-program data watermark expired")
+	ErrInvalidRawSignature  = errors.New("Invalid mini-program rawData signature")
+)
+
+// how far the watermark timestamp of encrypted data can be from now
+const DataWatermarkTolerance = 10 * time.Minute
+
+type dataWatermark struct {
+	AppID     string `json:"appid"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// decrypt encryptedData of wx.getUserInfo/getPhoneNumber etc. with session_key
+// of the session, watermark of the data is checked against the session and
+// removed from the returned data
+func (s *WXService) DecryptMiniProgramData(sessionID, encryptedData, iv string) (map[string]interface{}, error) {
+
+	session, err := s.sessions.Get(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := DecryptUserData(session.SessionKey, encryptedData, iv)
+	if err != nil {
+		return nil, err
+	}
+
+	data := struct {
+		Watermark dataWatermark `json:"watermark"`
+	}{}
+	if err = json.Unmarshal(plain, &data); err != nil {
+		return nil, ErrInvalidEncryptedData
+	}
+	if data.Watermark.AppID != session.AppID {
+		return nil, ErrWatermarkMismatch
+	}
+	stamp := time.Unix(data.Watermark.Timestamp, 0)
+	if time.Since(stamp) > DataWatermarkTolerance || stamp.Sub(time.Now()) > DataWatermarkTolerance {
+		return nil, ErrWatermarkExpired
+	}
+
+	result := make(map[string]interface{})
+	if err = json.Unmarshal(plain, &result); err != nil {
+		return nil, ErrInvalidEncryptedData
+	}
+	delete(result, "watermark")
+
+	return result, nil
+}
+
+// verify signature of rawData returned by wx.getUserInfo, which is
+// sha1(rawData + session_key)
+func (s *WXService) VerifyMiniProgramRawData(sessionID, rawData, signature string) error {
+
+	session, err := s.sessions.Get(sessionID)
+	if err != nil {
+		return err
+	}
+
+	h := sha1.New()
+	h.Write([]byte(rawData + session.SessionKey))
+	expected := hex.EncodeToString(h.Sum(nil))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(signature)) != 1 {
+		return ErrInvalidRawSignature
+	}
+
+	return nil
+}
+
+// decrypt mini-program data with AES-128-CBC, key and iv are base64 encoded
+// session_key and iv, and data is PKCS#7 padded
+func DecryptUserData(sessionKey, encryptedData, iv string) ([]byte, error) {
+
+	key, err := base64.StdEncoding.DecodeString(sessionKey)
+	if err != nil || len(key) != 16 {
+		return nil, ErrInvalidEncryptedData
+	}
+	ivBytes, err := base64.StdEncoding.DecodeString(iv)
+	if err != nil || len(ivBytes) != aes.BlockSize {
+		return nil, ErrInvalidEncryptedData
+	}
+	data, err := base64.StdEncoding.DecodeString(encryptedData)
+	if err != nil || len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, ErrInvalidEncryptedData
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, ivBytes).CryptBlocks(plain, data)
+
+	pad := int(plain[len(plain)-1])
+	if pad < 1 || pad > aes.BlockSize {
+		return nil, ErrInvalidEncryptedData
+	}
+	for _, b := range plain[len(plain)-pad:] {
+		if int(b) != pad {
+			return nil, ErrInvalidEncryptedData
+		}
+	}
+
+	return plain[:len(plain)-pad], nil
+}
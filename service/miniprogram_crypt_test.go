@@ -0,0 +1,117 @@
+package service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const (
+	testSessionKey = "tiihtNczf5v6AKRyjwEUhQ=="
+	testIV         = "r7BXXKkLb8qrSNn05n0qiA=="
+)
+
+// encrypt data as WeChat does for mini-program
+func encryptUserData(sessionKey, iv string, plain []byte) string {
+	key, _ := base64.StdEncoding.DecodeString(sessionKey)
+	ivBytes, _ := base64.StdEncoding.DecodeString(iv)
+
+	pad := aes.BlockSize - len(plain)%aes.BlockSize
+	for i := 0; i < pad; i++ {
+		plain = append(plain, byte(pad))
+	}
+
+	block, _ := aes.NewCipher(key)
+	data := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, ivBytes).CryptBlocks(data, plain)
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func TestDecryptMiniProgramData(t *testing.T) {
+
+	s, _ := NewWXService(&Option{})
+	s.sessions.Put(&MiniProgramSession{
+		ID:         "SID",
+		AppID:      "wxmp",
+		SessionKey: testSessionKey,
+		ExpiresAt:  time.Now().Add(time.Hour),
+	})
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	{
+		data := encryptUserData(testSessionKey, testIV,
+			[]byte(`{"phoneNumber":"13580006666","countryCode":"86","watermark":{"appid":"wxmp","timestamp":`+now+`}}`))
+		result, err := s.DecryptMiniProgramData("SID", data, testIV)
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, "13580006666", result["phoneNumber"]) {
+			return
+		}
+		if !assert.Nil(t, result["watermark"]) {
+			return
+		}
+	}
+
+	{
+		data := encryptUserData(testSessionKey, testIV,
+			[]byte(`{"openId":"OPENID","watermark":{"appid":"wxother","timestamp":`+now+`}}`))
+		_, err := s.DecryptMiniProgramData("SID", data, testIV)
+		if !assert.Equal(t, ErrWatermarkMismatch, err) {
+			return
+		}
+	}
+
+	{
+		data := encryptUserData(testSessionKey, testIV,
+			[]byte(`{"openId":"OPENID","watermark":{"appid":"wxmp","timestamp":1477314187}}`))
+		_, err := s.DecryptMiniProgramData("SID", data, testIV)
+		if !assert.Equal(t, ErrWatermarkExpired, err) {
+			return
+		}
+	}
+
+	{
+		// encrypted with another key
+		data := encryptUserData("AAAAAAAAAAAAAAAAAAAAAA==", testIV, []byte(`{"openId":"OPENID"}`))
+		_, err := s.DecryptMiniProgramData("SID", data, testIV)
+		if !assert.NotNil(t, err) {
+			return
+		}
+	}
+
+	{
+		_, err := s.DecryptMiniProgramData("SID", "abc", testIV)
+		if !assert.Equal(t, ErrInvalidEncryptedData, err) {
+			return
+		}
+		_, err = s.DecryptMiniProgramData("NOSID", "abc", testIV)
+		if !assert.Equal(t, ErrSessionNotFound, err) {
+			return
+		}
+	}
+}
+
+func TestVerifyMiniProgramRawData(t *testing.T) {
+
+	s, _ := NewWXService(&Option{})
+	s.sessions.Put(&MiniProgramSession{
+		ID:         "SID",
+		SessionKey: "HyVFkGl5F5OQWJZZaNzBBg==",
+		ExpiresAt:  time.Now().Add(time.Hour),
+	})
+
+	// sha1('{"nickName":"Band"}' + "HyVFkGl5F5OQWJZZaNzBBg==")
+	err := s.VerifyMiniProgramRawData("SID", `{"nickName":"Band"}`, "19036804514e3177482cf7382c6a337cf79b246d")
+	if !assert.Nil(t, err) {
+		return
+	}
+	err = s.VerifyMiniProgramRawData("SID", `{"nickName":"Bond"}`, "19036804514e3177482cf7382c6a337cf79b246d")
+	if !assert.Equal(t, ErrInvalidRawSignature, err) {
+		return
+	}
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCode2Session(t *testing.T) {
+
+	s, ts := newTestService(
+		&Option{MiniPrograms: []MiniProgramOption{{AppID: "wxmp", AppSecret: "secret"}}},
+		func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			if r.URL.Path != "/sns/jscode2session" || q.Get("appid") != "wxmp" || q.Get("secret") != "secret" {
+				w.Write([]byte(`{"errcode":40013,"errmsg":"invalid appid"}`))
+				return
+			}
+			if q.Get("js_code") != "good" {
+				w.Write([]byte(`{"errcode":40029,"errmsg":"invalid code"}`))
+				return
+			}
+			w.Write([]byte(`{"openid":"OPENID","session_key":"KEY","unionid":"UNIONID"}`))
+		},
+	)
+	defer ts.Close()
+
+	{
+		session, err := s.Code2Session(nil, "wxmp", "good")
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, "OPENID", session.OpenID) {
+			return
+		}
+		if !assert.Len(t, session.ID, 32) {
+			return
+		}
+
+		stored, err := s.sessions.Get(session.ID)
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, "KEY", stored.SessionKey) {
+			return
+		}
+	}
+
+	{
+		_, err := s.Code2Session(nil, "wxmp", "bad")
+		if !assert.True(t, IsWXError(err, ECInvalidCode)) {
+			return
+		}
+	}
+
+	{
+		_, err := s.Code2Session(nil, "wxother", "good")
+		if !assert.Equal(t, ErrUnknownMiniProgram, err) {
+			return
+		}
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+
+	ms := NewMemorySessionStore()
+	ms.Put(&MiniProgramSession{ID: "a", ExpiresAt: time.Now().Add(time.Hour)})
+	ms.Put(&MiniProgramSession{ID: "b", ExpiresAt: time.Now().Add(-time.Second)})
+
+	if _, err := ms.Get("a"); !assert.Nil(t, err) {
+		return
+	}
+	if _, err := ms.Get("b"); !assert.Equal(t, ErrSessionNotFound, err) {
+		return
+	}
+	if _, err := ms.Get("c"); !assert.Equal(t, ErrSessionNotFound, err) {
+		return
+	}
+
+	// expired sessions are swept
+	ms.lastSweep = time.Now().Add(-time.Hour)
+	ms.Put(&MiniProgramSession{ID: "c", ExpiresAt: time.Now().Add(time.Hour)})
+	if !assert.Len(t, ms.sessions, 2) {
+		return
+	}
+}
@@ -0,0 +1,198 @@
+package service
+
+import (
+	"errors"
+	"github.com/hyt-hz/wxOpenID/log"
+	"golang.org/x/net/context"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrAppNotConfigured         = errors.New("WeChat AppID or AppSecret not configured")
+	ErrRedirectURINotConfigured = errors.New("OAuth redirect URI not configured")
+	ErrInvalidScope             = errors.New("Invalid OAuth scope")
+	ErrScopeNotAuthorized       = errors.New("User has not authorized snsapi_userinfo scope")
+	ErrReauthorizeRequired      = errors.New("User refresh token expired, authorization required")
+)
+
+// URL to start web authorization, can be replaced for testing
+var DefaultAuthorizeURL = "https://open.weixin.qq.com/connect/oauth2/authorize"
+
+// scopes of web authorization
+const (
+	ScopeBase     = "snsapi_base"
+	ScopeUserInfo = "snsapi_userinfo"
+)
+
+const (
+	// refresh token is valid for 30 days since the authorization
+	RefreshTokenTTL = 30 * 24 * time.Hour
+	// renew user access token a bit before it expires
+	userTokenExpiryMargin = time.Minute
+)
+
+// user access token returned by web authorization (OAuth2)
+type OAuthToken struct {
+	AccessToken  string    `json:"access_token"`
+	ExpiresIn    int       `json:"expires_in"`
+	RefreshToken string    `json:"refresh_token"`
+	OpenID       string    `json:"openid"`
+	Scope        string    `json:"scope"`
+	UnionID      string    `json:"unionid"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	// when refresh token expires, user must authorize again after that
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+// user profile returned by sns/userinfo
+type UserInfo struct {
+	OpenID     string   `json:"openid"`
+	Nickname   string   `json:"nickname"`
+	Sex        int      `json:"sex"`
+	Province   string   `json:"province"`
+	City       string   `json:"city"`
+	Country    string   `json:"country"`
+	HeadImgURL string   `json:"headimgurl"`
+	Privilege  []string `json:"privilege"`
+	UnionID    string   `json:"unionid"`
+	Language   string   `json:"language"`
+}
+
+// build the URL to start web authorization with given scope and state,
+// WeChat redirects user to OAuthRedirectURI with code and state afterwards
+func (s *WXService) AuthorizeURL(scope string, state string) (string, error) {
+
+	if s.option.AppID == "" {
+		return "", ErrAppNotConfigured
+	}
+	if s.option.OAuthRedirectURI == "" {
+		return "", ErrRedirectURINotConfigured
+	}
+	if scope != ScopeBase && scope != ScopeUserInfo {
+		return "", ErrInvalidScope
+	}
+
+	// WeChat requires parameters in exactly this order
+	return DefaultAuthorizeURL +
+		"?appid=" + url.QueryEscape(s.option.AppID) +
+		"&redirect_uri=" + url.QueryEscape(s.option.OAuthRedirectURI) +
+		"&response_type=code" +
+		"&scope=" + scope +
+		"&state=" + url.QueryEscape(state) +
+		"#wechat_redirect", nil
+}
+
+// exchange code got from web authorization redirect for user access token
+// and OpenID, code can be used only once and expires in 5 minutes
+func (s *WXService) ExchangeCode(ctx context.Context, code string) (token *OAuthToken, err error) {
+
+	if s.option.AppID == "" || s.option.AppSecret == "" {
+		return nil, ErrAppNotConfigured
+	}
+
+	params := url.Values{}
+	params.Set("appid", s.option.AppID)
+	params.Set("secret", s.option.AppSecret)
+	params.Set("code", code)
+	params.Set("grant_type", "authorization_code")
+
+	token = &OAuthToken{}
+	if err = getJSON(ctx, s.client, s.apiBase+"/sns/oauth2/access_token", params, token); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	token.ExpiresAt = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	token.RefreshExpiresAt = now.Add(RefreshTokenTTL)
+
+	// keep the token for later profile retrieval
+	if err := s.userTokens.Put(token); err != nil {
+		log.Warning("Failed to save token of user %s: %s", token.OpenID, err)
+	}
+
+	return token, nil
+}
+
+// renew user access token with refresh token, renewed token is saved
+func (s *WXService) RefreshUserToken(ctx context.Context, token *OAuthToken) (*OAuthToken, error) {
+
+	if s.option.AppID == "" {
+		return nil, ErrAppNotConfigured
+	}
+	if time.Now().After(token.RefreshExpiresAt) {
+		return nil, ErrReauthorizeRequired
+	}
+
+	params := url.Values{}
+	params.Set("appid", s.option.AppID)
+	params.Set("grant_type", "refresh_token")
+	params.Set("refresh_token", token.RefreshToken)
+
+	renewed := &OAuthToken{}
+	err := getJSON(ctx, s.client, s.apiBase+"/sns/oauth2/refresh_token", params, renewed)
+	if err != nil {
+		if IsWXError(err, ECInvalidRefreshToken, ECRefreshTokenExpired) {
+			return nil, ErrReauthorizeRequired
+		}
+		return nil, err
+	}
+	renewed.ExpiresAt = time.Now().Add(time.Duration(renewed.ExpiresIn) * time.Second)
+	// refresh token is not extended by refreshing
+	renewed.RefreshExpiresAt = token.RefreshExpiresAt
+	if renewed.UnionID == "" {
+		renewed.UnionID = token.UnionID
+	}
+
+	if err := s.userTokens.Put(renewed); err != nil {
+		log.Warning("Failed to save token of user %s: %s", renewed.OpenID, err)
+	}
+
+	return renewed, nil
+}
+
+// get profile of user who authorized with snsapi_userinfo scope, user access
+// token is renewed if expired, lang can be zh_CN, zh_TW or en
+func (s *WXService) GetUserInfo(ctx context.Context, openID string, lang string) (*UserInfo, error) {
+
+	token, err := s.userTokens.Get(openID)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(token.Scope, ScopeUserInfo) {
+		return nil, ErrScopeNotAuthorized
+	}
+	if lang == "" {
+		lang = "zh_CN"
+	}
+
+	refreshed := false
+	if time.Now().Add(userTokenExpiryMargin).After(token.ExpiresAt) {
+		if token, err = s.RefreshUserToken(ctx, token); err != nil {
+			return nil, err
+		}
+		refreshed = true
+	}
+
+	for {
+		params := url.Values{}
+		params.Set("access_token", token.AccessToken)
+		params.Set("openid", openID)
+		params.Set("lang", lang)
+
+		info := &UserInfo{}
+		err = getJSON(ctx, s.client, s.apiBase+"/sns/userinfo", params, info)
+		if err == nil {
+			return info, nil
+		}
+
+		// token may be invalidated before its expiry, renew and retry once
+		if refreshed || !IsWXError(err, ECInvalidCredential, ECAccessTokenExpired) {
+			return nil, err
+		}
+		if token, err = s.RefreshUserToken(ctx, token); err != nil {
+			return nil, err
+		}
+		refreshed = true
+	}
+}
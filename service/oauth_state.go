@@ -0,0 +1,236 @@
+package service
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrStateSecretNotConfigured = errors.New("OAuth state secret not configured")
+	ErrInvalidState             = errors.New("Invalid, used or expired OAuth state")
+	ErrInvalidTicket            = errors.New("Invalid OpenID ticket")
+	ErrTicketExpired            = errors.New("OpenID ticket expired")
+)
+
+const (
+	DefaultOAuthStateTTL = 10 * time.Minute
+	// state is random hex, WeChat allows at most 128 bytes of [a-zA-Z0-9]
+	oauthStateSize = 16
+	// HMAC-SHA256 is truncated to keep ticket short
+	ticketMACSize = 16
+	// states kept in memory at most, authorization is open to anyone, so the
+	// oldest are dropped rather than growing without bound
+	maxOAuthStates = 100000
+)
+
+// storage of return URLs of web authorizations in progress, keyed by state,
+// must be shared by replicas as the callback may reach another one
+type OAuthStateStore interface {
+	Put(state string, returnTo string, ttl time.Duration) error
+	// get return URL of state and remove it, so state can be used only once
+	Take(state string) (string, error)
+}
+
+type oauthState struct {
+	state     string
+	returnTo  string
+	expiresAt time.Time
+}
+
+// OAuthStateStore in memory, for single replica, holds at most
+// maxOAuthStates states, the oldest is dropped when it's full
+type MemoryOAuthStateStore struct {
+	sync.Mutex
+	states map[string]*list.Element
+	// states in order of expiry
+	order *list.List
+}
+
+func NewMemoryOAuthStateStore() *MemoryOAuthStateStore {
+	return &MemoryOAuthStateStore{
+		states: make(map[string]*list.Element),
+		order:  list.New(),
+	}
+}
+
+func (ms *MemoryOAuthStateStore) Put(state string, returnTo string, ttl time.Duration) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	// states never used are dropped once expired
+	now := time.Now()
+	for e := ms.order.Front(); e != nil && now.After(e.Value.(*oauthState).expiresAt); e = ms.order.Front() {
+		ms.remove(e)
+	}
+
+	if e, ok := ms.states[state]; ok {
+		ms.remove(e)
+	}
+	if ms.order.Len() >= maxOAuthStates {
+		ms.remove(ms.order.Front())
+	}
+	ms.states[state] = ms.order.PushBack(&oauthState{state: state, returnTo: returnTo, expiresAt: now.Add(ttl)})
+	return nil
+}
+
+func (ms *MemoryOAuthStateStore) remove(e *list.Element) {
+	ms.order.Remove(e)
+	delete(ms.states, e.Value.(*oauthState).state)
+}
+
+func (ms *MemoryOAuthStateStore) Take(state string) (string, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	e, ok := ms.states[state]
+	if !ok {
+		return "", ErrInvalidState
+	}
+	ms.remove(e)
+	v := e.Value.(*oauthState)
+	if time.Now().After(v.expiresAt) {
+		return "", ErrInvalidState
+	}
+	return v.returnTo, nil
+}
+
+// OAuthStateStore in Redis, shared by replicas on different hosts
+type RedisOAuthStateStore struct {
+	client *redisClient
+	prefix string
+}
+
+func NewRedisOAuthStateStore(option *RedisOption) *RedisOAuthStateStore {
+	return &RedisOAuthStateStore{
+		client: newRedisClient(option),
+		prefix: option.Prefix + "oauth_state:",
+	}
+}
+
+func (rs *RedisOAuthStateStore) Put(state string, returnTo string, ttl time.Duration) error {
+	_, err := rs.client.Do("SET", rs.prefix+state, returnTo, "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	return err
+}
+
+func (rs *RedisOAuthStateStore) Take(state string) (string, error) {
+
+	reply, err := rs.client.Do("GET", rs.prefix+state)
+	if err != nil {
+		return "", err
+	}
+	returnTo, ok := reply.(string)
+	if !ok {
+		return "", ErrInvalidState
+	}
+
+	// only the one who deletes it takes the state
+	if reply, err = rs.client.Do("DEL", rs.prefix+state); err != nil {
+		return "", err
+	}
+	if n, _ := reply.(int64); n != 1 {
+		return "", ErrInvalidState
+	}
+	return returnTo, nil
+}
+
+// create state for web authorization returning to returnTo, the state is
+// random and the return URL is kept on server side for OAuthStateTTL, so the
+// callback can make sure the authorization was started by us
+func (s *WXService) NewOAuthState(returnTo string) (string, error) {
+
+	// needed to sign OpenID ticket at the end of authorization
+	if s.option.OAuthStateSecret == "" {
+		return "", ErrStateSecretNotConfigured
+	}
+
+	state := randomHex(oauthStateSize)
+	if err := s.oauthStates.Put(state, returnTo, s.oauthStateTTL()); err != nil {
+		return "", err
+	}
+	return state, nil
+}
+
+// return URL of state created by NewOAuthState, state can be used only once
+func (s *WXService) VerifyOAuthState(state string) (returnTo string, err error) {
+
+	if state == "" {
+		return "", ErrInvalidState
+	}
+	return s.oauthStates.Take(state)
+}
+
+// create ticket proving the OpenID of the user who just completed web
+// authorization, the ticket is signed with HMAC and expires after
+// OAuthStateTTL, so the return URL can't be given a forged OpenID
+func (s *WXService) NewOpenIDTicket(openID string) (string, error) {
+
+	if s.option.OAuthStateSecret == "" {
+		return "", ErrStateSecretNotConfigured
+	}
+
+	expiry := time.Now().Add(s.oauthStateTTL()).Unix()
+	payload := strconv.FormatInt(expiry, 36) + ":" + openID
+
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(s.ticketMAC([]byte(payload))), nil
+}
+
+// verify ticket created by NewOpenIDTicket, and return the OpenID carried
+func (s *WXService) VerifyOpenIDTicket(ticket string) (openID string, err error) {
+
+	if s.option.OAuthStateSecret == "" {
+		return "", ErrStateSecretNotConfigured
+	}
+
+	parts := strings.SplitN(ticket, ".", 2)
+	if len(parts) != 2 {
+		return "", ErrInvalidTicket
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", ErrInvalidTicket
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrInvalidTicket
+	}
+	if !hmac.Equal(mac, s.ticketMAC(payload)) {
+		return "", ErrInvalidTicket
+	}
+
+	fields := strings.SplitN(string(payload), ":", 2)
+	if len(fields) != 2 || fields[1] == "" {
+		return "", ErrInvalidTicket
+	}
+	expiry, err := strconv.ParseInt(fields[0], 36, 64)
+	if err != nil {
+		return "", ErrInvalidTicket
+	}
+	if time.Now().Unix() > expiry {
+		return "", ErrTicketExpired
+	}
+
+	return fields[1], nil
+}
+
+// purpose is mixed in, so the secret may sign other things later
+func (s *WXService) ticketMAC(payload []byte) []byte {
+	h := hmac.New(sha256.New, []byte(s.option.OAuthStateSecret))
+	h.Write([]byte("openid_ticket:"))
+	h.Write(payload)
+	return h.Sum(nil)[:ticketMACSize]
+}
+
+func (s *WXService) oauthStateTTL() time.Duration {
+	if s.option.OAuthStateTTL > 0 {
+		return s.option.OAuthStateTTL
+	}
+	return DefaultOAuthStateTTL
+}
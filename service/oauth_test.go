@@ -0,0 +1,408 @@
+package service
+
+import (
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExchangeCode(t *testing.T) {
+
+	s, ts := newTestService(
+		&Option{AppID: "wx123", AppSecret: "secret"},
+		func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			if r.URL.Path != "/sns/oauth2/access_token" || q.Get("appid") != "wx123" ||
+				q.Get("secret") != "secret" || q.Get("grant_type") != "authorization_code" {
+				w.Write([]byte(`{"errcode":40013,"errmsg":"invalid appid"}`))
+				return
+			}
+			switch q.Get("code") {
+			case "good":
+				w.Write([]byte(`{"access_token":"ACCESS","expires_in":7200,"refresh_token":"REFRESH",` +
+					`"openid":"OPENID","scope":"snsapi_base","unionid":"UNIONID"}`))
+			case "used":
+				w.Write([]byte(`{"errcode":40163,"errmsg":"code been used"}`))
+			default:
+				w.Write([]byte(`{"errcode":40029,"errmsg":"invalid code"}`))
+			}
+		},
+	)
+	defer ts.Close()
+
+	{
+		start := time.Now()
+		token, err := s.ExchangeCode(nil, "good")
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, "OPENID", token.OpenID) {
+			return
+		}
+		if !assert.Equal(t, "UNIONID", token.UnionID) {
+			return
+		}
+		if !assert.Equal(t, "ACCESS", token.AccessToken) {
+			return
+		}
+		if !assert.Equal(t, "REFRESH", token.RefreshToken) {
+			return
+		}
+		if !assert.Equal(t, "snsapi_base", token.Scope) {
+			return
+		}
+		if !assert.True(t, token.ExpiresAt.After(start.Add(7199*time.Second))) {
+			return
+		}
+	}
+
+	{
+		_, err := s.ExchangeCode(nil, "used")
+		if !assert.True(t, IsWXError(err, ECCodeUsed)) {
+			return
+		}
+	}
+
+	{
+		_, err := s.ExchangeCode(nil, "bad")
+		if !assert.True(t, IsWXError(err, ECInvalidCode)) {
+			return
+		}
+		if !assert.False(t, IsWXError(err, ECCodeUsed)) {
+			return
+		}
+	}
+
+	{
+		s, _ := NewWXService(&Option{})
+		_, err := s.ExchangeCode(nil, "good")
+		if !assert.Equal(t, ErrAppNotConfigured, err) {
+			return
+		}
+	}
+}
+
+func TestOAuthState(t *testing.T) {
+
+	{
+		s, _ := NewWXService(&Option{})
+		_, err := s.NewOAuthState("https://m.example.com/")
+		if !assert.Equal(t, ErrStateSecretNotConfigured, err) {
+			return
+		}
+	}
+
+	s, _ := NewWXService(&Option{OAuthStateSecret: "secret"})
+
+	{
+		// long return URL is kept on server side, state stays short
+		returnTo := "https://m.example.com/a?b=c&" + strings.Repeat("d", 200)
+		state, err := s.NewOAuthState(returnTo)
+		if !assert.Nil(t, err) || !assert.Regexp(t, "^[0-9a-f]{32}$", state) {
+			return
+		}
+		r, err := s.VerifyOAuthState(state)
+		if !assert.Nil(t, err) || !assert.Equal(t, returnTo, r) {
+			return
+		}
+
+		// used once only
+		_, err = s.VerifyOAuthState(state)
+		if !assert.Equal(t, ErrInvalidState, err) {
+			return
+		}
+		_, err = s.VerifyOAuthState("abc")
+		if !assert.Equal(t, ErrInvalidState, err) {
+			return
+		}
+	}
+
+	{
+		s, _ := NewWXService(&Option{OAuthStateSecret: "secret", OAuthStateTTL: time.Nanosecond})
+		state, err := s.NewOAuthState("https://m.example.com/")
+		if !assert.Nil(t, err) {
+			return
+		}
+		time.Sleep(time.Millisecond)
+		_, err = s.VerifyOAuthState(state)
+		if !assert.Equal(t, ErrInvalidState, err) {
+			return
+		}
+	}
+}
+
+func TestMemoryOAuthStateStore(t *testing.T) {
+
+	ms := NewMemoryOAuthStateStore()
+	ms.Put("expired", "https://m.example.com/", -time.Second)
+	ms.Put("0", "https://m.example.com/0", time.Minute)
+	// expired state is dropped by the next put
+	if !assert.Equal(t, 1, ms.order.Len()) {
+		return
+	}
+
+	// the oldest is dropped when it's full
+	for i := 1; i < maxOAuthStates+1; i++ {
+		ms.Put(strconv.Itoa(i), "https://m.example.com/", time.Minute)
+	}
+	if !assert.Equal(t, maxOAuthStates, len(ms.states)) {
+		return
+	}
+	if _, err := ms.Take("0"); !assert.Equal(t, ErrInvalidState, err) {
+		return
+	}
+	if r, err := ms.Take("1"); !assert.Nil(t, err) || !assert.Equal(t, "https://m.example.com/", r) {
+		return
+	}
+}
+
+func TestRedisOAuthStateStore(t *testing.T) {
+
+	fr := startFakeRedis()
+	defer fr.Close()
+
+	rs := NewRedisOAuthStateStore(&RedisOption{Addr: fr.Addr(), Prefix: "wx:"})
+	if !assert.Nil(t, rs.Put("STATE", "https://m.example.com/", time.Minute)) {
+		return
+	}
+	returnTo, err := rs.Take("STATE")
+	if !assert.Nil(t, err) || !assert.Equal(t, "https://m.example.com/", returnTo) {
+		return
+	}
+	if _, err := rs.Take("STATE"); !assert.Equal(t, ErrInvalidState, err) {
+		return
+	}
+}
+
+func TestOpenIDTicket(t *testing.T) {
+
+	s, _ := NewWXService(&Option{OAuthStateSecret: "secret"})
+
+	ticket, err := s.NewOpenIDTicket("OPENID")
+	if !assert.Nil(t, err) {
+		return
+	}
+	openID, err := s.VerifyOpenIDTicket(ticket)
+	if !assert.Nil(t, err) || !assert.Equal(t, "OPENID", openID) {
+		return
+	}
+
+	// signed with another secret
+	s2, _ := NewWXService(&Option{OAuthStateSecret: "another"})
+	if _, err := s2.VerifyOpenIDTicket(ticket); !assert.Equal(t, ErrInvalidTicket, err) {
+		return
+	}
+
+	// OpenID replaced
+	parts := strings.SplitN(ticket, ".", 2)
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	forged := strings.Replace(string(payload), "OPENID", "VICTIM", 1)
+	forged = base64.RawURLEncoding.EncodeToString([]byte(forged)) + "." + parts[1]
+	if _, err := s.VerifyOpenIDTicket(forged); !assert.Equal(t, ErrInvalidTicket, err) {
+		return
+	}
+	if _, err := s.VerifyOpenIDTicket("OPENID"); !assert.Equal(t, ErrInvalidTicket, err) {
+		return
+	}
+
+	{
+		s, _ := NewWXService(&Option{OAuthStateSecret: "secret", OAuthStateTTL: time.Nanosecond})
+		ticket, err := s.NewOpenIDTicket("OPENID")
+		if !assert.Nil(t, err) {
+			return
+		}
+		time.Sleep(1100 * time.Millisecond)
+		if _, err := s.VerifyOpenIDTicket(ticket); !assert.Equal(t, ErrTicketExpired, err) {
+			return
+		}
+	}
+}
+
+func TestAuthorizeURL(t *testing.T) {
+
+	s, _ := NewWXService(&Option{AppID: "wx123", OAuthRedirectURI: "https://wx.example.com/wx/oauth/callback"})
+
+	{
+		u, err := s.AuthorizeURL(ScopeBase, "STATE")
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, "https://open.weixin.qq.com/connect/oauth2/authorize?appid=wx123"+
+			"&redirect_uri=https%3A%2F%2Fwx.example.com%2Fwx%2Foauth%2Fcallback"+
+			"&response_type=code&scope=snsapi_base&state=STATE#wechat_redirect", u) {
+			return
+		}
+	}
+
+	{
+		_, err := s.AuthorizeURL("snsapi_login", "STATE")
+		if !assert.Equal(t, ErrInvalidScope, err) {
+			return
+		}
+	}
+}
+
+func TestGetUserInfo(t *testing.T) {
+
+	refreshCnt := 0
+	s, ts := newTestService(
+		&Option{AppID: "wx123", AppSecret: "secret"},
+		func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			switch r.URL.Path {
+			case "/sns/oauth2/access_token":
+				scope := ScopeBase
+				if q.Get("code") == "userinfo" {
+					scope = ScopeUserInfo
+				}
+				w.Write([]byte(`{"access_token":"STALE","expires_in":7200,"refresh_token":"REFRESH",` +
+					`"openid":"OPENID","scope":"` + scope + `"}`))
+			case "/sns/oauth2/refresh_token":
+				refreshCnt += 1
+				if q.Get("refresh_token") != "REFRESH" {
+					w.Write([]byte(`{"errcode":40030,"errmsg":"invalid refresh_token"}`))
+					return
+				}
+				w.Write([]byte(`{"access_token":"FRESH","expires_in":7200,"refresh_token":"REFRESH",` +
+					`"openid":"OPENID","scope":"snsapi_userinfo"}`))
+			case "/sns/userinfo":
+				if q.Get("access_token") != "FRESH" {
+					w.Write([]byte(`{"errcode":42001,"errmsg":"access_token expired"}`))
+					return
+				}
+				w.Write([]byte(`{"openid":"OPENID","nickname":"NICK","headimgurl":"http://img/0",` +
+					`"privilege":[],"unionid":"UNIONID","language":"zh_CN"}`))
+			}
+		},
+	)
+	defer ts.Close()
+
+	{
+		_, err := s.GetUserInfo(nil, "OPENID", "")
+		if !assert.Equal(t, ErrUserTokenNotFound, err) {
+			return
+		}
+	}
+
+	{
+		_, err := s.ExchangeCode(nil, "base")
+		if !assert.Nil(t, err) {
+			return
+		}
+		_, err = s.GetUserInfo(nil, "OPENID", "")
+		if !assert.Equal(t, ErrScopeNotAuthorized, err) {
+			return
+		}
+	}
+
+	{
+		// STALE token is rejected, renewed and retried
+		_, err := s.ExchangeCode(nil, "userinfo")
+		if !assert.Nil(t, err) {
+			return
+		}
+		info, err := s.GetUserInfo(nil, "OPENID", "en")
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, "NICK", info.Nickname) {
+			return
+		}
+		if !assert.Equal(t, "UNIONID", info.UnionID) {
+			return
+		}
+		// language of user, not the one asked for
+		if !assert.Equal(t, "zh_CN", info.Language) {
+			return
+		}
+		if !assert.Equal(t, 1, refreshCnt) {
+			return
+		}
+	}
+
+	{
+		// renewed token is persisted and reused
+		_, err := s.GetUserInfo(nil, "OPENID", "")
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, 1, refreshCnt) {
+			return
+		}
+	}
+
+	{
+		// expired token is renewed before the call
+		token, _ := s.userTokens.Get("OPENID")
+		token.AccessToken = "STALE"
+		token.ExpiresAt = time.Now()
+		s.userTokens.Put(token)
+		_, err := s.GetUserInfo(nil, "OPENID", "")
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, 2, refreshCnt) {
+			return
+		}
+	}
+
+	{
+		token, _ := s.userTokens.Get("OPENID")
+		token.ExpiresAt = time.Now()
+		token.RefreshExpiresAt = time.Now()
+		s.userTokens.Put(token)
+		_, err := s.GetUserInfo(nil, "OPENID", "")
+		if !assert.Equal(t, ErrReauthorizeRequired, err) {
+			return
+		}
+	}
+}
+
+func TestFileUserTokenStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "wxtest")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.json")
+
+	{
+		store, err := NewFileUserTokenStore(path)
+		if !assert.Nil(t, err) {
+			return
+		}
+		err = store.Put(&OAuthToken{OpenID: "OPENID", AccessToken: "ACCESS"})
+		if !assert.Nil(t, err) {
+			return
+		}
+	}
+
+	{
+		store, err := NewFileUserTokenStore(path)
+		if !assert.Nil(t, err) {
+			return
+		}
+		token, err := store.Get("OPENID")
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, "ACCESS", token.AccessToken) {
+			return
+		}
+		fi, err := os.Stat(path)
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, os.FileMode(0600), fi.Mode().Perm()) {
+			return
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package service
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRedisProtocol = errors.New("Invalid Redis protocol reply")
+)
+
+const (
+	DefaultRedisTimeout = 3 * time.Second
+)
+
+// connection options of Redis
+type RedisOption struct {
+	Addr     string `yaml:"addr"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+	// prefix of all keys we use
+	Prefix string `yaml:"prefix"`
+}
+
+func (o RedisOption) String() string {
+	type option RedisOption
+	c := option(o)
+	c.Password = RedactSecret(c.Password)
+	return fmt.Sprintf("%+v", c)
+}
+
+// error reply of Redis
+type RedisError string
+
+func (err RedisError) Error() string {
+	return "Redis error " + string(err)
+}
+
+// minimal client of Redis protocol (RESP), only what token store and lock
+// need, a single connection is shared and reconnected after failure
+type redisClient struct {
+	sync.Mutex
+	option  RedisOption
+	timeout time.Duration
+	conn    net.Conn
+	reader  *bufio.Reader
+}
+
+func newRedisClient(option *RedisOption) *redisClient {
+	return &redisClient{
+		option:  *option,
+		timeout: DefaultRedisTimeout,
+	}
+}
+
+// run command and return its reply, which can be string, int64, nil or
+// []interface{}, error reply is returned as RedisError
+func (c *redisClient) Do(args ...string) (interface{}, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := c.do(args...)
+	if err != nil {
+		if _, ok := err.(RedisError); !ok {
+			// connection is in unknown state
+			c.conn.Close()
+			c.conn = nil
+		}
+	}
+	return reply, err
+}
+
+func (c *redisClient) connect() error {
+
+	conn, err := net.DialTimeout("tcp", c.option.Addr, c.timeout)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+
+	if c.option.Password != "" {
+		if _, err = c.do("AUTH", c.option.Password); err != nil {
+			conn.Close()
+			c.conn = nil
+			return err
+		}
+	}
+	if c.option.DB != 0 {
+		if _, err = c.do("SELECT", strconv.Itoa(c.option.DB)); err != nil {
+			conn.Close()
+			c.conn = nil
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *redisClient) do(args ...string) (interface{}, error) {
+
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+
+	buf := make([]byte, 0, 64)
+	buf = append(buf, fmt.Sprintf("*%d\r\n", len(args))...)
+	for _, arg := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n", len(arg))...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(c.reader)
+}
+
+func readRedisLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", ErrRedisProtocol
+	}
+	return line[:len(line)-2], nil
+}
+
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+
+	line, err := readRedisLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, RedisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, ErrRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, ErrRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRedisReply(r); err != nil {
+				if _, ok := err.(RedisError); !ok {
+					return nil, err
+				}
+				items[i] = err
+			}
+		}
+		return items, nil
+	default:
+		return nil, ErrRedisProtocol
+	}
+}
@@ -0,0 +1,204 @@
+package service
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+// passive reply types
+const (
+	ReplyTypeText                    = "text"
+	ReplyTypeImage                   = "image"
+	ReplyTypeVoice                   = "voice"
+	ReplyTypeVideo                   = "video"
+	ReplyTypeMusic                   = "music"
+	ReplyTypeNews                    = "news"
+	ReplyTypeTransferCustomerService = "transfer_customer_service"
+)
+
+// WeChat accepts at most 8 articles in news reply
+const MaxReplyArticles = 8
+
+// string marshalled in CDATA section
+type cdata string
+
+func (c cdata) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return e.EncodeElement(struct {
+		Text string `xml:",cdata"`
+	}{string(c)}, start)
+}
+
+// fields common to all replies, sender and receiver are swapped from the
+// message replied to
+type replyHeader struct {
+	XMLName      xml.Name `xml:"xml"`
+	ToUserName   cdata    `xml:"ToUserName"`
+	FromUserName cdata    `xml:"FromUserName"`
+	CreateTime   int64    `xml:"CreateTime"`
+	MsgType      cdata    `xml:"MsgType"`
+}
+
+func newReplyHeader(msg Message, msgType string) replyHeader {
+	header := msg.Header()
+	return replyHeader{
+		ToUserName:   cdata(header.FromUserName),
+		FromUserName: cdata(header.ToUserName),
+		CreateTime:   time.Now().Unix(),
+		MsgType:      cdata(msgType),
+	}
+}
+
+type mediaElement struct {
+	MediaID cdata `xml:"MediaId"`
+}
+
+type TextReply struct {
+	Content string
+}
+
+func (r *TextReply) MarshalReply(msg Message) ([]byte, error) {
+	return xml.Marshal(&struct {
+		replyHeader
+		Content cdata `xml:"Content"`
+	}{newReplyHeader(msg, ReplyTypeText), cdata(r.Content)})
+}
+
+// reply with image uploaded as media
+type ImageReply struct {
+	MediaID string
+}
+
+func (r *ImageReply) MarshalReply(msg Message) ([]byte, error) {
+	return xml.Marshal(&struct {
+		replyHeader
+		Image mediaElement `xml:"Image"`
+	}{newReplyHeader(msg, ReplyTypeImage), mediaElement{cdata(r.MediaID)}})
+}
+
+// reply with voice uploaded as media
+type VoiceReply struct {
+	MediaID string
+}
+
+func (r *VoiceReply) MarshalReply(msg Message) ([]byte, error) {
+	return xml.Marshal(&struct {
+		replyHeader
+		Voice mediaElement `xml:"Voice"`
+	}{newReplyHeader(msg, ReplyTypeVoice), mediaElement{cdata(r.MediaID)}})
+}
+
+// reply with video uploaded as media
+type VideoReply struct {
+	MediaID     string
+	Title       string
+	Description string
+}
+
+func (r *VideoReply) MarshalReply(msg Message) ([]byte, error) {
+	video := struct {
+		MediaID     cdata `xml:"MediaId"`
+		Title       cdata `xml:"Title,omitempty"`
+		Description cdata `xml:"Description,omitempty"`
+	}{cdata(r.MediaID), cdata(r.Title), cdata(r.Description)}
+
+	return xml.Marshal(&struct {
+		replyHeader
+		Video interface{} `xml:"Video"`
+	}{newReplyHeader(msg, ReplyTypeVideo), video})
+}
+
+type MusicReply struct {
+	Title        string
+	Description  string
+	MusicURL     string
+	HQMusicURL   string
+	ThumbMediaID string
+}
+
+func (r *MusicReply) MarshalReply(msg Message) ([]byte, error) {
+	music := struct {
+		Title        cdata `xml:"Title,omitempty"`
+		Description  cdata `xml:"Description,omitempty"`
+		MusicURL     cdata `xml:"MusicUrl,omitempty"`
+		HQMusicURL   cdata `xml:"HQMusicUrl,omitempty"`
+		ThumbMediaID cdata `xml:"ThumbMediaId"`
+	}{cdata(r.Title), cdata(r.Description), cdata(r.MusicURL), cdata(r.HQMusicURL), cdata(r.ThumbMediaID)}
+
+	return xml.Marshal(&struct {
+		replyHeader
+		Music interface{} `xml:"Music"`
+	}{newReplyHeader(msg, ReplyTypeMusic), music})
+}
+
+type Article struct {
+	Title       string
+	Description string
+	PicURL      string
+	URL         string
+}
+
+// reply with articles, only the first MaxReplyArticles are sent
+type NewsReply struct {
+	Articles []Article
+}
+
+func (r *NewsReply) MarshalReply(msg Message) ([]byte, error) {
+
+	type item struct {
+		Title       cdata `xml:"Title"`
+		Description cdata `xml:"Description"`
+		PicURL      cdata `xml:"PicUrl"`
+		URL         cdata `xml:"Url"`
+	}
+
+	articles := r.Articles
+	if len(articles) > MaxReplyArticles {
+		articles = articles[:MaxReplyArticles]
+	}
+	items := make([]item, len(articles))
+	for i, a := range articles {
+		items[i] = item{cdata(a.Title), cdata(a.Description), cdata(a.PicURL), cdata(a.URL)}
+	}
+
+	return xml.Marshal(&struct {
+		replyHeader
+		ArticleCount int    `xml:"ArticleCount"`
+		Articles     []item `xml:"Articles>item"`
+	}{newReplyHeader(msg, ReplyTypeNews), len(items), items})
+}
+
+// transfer message to customer service, to the given account if KfAccount
+// is not empty
+type TransferCustomerServiceReply struct {
+	KfAccount string
+}
+
+func (r *TransferCustomerServiceReply) MarshalReply(msg Message) ([]byte, error) {
+
+	type transInfo struct {
+		KfAccount cdata `xml:"KfAccount"`
+	}
+	var info *transInfo
+	if r.KfAccount != "" {
+		info = &transInfo{cdata(r.KfAccount)}
+	}
+
+	return xml.Marshal(&struct {
+		replyHeader
+		TransInfo *transInfo `xml:"TransInfo,omitempty"`
+	}{newReplyHeader(msg, ReplyTypeTransferCustomerService), info})
+}
+
+// acknowledgement without reply, sent as is even in safe mode
+type AckReply string
+
+const (
+	// tell WeChat the message is received, without reply
+	SuccessReply = AckReply("success")
+	// empty response, same as SuccessReply
+	EmptyReply = AckReply("")
+)
+
+func (r AckReply) MarshalReply(msg Message) ([]byte, error) {
+	return []byte(r), nil
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"encoding/xml"
+	"github.com/hyt-hz/wxOpenID/wxcrypt"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"strings"
+	"testing"
+)
+
+func TestMarshalReply(t *testing.T) {
+
+	msg := &TextMessage{
+		MessageHeader: MessageHeader{ToUserName: "gh_account", FromUserName: "OPENID", MsgType: MsgTypeText},
+		Content:       "hi",
+	}
+
+	cases := []struct {
+		reply   Reply
+		msgType string
+		body    string
+	}{
+		{&TextReply{Content: "a < b"}, ReplyTypeText,
+			`<Content><![CDATA[a < b]]></Content>`},
+		{&ImageReply{MediaID: "IMAGE"}, ReplyTypeImage,
+			`<Image><MediaId><![CDATA[IMAGE]]></MediaId></Image>`},
+		{&VoiceReply{MediaID: "VOICE"}, ReplyTypeVoice,
+			`<Voice><MediaId><![CDATA[VOICE]]></MediaId></Voice>`},
+		{&VideoReply{MediaID: "VIDEO", Title: "title"}, ReplyTypeVideo,
+			`<Video><MediaId><![CDATA[VIDEO]]></MediaId><Title><![CDATA[title]]></Title></Video>`},
+		{&MusicReply{MusicURL: "http://m", ThumbMediaID: "THUMB"}, ReplyTypeMusic,
+			`<Music><MusicUrl><![CDATA[http://m]]></MusicUrl><ThumbMediaId><![CDATA[THUMB]]></ThumbMediaId></Music>`},
+		{&NewsReply{Articles: []Article{{Title: "t", Description: "d", PicURL: "p", URL: "u"}}}, ReplyTypeNews,
+			`<ArticleCount>1</ArticleCount><Articles><item><Title><![CDATA[t]]></Title>` +
+				`<Description><![CDATA[d]]></Description><PicUrl><![CDATA[p]]></PicUrl><Url><![CDATA[u]]></Url></item></Articles>`},
+		{&TransferCustomerServiceReply{}, ReplyTypeTransferCustomerService, ``},
+		{&TransferCustomerServiceReply{KfAccount: "test1@test"}, ReplyTypeTransferCustomerService,
+			`<TransInfo><KfAccount><![CDATA[test1@test]]></KfAccount></TransInfo>`},
+	}
+
+	for _, c := range cases {
+		data, err := c.reply.MarshalReply(msg)
+		if !assert.Nil(t, err) {
+			return
+		}
+		s := string(data)
+		if !assert.True(t, strings.HasPrefix(s, `<xml><ToUserName><![CDATA[OPENID]]></ToUserName>`+
+			`<FromUserName><![CDATA[gh_account]]></FromUserName><CreateTime>`), s) {
+			return
+		}
+		if !assert.True(t, strings.HasSuffix(s, `<MsgType><![CDATA[`+c.msgType+`]]></MsgType>`+c.body+`</xml>`), s) {
+			return
+		}
+	}
+
+	{
+		articles := make([]Article, MaxReplyArticles+1)
+		data, err := (&NewsReply{Articles: articles}).MarshalReply(msg)
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, MaxReplyArticles, strings.Count(string(data), "<item>")) {
+			return
+		}
+	}
+
+	{
+		data, err := SuccessReply.MarshalReply(msg)
+		if !assert.Nil(t, err) || !assert.Equal(t, "success", string(data)) {
+			return
+		}
+		data, err = EmptyReply.MarshalReply(msg)
+		if !assert.Nil(t, err) || !assert.Equal(t, "", string(data)) {
+			return
+		}
+	}
+}
+
+func TestEncryptedReply(t *testing.T) {
+
+	crypter, err := wxcrypt.NewCrypter("spamtest", "abcdefghijklmnopqrstuvwxyz0123456789ABCDEFG", "wx2c2769f8efd9abc2")
+	if !assert.Nil(t, err) {
+		return
+	}
+	plain := []byte(`<xml><ToUserName><![CDATA[gh_account]]></ToUserName>` +
+		`<FromUserName><![CDATA[OPENID]]></FromUserName><CreateTime>1409735668</CreateTime>` +
+		`<MsgType><![CDATA[text]]></MsgType><Content><![CDATA[hi]]></Content><MsgId>1</MsgId></xml>`)
+	encrypted, err := crypter.Encrypt(plain)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	s, _ := NewWXService(&Option{Token: "spamtest", AppID: "wx2c2769f8efd9abc2"})
+	s.SetCrypter(crypter)
+	var reply Reply
+	s.Router().HandleMsgType(MsgTypeText, func(ctx context.Context, msg Message) Reply {
+		return reply
+	})
+
+	req := &PushRequest{
+		Timestamp:    "1409735669",
+		Nonce:        "1320562132",
+		EncryptType:  EncryptTypeAES,
+		MsgSignature: crypter.Signature("1409735669", "1320562132", encrypted),
+		Body:         []byte(`<xml><Encrypt><![CDATA[` + encrypted + `]]></Encrypt></xml>`),
+	}
+
+	{
+		reply = &TextReply{Content: "hello"}
+		data, err := s.HandleMessage(nil, req)
+		if !assert.Nil(t, err) {
+			return
+		}
+		envelope := struct {
+			Encrypt      string
+			MsgSignature string
+			TimeStamp    string
+			Nonce        string
+		}{}
+		if !assert.Nil(t, xml.Unmarshal(data, &envelope)) {
+			return
+		}
+		if !assert.Nil(t, crypter.VerifySignature(envelope.MsgSignature, req.Timestamp, req.Nonce, envelope.Encrypt)) {
+			return
+		}
+		decrypted, err := crypter.Decrypt(envelope.Encrypt)
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Contains(t, string(decrypted), `<Content><![CDATA[hello]]></Content>`) {
+			return
+		}
+	}
+
+	{
+		// acknowledgement is never encrypted
+		reply = SuccessReply
+		s.SetDedupStore(NewMemoryDedupStore(0, 0))
+		data, err := s.HandleMessage(nil, req)
+		if !assert.Nil(t, err) || !assert.Equal(t, "success", string(data)) {
+			return
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package service
+
+import (
+	"github.com/hyt-hz/wxOpenID/log"
+	"golang.org/x/net/context"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// passive reply to a message, sent back in response of the push
+type Reply interface {
+	// reply in XML, addressed to sender of msg
+	MarshalReply(msg Message) ([]byte, error)
+}
+
+// handler of messages pushed by WeChat, returns nil if no passive reply
+type MessageHandler func(ctx context.Context, msg Message) Reply
+
+type MessageMiddleware func(MessageHandler) MessageHandler
+
+type routeRule struct {
+	match   func(Message) bool
+	handler MessageHandler
+}
+
+// router of messages to handlers by rules, the first matching rule wins, and
+// fallback handler is used if none matches
+//
+// to register handlers:
+//
+// r := NewMessageRouter()
+// r.Use(RecoveryMessageMiddleware)
+// r.HandleEvent(EventSubscribe, welcome)
+// r.HandleEventKeyPrefix(EventClick, "MENU_", menuClicked)
+// r.HandleContent(regexp.MustCompile(`^help`), help)
+// r.Fallback(defaultReply)
+type MessageRouter struct {
+	sync.RWMutex
+	rules           []routeRule
+	middlewareStack []MessageMiddleware
+	fallback        MessageHandler
+}
+
+func NewMessageRouter() *MessageRouter {
+	return &MessageRouter{
+		rules:           make([]routeRule, 0, 10),
+		middlewareStack: make([]MessageMiddleware, 0, 10),
+	}
+}
+
+// add middleware wrapping all handlers, the first added is the outermost
+func (r *MessageRouter) Use(m MessageMiddleware) *MessageRouter {
+	r.Lock()
+	defer r.Unlock()
+
+	r.middlewareStack = append(r.middlewareStack, m)
+	return r
+}
+
+// handle messages matched by match
+func (r *MessageRouter) Handle(match func(Message) bool, h MessageHandler) *MessageRouter {
+	r.Lock()
+	defer r.Unlock()
+
+	r.rules = append(r.rules, routeRule{match: match, handler: h})
+	return r
+}
+
+// handle messages of msgType, e.g. MsgTypeText
+func (r *MessageRouter) HandleMsgType(msgType string, h MessageHandler) *MessageRouter {
+	return r.Handle(func(msg Message) bool {
+		return msg.Header().MsgType == msgType
+	}, h)
+}
+
+// handle events of event, e.g. EventSubscribe
+func (r *MessageRouter) HandleEvent(event string, h MessageHandler) *MessageRouter {
+	return r.Handle(func(msg Message) bool {
+		return EventOf(msg) == event
+	}, h)
+}
+
+// handle events of event with EventKey starting with prefix
+func (r *MessageRouter) HandleEventKeyPrefix(event string, prefix string, h MessageHandler) *MessageRouter {
+	return r.Handle(func(msg Message) bool {
+		return EventOf(msg) == event && strings.HasPrefix(EventKeyOf(msg), prefix)
+	}, h)
+}
+
+// handle text messages with content matching re
+func (r *MessageRouter) HandleContent(re *regexp.Regexp, h MessageHandler) *MessageRouter {
+	return r.Handle(func(msg Message) bool {
+		text, ok := msg.(*TextMessage)
+		return ok && re.MatchString(text.Content)
+	}, h)
+}
+
+// handle messages matched by no rule
+func (r *MessageRouter) Fallback(h MessageHandler) *MessageRouter {
+	r.Lock()
+	defer r.Unlock()
+
+	r.fallback = h
+	return r
+}
+
+// run handler of the first rule matching msg
+func (r *MessageRouter) Route(ctx context.Context, msg Message) Reply {
+
+	r.RLock()
+	h := r.fallback
+	for _, rule := range r.rules {
+		if rule.match(msg) {
+			h = rule.handler
+			break
+		}
+	}
+	middlewareStack := r.middlewareStack
+	r.RUnlock()
+
+	if h == nil {
+		// middleware still sees messages nobody handles
+		h = func(ctx context.Context, msg Message) Reply {
+			return nil
+		}
+	}
+	for i := len(middlewareStack); i > 0; i-- {
+		h = middlewareStack[i-1](h)
+	}
+
+	return h(ctx, msg)
+}
+
+// EventKey of event, empty if msg has no EventKey
+func EventKeyOf(msg Message) string {
+	switch e := msg.(type) {
+	case *SubscribeEvent:
+		return e.EventKey
+	case *ScanEvent:
+		return e.EventKey
+	case *ClickEvent:
+		return e.EventKey
+	case *ViewEvent:
+		return e.EventKey
+	default:
+		return ""
+	}
+}
+
+func LoggerMessageMiddleware(h MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg Message) Reply {
+		start := time.Now()
+		reply := h(ctx, msg)
+		header := msg.Header()
+		log.Info("Message %s %s from %s <%.3f>", header.MsgType, EventOf(msg), header.FromUserName,
+			time.Now().Sub(start).Seconds())
+		return reply
+	}
+}
+
+// middleware calling observe with events of the given types before routing
+// them, whether any rule matches them or not, e.g. to keep records of users
+func EventObserverMiddleware(observe func(ctx context.Context, msg Message), events ...string) MessageMiddleware {
+	return func(h MessageHandler) MessageHandler {
+		return func(ctx context.Context, msg Message) Reply {
+			event := EventOf(msg)
+			for _, e := range events {
+				if e == event {
+					observe(ctx, msg)
+					break
+				}
+			}
+			return h(ctx, msg)
+		}
+	}
+}
+
+// recover from panic in handler, and reply nothing
+func RecoveryMessageMiddleware(h MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg Message) (reply Reply) {
+		defer func() {
+			if err := recover(); err != nil {
+				log.Error("Panic recovery in message handler -> %s\n%s", err, debug.Stack())
+				reply = nil
+			}
+		}()
+		return h(ctx, msg)
+	}
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// reply with fixed content, for test purpose
+type testReply string
+
+func (r testReply) MarshalReply(msg Message) ([]byte, error) {
+	return []byte(r), nil
+}
+
+func replyWith(content string) MessageHandler {
+	return func(ctx context.Context, msg Message) Reply {
+		return testReply(content)
+	}
+}
+
+func newTextMessage(content string) *TextMessage {
+	return &TextMessage{
+		MessageHeader: MessageHeader{MsgType: MsgTypeText, FromUserName: "OPENID"},
+		Content:       content,
+	}
+}
+
+func newEvent(event string, eventKey string) Message {
+	header := EventHeader{
+		MessageHeader: MessageHeader{MsgType: MsgTypeEvent, FromUserName: "OPENID"},
+		Event:         event,
+	}
+	switch event {
+	case EventSubscribe:
+		return &SubscribeEvent{EventHeader: header, EventKey: eventKey}
+	case EventScan:
+		return &ScanEvent{EventHeader: header, EventKey: eventKey}
+	case EventClick:
+		return &ClickEvent{EventHeader: header, EventKey: eventKey}
+	default:
+		return &UnsubscribeEvent{EventHeader: header}
+	}
+}
+
+func TestMessageRouter(t *testing.T) {
+
+	r := NewMessageRouter()
+	r.HandleContent(regexp.MustCompile(`^help`), replyWith("help"))
+	r.HandleMsgType(MsgTypeText, replyWith("text"))
+	r.HandleEventKeyPrefix(EventClick, "MENU_", replyWith("menu"))
+	r.HandleEvent(EventClick, replyWith("click"))
+	r.HandleEvent(EventSubscribe, replyWith("subscribe"))
+	r.HandleEvent(EventSubscribe, replyWith("never"))
+
+	cases := []struct {
+		msg   Message
+		reply Reply
+	}{
+		{newTextMessage("help me"), testReply("help")},
+		{newTextMessage("hello"), testReply("text")},
+		{newEvent(EventClick, "MENU_1"), testReply("menu")},
+		{newEvent(EventClick, "OTHER"), testReply("click")},
+		{newEvent(EventSubscribe, ""), testReply("subscribe")},
+		{newEvent(EventUnsubscribe, ""), nil},
+	}
+	for _, c := range cases {
+		if !assert.Equal(t, c.reply, r.Route(nil, c.msg)) {
+			return
+		}
+	}
+
+	r.Fallback(replyWith("fallback"))
+	if !assert.Equal(t, testReply("fallback"), r.Route(nil, newEvent(EventUnsubscribe, ""))) {
+		return
+	}
+}
+
+func TestMessageRouterMiddleware(t *testing.T) {
+
+	order := ""
+	r := NewMessageRouter()
+	r.Use(func(h MessageHandler) MessageHandler {
+		return func(ctx context.Context, msg Message) Reply {
+			order += "1"
+			return h(ctx, msg)
+		}
+	}).Use(func(h MessageHandler) MessageHandler {
+		return func(ctx context.Context, msg Message) Reply {
+			order += "2"
+			return h(ctx, msg)
+		}
+	}).Use(RecoveryMessageMiddleware)
+
+	r.HandleEvent(EventClick, func(ctx context.Context, msg Message) Reply {
+		order += "h"
+		panic("test")
+	})
+
+	if !assert.Nil(t, r.Route(nil, newEvent(EventClick, "KEY"))) {
+		return
+	}
+	if !assert.Equal(t, "12h", order) {
+		return
+	}
+}
+
+func TestEventObserverMiddleware(t *testing.T) {
+
+	observed := ""
+	r := NewMessageRouter()
+	r.Use(EventObserverMiddleware(func(ctx context.Context, msg Message) {
+		observed += EventOf(msg)
+	}, EventSubscribe, EventScan))
+	r.HandleEvent(EventSubscribe, replyWith("welcome"))
+
+	if !assert.Equal(t, testReply("welcome"), r.Route(nil, newEvent(EventSubscribe, ""))) {
+		return
+	}
+	// observed even without handler
+	if !assert.Nil(t, r.Route(nil, newEvent(EventScan, "1"))) {
+		return
+	}
+	if !assert.Nil(t, r.Route(nil, newEvent(EventClick, "KEY"))) {
+		return
+	}
+	if !assert.Equal(t, EventSubscribe+EventScan, observed) {
+		return
+	}
+}
+
+func TestDispatch(t *testing.T) {
+
+	var slowDone int32
+	r := NewMessageRouter()
+	r.HandleMsgType(MsgTypeText, replyWith("text"))
+	r.HandleEvent(EventSubscribe, func(ctx context.Context, msg Message) Reply {
+		time.Sleep(200 * time.Millisecond)
+		atomic.AddInt32(&slowDone, 1)
+		return testReply("late")
+	})
+	d := NewMessageDispatcher(r, 50*time.Millisecond)
+
+	if !assert.Equal(t, testReply("text"), d.Dispatch(newTextMessage("hello"))) {
+		return
+	}
+
+	// slow handler does not block dispatch
+	start := time.Now()
+	if !assert.Nil(t, d.Dispatch(newEvent(EventSubscribe, ""))) {
+		return
+	}
+	if !assert.True(t, time.Since(start) < 150*time.Millisecond) {
+		return
+	}
+	if !assert.Equal(t, int32(0), atomic.LoadInt32(&slowDone)) {
+		return
+	}
+	time.Sleep(250 * time.Millisecond)
+	if !assert.Equal(t, int32(1), atomic.LoadInt32(&slowDone)) {
+		return
+	}
+}
@@ -0,0 +1,210 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	ErrUnknownSubscribeTemplate = errors.New("Subscribe message template not declared")
+	ErrInvalidMiniProgramState  = errors.New("Invalid miniprogram_state, must be developer, trial or formal")
+	ErrMissingRecipient         = errors.New("Recipient or template of message missing")
+)
+
+// WeChat error codes of subscribe message
+const (
+	ECSubscribeRefused      = 43101
+	ECInvalidTemplateParams = 47003
+)
+
+// mini-program version opened by clicking subscribe message
+const (
+	MiniProgramStateDeveloper = "developer"
+	MiniProgramStateTrial     = "trial"
+	MiniProgramStateFormal    = "formal"
+)
+
+// types of subscribe message template fields, the key of a field is its
+// type followed by a number, e.g. thing1
+const (
+	FieldThing           = "thing"
+	FieldNumber          = "number"
+	FieldLetter          = "letter"
+	FieldSymbol          = "symbol"
+	FieldCharacterString = "character_string"
+	FieldTime            = "time"
+	FieldDate            = "date"
+	FieldAmount          = "amount"
+	FieldPhoneNumber     = "phone_number"
+	FieldCarNumber       = "car_number"
+	FieldName            = "name"
+	FieldPhrase          = "phrase"
+)
+
+var (
+	clockPattern   = `([01]?\d|2[0-3]):[0-5]\d(:[0-5]\d)?`
+	datePattern    = `(\d{4}-\d{1,2}-\d{1,2}|\d{4}年\d{1,2}月\d{1,2}日)( ` + clockPattern + `)?`
+	timeRegexp     = regexp.MustCompile(`^(` + clockPattern + `|` + datePattern + `)(~(` + clockPattern + `|` + datePattern + `))?$`)
+	dateRegexp     = regexp.MustCompile(`^` + datePattern + `(~` + datePattern + `)?$`)
+	numberRegexp   = regexp.MustCompile(`^-?\d+(\.\d+)?$`)
+	letterRegexp   = regexp.MustCompile(`^[a-zA-Z]+$`)
+	amountRegexp   = regexp.MustCompile(`^[^\d.\s]?\d{1,10}(\.\d{1,2})?元?$`)
+	phoneRegexp    = regexp.MustCompile(`^[\d+\-() ]+$`)
+	charStrRegexp  = regexp.MustCompile(`^[\x21-\x7e]+$`)
+	symbolRegexp   = regexp.MustCompile(`^[^\p{L}\p{N}\s]+$`)
+	carNumberRegex = regexp.MustCompile(`^[\p{Han}A-Z0-9]+$`)
+)
+
+// limits of field types, length in characters and pattern of value, nil
+// if any value
+var subscribeFieldRules = map[string]struct {
+	maxLen  int
+	pattern *regexp.Regexp
+}{
+	FieldThing:           {20, nil},
+	FieldNumber:          {32, numberRegexp},
+	FieldLetter:          {32, letterRegexp},
+	FieldSymbol:          {5, symbolRegexp},
+	FieldCharacterString: {32, charStrRegexp},
+	FieldTime:            {0, timeRegexp},
+	FieldDate:            {0, dateRegexp},
+	FieldAmount:          {0, amountRegexp},
+	FieldPhoneNumber:     {17, phoneRegexp},
+	FieldCarNumber:       {8, carNumberRegex},
+	FieldName:            {20, nil},
+	FieldPhrase:          {5, nil},
+}
+
+// value of subscribe message field
+type SubscribeData struct {
+	Value string `json:"value"`
+}
+
+// one-time subscribe message of mini-program
+type SubscribeMessage struct {
+	ToUser     string `json:"touser"`
+	TemplateID string `json:"template_id"`
+	// page opened by clicking the message, with query
+	Page string                   `json:"page,omitempty"`
+	Data map[string]SubscribeData `json:"data"`
+	// developer, trial or formal, formal if empty
+	MiniProgramState string `json:"miniprogram_state,omitempty"`
+	Lang             string `json:"lang,omitempty"`
+}
+
+// data of subscribe message not matching template schema
+type SubscribeDataError struct {
+	Field  string
+	Reason string
+}
+
+func (err *SubscribeDataError) Error() string {
+	return fmt.Sprintf("Invalid subscribe message field %s: %s", err.Field, err.Reason)
+}
+
+// check data of subscribe message against schema of its template, which
+// maps field keys to their types
+func ValidateSubscribeData(schema map[string]string, data map[string]SubscribeData) error {
+
+	keys := make([]string, 0, len(schema))
+	for key := range schema {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		d, ok := data[key]
+		if !ok || d.Value == "" {
+			return &SubscribeDataError{key, "missing"}
+		}
+		if err := validateSubscribeField(schema[key], d.Value); err != "" {
+			return &SubscribeDataError{key, err}
+		}
+	}
+	for key := range data {
+		if _, ok := schema[key]; !ok {
+			return &SubscribeDataError{key, "not in template"}
+		}
+	}
+	return nil
+}
+
+// check field types in template schemas declared in mini-program option
+func validateSubscribeTemplates(mp *MiniProgramOption) error {
+	for templateID, schema := range mp.SubscribeTemplates {
+		for key, fieldType := range schema {
+			if _, ok := subscribeFieldRules[fieldType]; !ok {
+				return fmt.Errorf("Unknown type %s of field %s in subscribe template %s of mini-program %s",
+					fieldType, key, templateID, mp.AppID)
+			}
+		}
+	}
+	return nil
+}
+
+// reason why value is invalid for field type, empty if it's valid
+func validateSubscribeField(fieldType string, value string) string {
+
+	rule, ok := subscribeFieldRules[fieldType]
+	if !ok {
+		return "unknown type " + fieldType
+	}
+	if n := utf8.RuneCountInString(value); rule.maxLen > 0 && n > rule.maxLen {
+		return fmt.Sprintf("%s longer than %d characters", fieldType, rule.maxLen)
+	}
+	if rule.pattern != nil && !rule.pattern.MatchString(value) {
+		return "invalid " + fieldType
+	}
+
+	switch fieldType {
+	case FieldPhrase:
+		// Chinese characters only
+		if strings.IndexFunc(value, func(r rune) bool { return !isHan(r) }) >= 0 {
+			return "phrase must be Chinese characters"
+		}
+	case FieldName:
+		// 10 Chinese characters, or 20 letters
+		if strings.IndexFunc(value, isHan) >= 0 && utf8.RuneCountInString(value) > 10 {
+			return "name longer than 10 Chinese characters"
+		}
+	}
+	return ""
+}
+
+func isHan(r rune) bool {
+	return unicode.Is(unicode.Han, r)
+}
+
+// send subscribe message of mini-program, the data is validated against
+// template schema declared in its option before sending
+func (s *WXService) SendSubscribeMessage(ctx context.Context, appID string, msg *SubscribeMessage) error {
+
+	mp, ok := s.miniPrograms[appID]
+	if !ok {
+		return ErrUnknownMiniProgram
+	}
+	if msg.ToUser == "" || msg.TemplateID == "" {
+		return ErrMissingRecipient
+	}
+	switch msg.MiniProgramState {
+	case "", MiniProgramStateDeveloper, MiniProgramStateTrial, MiniProgramStateFormal:
+	default:
+		return ErrInvalidMiniProgramState
+	}
+
+	schema, ok := mp.SubscribeTemplates[msg.TemplateID]
+	if !ok {
+		return ErrUnknownSubscribeTemplate
+	}
+	if err := ValidateSubscribeData(schema, msg.Data); err != nil {
+		return err
+	}
+
+	return s.miniProgramTokens[appID].PostJSON(ctx, "/cgi-bin/message/subscribe/send", nil, msg, nil)
+}
@@ -0,0 +1,181 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestValidateSubscribeData(t *testing.T) {
+
+	cases := []struct {
+		fieldType string
+		value     string
+		valid     bool
+	}{
+		{FieldThing, "12345678901234567890", true},
+		{FieldThing, "一二三四五六七八九十一二三四五六七八九十", true},
+		{FieldThing, "123456789012345678901", false},
+		{FieldNumber, "12.5", true},
+		{FieldNumber, "12a", false},
+		{FieldLetter, "abcXYZ", true},
+		{FieldLetter, "abc1", false},
+		{FieldSymbol, "%$#", true},
+		{FieldSymbol, "a", false},
+		{FieldCharacterString, "ORDER-123", true},
+		{FieldCharacterString, "订单123", false},
+		{FieldTime, "15:01", true},
+		{FieldTime, "2019-10-01 15:01", true},
+		{FieldTime, "25:01", false},
+		{FieldDate, "2019年10月1日", true},
+		{FieldDate, "2019年10月1日 15:01", true},
+		{FieldDate, "2019-10-01~2019-10-07", true},
+		{FieldDate, "tomorrow", false},
+		{FieldAmount, "¥100.00", true},
+		{FieldAmount, "100元", true},
+		{FieldAmount, "100.001", false},
+		{FieldPhoneNumber, "+86-0755-12345678", true},
+		{FieldPhoneNumber, "1380013800a", false},
+		{FieldCarNumber, "粤A12345", true},
+		{FieldCarNumber, "粤A1234567", false},
+		{FieldName, "张三", true},
+		{FieldName, "Alexander Hamilton", true},
+		{FieldName, "一二三四五六七八九十一", false},
+		{FieldPhrase, "已发货", true},
+		{FieldPhrase, "shipped", false},
+		{FieldPhrase, "一二三四五六", false},
+		{"unknown", "a", false},
+	}
+
+	for _, c := range cases {
+		err := ValidateSubscribeData(map[string]string{"key1": c.fieldType}, map[string]SubscribeData{"key1": {c.value}})
+		if !assert.Equal(t, c.valid, err == nil, c.fieldType+" "+c.value) {
+			return
+		}
+	}
+
+	schema := map[string]string{"thing1": FieldThing, "date2": FieldDate}
+	{
+		err := ValidateSubscribeData(schema, map[string]SubscribeData{"thing1": {"a"}})
+		if !assert.Equal(t, &SubscribeDataError{"date2", "missing"}, err) {
+			return
+		}
+	}
+	{
+		err := ValidateSubscribeData(schema, map[string]SubscribeData{"thing1": {"a"}, "date2": {"2019-10-01"}, "x3": {"b"}})
+		if !assert.Equal(t, &SubscribeDataError{"x3", "not in template"}, err) {
+			return
+		}
+	}
+}
+
+func TestValidateSubscribeTemplates(t *testing.T) {
+
+	// unknown field type fails at startup
+	_, err := NewWXService(&Option{MiniPrograms: []MiniProgramOption{{
+		AppID:              "wxmini",
+		SubscribeTemplates: map[string]map[string]string{"TEMPLATE": {"thing1": "thing", "foo2": "foo"}},
+	}}})
+	if !assert.NotNil(t, err) || !assert.Contains(t, err.Error(), "foo2") {
+		return
+	}
+
+	_, err = NewWXService(&Option{MiniPrograms: []MiniProgramOption{{
+		AppID:              "wxmini",
+		SubscribeTemplates: map[string]map[string]string{"TEMPLATE": {"thing1": "thing", "time2": "time"}},
+	}}})
+	if !assert.Nil(t, err) {
+		return
+	}
+}
+
+func TestSendSubscribeMessage(t *testing.T) {
+
+	option := &Option{
+		MiniPrograms: []MiniProgramOption{{
+			AppID:     "wxmini",
+			AppSecret: "secret",
+			SubscribeTemplates: map[string]map[string]string{
+				"TEMPLATE": {"thing1": FieldThing, "phrase2": FieldPhrase},
+			},
+		}},
+	}
+	sent := make(chan map[string]interface{}, 1)
+	s, ts := newTestService(option, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cgi-bin/token":
+			if r.FormValue("appid") != "wxmini" {
+				w.Write([]byte(`{"errcode": 40013, "errmsg": "invalid appid"}`))
+				return
+			}
+			w.Write([]byte(`{"access_token": "MINITOKEN", "expires_in": 7200}`))
+		case "/cgi-bin/message/subscribe/send":
+			if r.FormValue("access_token") != "MINITOKEN" {
+				w.Write([]byte(`{"errcode": 40001, "errmsg": "invalid credential"}`))
+				return
+			}
+			req := map[string]interface{}{}
+			json.NewDecoder(r.Body).Decode(&req)
+			if req["touser"] == "REFUSED" {
+				w.Write([]byte(`{"errcode": 43101, "errmsg": "user refuse to accept the msg"}`))
+				return
+			}
+			sent <- req
+			w.Write([]byte(`{"errcode": 0, "errmsg": "ok"}`))
+		}
+	})
+	defer ts.Close()
+
+	msg := &SubscribeMessage{
+		ToUser:           "OPENID",
+		TemplateID:       "TEMPLATE",
+		Page:             "pages/order?id=1",
+		Data:             map[string]SubscribeData{"thing1": {"Order 1"}, "phrase2": {"已发货"}},
+		MiniProgramState: MiniProgramStateTrial,
+	}
+	if !assert.Nil(t, s.SendSubscribeMessage(nil, "wxmini", msg)) {
+		return
+	}
+	req := <-sent
+	if !assert.Equal(t, "pages/order?id=1", req["page"]) || !assert.Equal(t, "trial", req["miniprogram_state"]) {
+		return
+	}
+	if !assert.Equal(t, "已发货", req["data"].(map[string]interface{})["phrase2"].(map[string]interface{})["value"]) {
+		return
+	}
+
+	{
+		msg := *msg
+		msg.ToUser = "REFUSED"
+		if !assert.True(t, IsWXError(s.SendSubscribeMessage(nil, "wxmini", &msg), ECSubscribeRefused)) {
+			return
+		}
+	}
+
+	{
+		msg := *msg
+		msg.Data = map[string]SubscribeData{"thing1": {"Order 1"}, "phrase2": {"shipped"}}
+		_, ok := s.SendSubscribeMessage(nil, "wxmini", &msg).(*SubscribeDataError)
+		if !assert.True(t, ok) {
+			return
+		}
+	}
+
+	{
+		msg := *msg
+		msg.TemplateID = "UNKNOWN"
+		if !assert.Equal(t, ErrUnknownSubscribeTemplate, s.SendSubscribeMessage(nil, "wxmini", &msg)) {
+			return
+		}
+		msg.TemplateID = "TEMPLATE"
+		msg.MiniProgramState = "release"
+		if !assert.Equal(t, ErrInvalidMiniProgramState, s.SendSubscribeMessage(nil, "wxmini", &msg)) {
+			return
+		}
+	}
+
+	if !assert.Equal(t, ErrUnknownMiniProgram, s.SendSubscribeMessage(nil, "wxother", msg)) {
+		return
+	}
+}
@@ -0,0 +1,222 @@
+package service
+
+import (
+	"errors"
+	"github.com/hyt-hz/wxOpenID/log"
+	"golang.org/x/net/context"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTemplateDeliveryNotFound = errors.New("Template message not found")
+)
+
+// delivery status of template message, the failed ones are reported by
+// TEMPLATESENDJOBFINISH event as is
+const (
+	TemplateStatusSent         = "sent"
+	TemplateStatusSuccess      = "success"
+	TemplateStatusUserBlock    = "failed:user block"
+	TemplateStatusSystemFailed = "failed:system failed"
+)
+
+const (
+	// template deliveries are kept this long
+	templateDeliveryRetention = 30 * 24 * time.Hour
+)
+
+// value of a template field, color is like "#173177"
+type TemplateData struct {
+	Value string `json:"value"`
+	Color string `json:"color,omitempty"`
+}
+
+// mini-program page opened by clicking template message
+type TemplateMiniProgram struct {
+	AppID    string `json:"appid"`
+	PagePath string `json:"pagepath,omitempty"`
+}
+
+// template message sent and its delivery status
+type TemplateDelivery struct {
+	MsgID      int64     `json:"msgid"`
+	OpenID     string    `json:"openid"`
+	TemplateID string    `json:"template_id"`
+	Status     string    `json:"status"`
+	SentAt     time.Time `json:"sent_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// storage of template deliveries, keyed by msgid
+type TemplateDeliveryStore interface {
+	Get(msgID int64) (*TemplateDelivery, error)
+	Put(delivery *TemplateDelivery) error
+}
+
+// TemplateDeliveryStore in memory, deliveries older than retention are
+// swept when new delivery is put
+type MemoryTemplateDeliveryStore struct {
+	sync.Mutex
+	deliveries map[int64]TemplateDelivery
+	lastSweep  time.Time
+}
+
+func NewMemoryTemplateDeliveryStore() *MemoryTemplateDeliveryStore {
+	return &MemoryTemplateDeliveryStore{
+		deliveries: make(map[int64]TemplateDelivery),
+		lastSweep:  time.Now(),
+	}
+}
+
+func (ms *MemoryTemplateDeliveryStore) Get(msgID int64) (*TemplateDelivery, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	delivery, ok := ms.deliveries[msgID]
+	if !ok {
+		return nil, ErrTemplateDeliveryNotFound
+	}
+	return &delivery, nil
+}
+
+func (ms *MemoryTemplateDeliveryStore) Put(delivery *TemplateDelivery) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	ms.put(delivery)
+	return nil
+}
+
+func (ms *MemoryTemplateDeliveryStore) put(delivery *TemplateDelivery) {
+
+	now := time.Now()
+	if now.Sub(ms.lastSweep) > time.Hour {
+		for msgID, d := range ms.deliveries {
+			if now.Sub(d.SentAt) > templateDeliveryRetention {
+				delete(ms.deliveries, msgID)
+			}
+		}
+		ms.lastSweep = now
+	}
+
+	ms.deliveries[delivery.MsgID] = *delivery
+}
+
+// TemplateDeliveryStore persisted in a JSON file, the whole file is
+// rewritten in background after changes
+type FileTemplateDeliveryStore struct {
+	MemoryTemplateDeliveryStore
+	file *jsonFile
+}
+
+func NewFileTemplateDeliveryStore(path string) (*FileTemplateDeliveryStore, error) {
+
+	fs := &FileTemplateDeliveryStore{
+		MemoryTemplateDeliveryStore: *NewMemoryTemplateDeliveryStore(),
+		file:                        newJSONFile("template delivery", path),
+	}
+
+	if err := fs.file.Load(&fs.deliveries); err != nil {
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+func (fs *FileTemplateDeliveryStore) Put(delivery *TemplateDelivery) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	fs.put(delivery)
+	fs.file.SaveLater(fs, fs.deliveries)
+	return nil
+}
+
+// write deliveries saved in background to the file
+func (fs *FileTemplateDeliveryStore) Flush() error {
+	return fs.file.Flush()
+}
+
+// send template message to follower, with url or mini-program page opened by
+// clicking it, both are optional, the msgid returned can be used to query
+// delivery status later
+func (s *WXService) SendTemplateMessage(ctx context.Context, openID, templateID, url string,
+	miniProgram *TemplateMiniProgram, data map[string]TemplateData) (msgID int64, err error) {
+
+	body := struct {
+		ToUser      string                  `json:"touser"`
+		TemplateID  string                  `json:"template_id"`
+		URL         string                  `json:"url,omitempty"`
+		MiniProgram *TemplateMiniProgram    `json:"miniprogram,omitempty"`
+		Data        map[string]TemplateData `json:"data"`
+	}{openID, templateID, url, miniProgram, data}
+
+	result := struct {
+		MsgID int64 `json:"msgid"`
+	}{}
+	if err = s.accessToken.PostJSON(ctx, "/cgi-bin/message/template/send", nil, &body, &result); err != nil {
+		return 0, err
+	}
+
+	delivery := &TemplateDelivery{
+		MsgID:      result.MsgID,
+		OpenID:     openID,
+		TemplateID: templateID,
+		Status:     TemplateStatusSent,
+		SentAt:     time.Now(),
+	}
+	if err := s.saveTemplateDelivery(delivery); err != nil {
+		log.Warning("Failed to save template message %d: %s", result.MsgID, err)
+	}
+
+	return result.MsgID, nil
+}
+
+// template message sent and its delivery status
+func (s *WXService) GetTemplateDelivery(msgID int64) (*TemplateDelivery, error) {
+	return s.templateDeliveries.Get(msgID)
+}
+
+func (s *WXService) saveTemplateDelivery(delivery *TemplateDelivery) error {
+	s.templateLock.Lock()
+	defer s.templateLock.Unlock()
+
+	// result may be pushed before we save the sent one
+	if saved, err := s.templateDeliveries.Get(delivery.MsgID); err == nil && saved.Status != TemplateStatusSent {
+		delivery.Status = saved.Status
+		delivery.FinishedAt = saved.FinishedAt
+	}
+	return s.templateDeliveries.Put(delivery)
+}
+
+// update delivery status with TEMPLATESENDJOBFINISH event, observed by router
+// middleware
+func (s *WXService) trackTemplateDelivery(ctx context.Context, msg Message) {
+
+	e, ok := msg.(*TemplateSendJobFinishEvent)
+	if !ok {
+		return
+	}
+
+	s.templateLock.Lock()
+	defer s.templateLock.Unlock()
+
+	delivery, err := s.templateDeliveries.Get(e.MsgID)
+	if err == ErrTemplateDeliveryNotFound {
+		delivery, err = &TemplateDelivery{MsgID: e.MsgID, OpenID: e.FromUserName, SentAt: time.Unix(e.CreateTime, 0)}, nil
+	}
+	if err != nil {
+		log.Error("Failed to load template message %d: %s", e.MsgID, err)
+		return
+	}
+
+	delivery.Status = e.Status
+	delivery.FinishedAt = time.Unix(e.CreateTime, 0)
+	if err := s.templateDeliveries.Put(delivery); err != nil {
+		log.Error("Failed to save status of template message %d: %s", e.MsgID, err)
+	}
+	if e.Status != TemplateStatusSuccess {
+		log.Warning("Template message %d to %s not delivered: %s", e.MsgID, e.FromUserName, e.Status)
+	}
+}
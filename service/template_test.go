@@ -0,0 +1,138 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func pushTemplateSendJobFinish(s *WXService, msgID int64, status string) error {
+	body := fmt.Sprintf(`<xml><ToUserName><![CDATA[gh_account]]></ToUserName>`+
+		`<FromUserName><![CDATA[OPENID]]></FromUserName><CreateTime>1395658920</CreateTime>`+
+		`<MsgType><![CDATA[event]]></MsgType><Event><![CDATA[TEMPLATESENDJOBFINISH]]></Event>`+
+		`<MsgID>%d</MsgID><Status><![CDATA[%s]]></Status></xml>`, msgID, status)
+	_, err := s.HandleMessage(nil, &PushRequest{Body: []byte(body)})
+	return err
+}
+
+func TestSendTemplateMessage(t *testing.T) {
+
+	s, ts := newTestService(&Option{AppID: "wx123", AppSecret: "secret"}, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cgi-bin/token":
+			w.Write([]byte(`{"access_token": "TOKEN", "expires_in": 7200}`))
+		case "/cgi-bin/message/template/send":
+			if r.FormValue("access_token") != "TOKEN" {
+				w.Write([]byte(`{"errcode": 40001, "errmsg": "invalid credential"}`))
+				return
+			}
+			req := map[string]interface{}{}
+			json.NewDecoder(r.Body).Decode(&req)
+			if req["template_id"] != "TEMPLATE" {
+				w.Write([]byte(`{"errcode": 40037, "errmsg": "invalid template_id"}`))
+				return
+			}
+			if req["touser"] != "OPENID" || req["url"] != "http://m.example.com/order" ||
+				req["miniprogram"].(map[string]interface{})["appid"] != "wxmini" {
+				w.Write([]byte(`{"errcode": 40003, "errmsg": "invalid openid"}`))
+				return
+			}
+			first := req["data"].(map[string]interface{})["first"].(map[string]interface{})
+			if first["value"] != "Order shipped" || first["color"] != "#173177" {
+				w.Write([]byte(`{"errcode": 47001, "errmsg": "data format error"}`))
+				return
+			}
+			w.Write([]byte(`{"errcode": 0, "errmsg": "ok", "msgid": 200228332}`))
+		}
+	})
+	defer ts.Close()
+
+	data := map[string]TemplateData{
+		"first":   {Value: "Order shipped", Color: "#173177"},
+		"keyword": {Value: "123"},
+	}
+	msgID, err := s.SendTemplateMessage(nil, "OPENID", "TEMPLATE", "http://m.example.com/order",
+		&TemplateMiniProgram{AppID: "wxmini", PagePath: "pages/order"}, data)
+	if !assert.Nil(t, err) || !assert.Equal(t, int64(200228332), msgID) {
+		return
+	}
+
+	delivery, err := s.GetTemplateDelivery(msgID)
+	if !assert.Nil(t, err) || !assert.Equal(t, TemplateStatusSent, delivery.Status) ||
+		!assert.Equal(t, "OPENID", delivery.OpenID) || !assert.Equal(t, "TEMPLATE", delivery.TemplateID) {
+		return
+	}
+
+	if !assert.Nil(t, pushTemplateSendJobFinish(s, msgID, TemplateStatusUserBlock)) {
+		return
+	}
+	delivery, err = s.GetTemplateDelivery(msgID)
+	if !assert.Nil(t, err) || !assert.Equal(t, TemplateStatusUserBlock, delivery.Status) ||
+		!assert.Equal(t, time.Unix(1395658920, 0), delivery.FinishedAt) {
+		return
+	}
+
+	{
+		_, err := s.SendTemplateMessage(nil, "OPENID", "UNKNOWN", "", nil, data)
+		if !assert.True(t, IsWXError(err, ECInvalidTemplateID)) {
+			return
+		}
+	}
+
+	if _, err := s.GetTemplateDelivery(1); !assert.Equal(t, ErrTemplateDeliveryNotFound, err) {
+		return
+	}
+}
+
+func TestTemplateDeliveryPushedFirst(t *testing.T) {
+
+	s, _ := NewWXService(&Option{Token: "token"})
+
+	// result is pushed before the sent one is saved
+	if !assert.Nil(t, pushTemplateSendJobFinish(s, 100, TemplateStatusSuccess)) {
+		return
+	}
+	if !assert.Nil(t, s.saveTemplateDelivery(&TemplateDelivery{MsgID: 100, OpenID: "OPENID", Status: TemplateStatusSent})) {
+		return
+	}
+	delivery, err := s.GetTemplateDelivery(100)
+	if !assert.Nil(t, err) || !assert.Equal(t, TemplateStatusSuccess, delivery.Status) {
+		return
+	}
+}
+
+func TestFileTemplateDeliveryStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "wxtest")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "templates.json")
+
+	fs, err := NewFileTemplateDeliveryStore(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	if !assert.Nil(t, fs.Put(&TemplateDelivery{MsgID: 200228332, OpenID: "OPENID", Status: TemplateStatusSuccess})) {
+		return
+	}
+	if !assert.Nil(t, fs.Flush()) {
+		return
+	}
+
+	fs, err = NewFileTemplateDeliveryStore(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	delivery, err := fs.Get(200228332)
+	if !assert.Nil(t, err) || !assert.Equal(t, TemplateStatusSuccess, delivery.Status) {
+		return
+	}
+}
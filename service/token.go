@@ -0,0 +1,387 @@
+package service
+
+import (
+	"errors"
+	"github.com/hyt-hz/wxOpenID/log"
+	"golang.org/x/net/context"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTokenLockTimeout = errors.New("Timeout waiting for token refreshed by other replica")
+)
+
+const (
+	// background refresh never happens more often than this, to protect
+	// daily quota in case refresh margin is larger than token lifetime
+	tokenMinRefreshInterval = time.Minute
+	// wait before retry if background refresh failed, doubled after every
+	// failure in a row up to the max
+	tokenRetryInterval    = 10 * time.Second
+	tokenMaxRetryInterval = 30 * time.Minute
+	// lock of token refresh shared by replicas expires after this
+	tokenLockTTL = time.Minute
+	// how often to check the lock and the shared store while other replica
+	// is refreshing
+	tokenLockPollInterval = 200 * time.Millisecond
+)
+
+// errcodes of refresh which retrying won't fix, e.g. wrong AppSecret or our IP
+// not in the whitelist, 40001 means wrong AppSecret when fetching access_token
+var tokenFatalErrCodes = []int{ECInvalidCredential, ECInvalidAppID, ECInvalidAppSecret, ECIPNotWhitelisted}
+
+// credential with expiry, e.g. access_token or jsapi_ticket
+type Token struct {
+	Value     string    `json:"value"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (t *Token) Valid() bool {
+	return t != nil && t.Value != "" && time.Now().Before(t.ExpiresAt)
+}
+
+// fetch new token from WeChat
+type tokenFetcher func(ctx context.Context) (*Token, error)
+
+// refresh in flight, shared by all callers asking for refresh meanwhile
+type tokenCall struct {
+	done  chan struct{}
+	token *Token
+	err   error
+}
+
+// cache of a token, refreshed in background margin before it expires,
+// concurrent refreshes are collapsed into one fetch, the token is saved in
+// store and loaded from it at startup
+//
+// if a locker is set, the store is supposed to be shared by replicas, and
+// only the replica holding the lock fetches the token, others wait for it to
+// appear in the store
+type tokenCache struct {
+	sync.Mutex
+	name        string
+	key         string
+	fetch       tokenFetcher
+	margin      time.Duration
+	minInterval time.Duration
+	// initial and max wait before retry of background refresh
+	retryInterval    time.Duration
+	maxRetryInterval time.Duration
+	store            TokenStore
+	locker           Locker
+	loaded           bool
+	token            *Token
+	stale            string
+	call             *tokenCall
+	// closed and replaced every time token is refreshed
+	refreshedCh chan struct{}
+	stopCh      chan struct{}
+}
+
+func newTokenCache(name string, key string, fetch tokenFetcher, margin time.Duration) *tokenCache {
+	return &tokenCache{
+		name:             name,
+		key:              key,
+		fetch:            fetch,
+		margin:           margin,
+		minInterval:      tokenMinRefreshInterval,
+		retryInterval:    tokenRetryInterval,
+		maxRetryInterval: tokenMaxRetryInterval,
+		store:            NewMemoryTokenStore(),
+		refreshedCh:      make(chan struct{}),
+	}
+}
+
+func (tc *tokenCache) SetStore(store TokenStore) {
+	tc.Lock()
+	defer tc.Unlock()
+
+	tc.store = store
+	tc.loaded = false
+}
+
+func (tc *tokenCache) SetLocker(locker Locker) {
+	tc.Lock()
+	defer tc.Unlock()
+
+	tc.locker = locker
+}
+
+// cached token, loaded from store at the first time
+func (tc *tokenCache) current() *Token {
+	tc.Lock()
+	defer tc.Unlock()
+
+	if tc.token == nil && !tc.loaded {
+		tc.loaded = true
+		token, err := tc.store.Load(tc.key)
+		if err == nil && token.Valid() {
+			log.Info("Loaded %s from store, expires at %s", tc.name, token.ExpiresAt)
+			tc.token = token
+		} else if err != nil && err != ErrTokenNotFound {
+			log.Warning("Failed to load %s from store: %s", tc.name, err)
+		}
+	}
+
+	return tc.token
+}
+
+// get cached token, refresh it if not valid
+func (tc *tokenCache) Get(ctx context.Context) (*Token, error) {
+
+	token := tc.current()
+	if token.Valid() {
+		return token, nil
+	}
+	return tc.Refresh(ctx)
+}
+
+// fetch new token, if refresh is already in progress wait for its result
+// instead of fetching again
+func (tc *tokenCache) Refresh(ctx context.Context) (*Token, error) {
+
+	tc.Lock()
+	call := tc.fetchCall()
+	tc.Unlock()
+
+	return tc.wait(ctx, call)
+}
+
+// refresh token only if the cached one is the given stale token, so that
+// callers reporting the same stale token cause only one refresh
+func (tc *tokenCache) RefreshIfStale(ctx context.Context, stale string) (*Token, error) {
+
+	// load from store at the first time
+	tc.current()
+
+	// checked under lock, otherwise the refresh in progress may finish right
+	// after the check and the stale token is refreshed again
+	tc.Lock()
+	if tc.token.Valid() && tc.token.Value != stale {
+		token := tc.token
+		tc.Unlock()
+		return token, nil
+	}
+	call := tc.fetchCall()
+	tc.Unlock()
+
+	return tc.wait(ctx, call)
+}
+
+// refresh in progress or a new one, must be called with lock held
+func (tc *tokenCache) fetchCall() *tokenCall {
+
+	if tc.call == nil {
+		tc.call = &tokenCall{done: make(chan struct{})}
+		go tc.doFetch(tc.call)
+	}
+	return tc.call
+}
+
+func (tc *tokenCache) wait(ctx context.Context, call *tokenCall) (*Token, error) {
+
+	if ctx == nil {
+		<-call.done
+		return call.token, call.err
+	}
+
+	select {
+	case <-call.done:
+		return call.token, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// drop the cached token if it's the given stale one, next Get refreshes it
+func (tc *tokenCache) Invalidate(stale string) {
+	tc.Lock()
+	defer tc.Unlock()
+
+	if tc.token != nil && tc.token.Value == stale {
+		tc.token = nil
+		tc.stale = stale
+	}
+}
+
+// fetch is not bound to context of any caller, so cancellation of one caller
+// does not fail the others
+func (tc *tokenCache) doFetch(call *tokenCall) {
+
+	tc.Lock()
+	stale := tc.stale
+	if tc.token != nil {
+		stale = tc.token.Value
+	}
+	store := tc.store
+	locker := tc.locker
+	tc.Unlock()
+
+	if locker == nil {
+		call.token, call.err = tc.fetchAndSave(store)
+	} else {
+		call.token, call.err = tc.fetchShared(store, locker, stale)
+	}
+
+	tc.Lock()
+	if call.err == nil {
+		tc.token = call.token
+		tc.stale = ""
+		tc.loaded = true
+		close(tc.refreshedCh)
+		tc.refreshedCh = make(chan struct{})
+	}
+	tc.call = nil
+	tc.Unlock()
+
+	close(call.done)
+}
+
+func (tc *tokenCache) fetchAndSave(store TokenStore) (*Token, error) {
+
+	token, err := tc.fetch(context.Background())
+	if err != nil {
+		log.Error("Failed to refresh %s: %s", tc.name, err)
+		return nil, err
+	}
+	log.Info("Refreshed %s, expires at %s", tc.name, token.ExpiresAt)
+
+	if err := store.Save(tc.key, token); err != nil {
+		log.Warning("Failed to save %s to store: %s", tc.name, err)
+	}
+	return token, nil
+}
+
+// fetch token holding the lock shared by replicas, if other replica holds the
+// lock, wait for the token it saves in the shared store
+func (tc *tokenCache) fetchShared(store TokenStore, locker Locker, stale string) (*Token, error) {
+
+	deadline := time.Now().Add(2 * tokenLockTTL)
+	for {
+		if token := tc.loadRefreshed(store, stale); token != nil {
+			return token, nil
+		}
+
+		unlock, ok, err := locker.TryLock(tc.key, tokenLockTTL)
+		if err != nil {
+			log.Error("Failed to lock %s for refresh: %s", tc.name, err)
+			return nil, err
+		}
+		if ok {
+			defer unlock()
+			// other replica may have refreshed it before we got the lock
+			if token := tc.loadRefreshed(store, stale); token != nil {
+				return token, nil
+			}
+			return tc.fetchAndSave(store)
+		}
+
+		if time.Now().After(deadline) {
+			log.Error("Timeout waiting for %s refreshed by other replica", tc.name)
+			return nil, ErrTokenLockTimeout
+		}
+		time.Sleep(tokenLockPollInterval)
+	}
+}
+
+// token in store if it's valid and not the stale one
+func (tc *tokenCache) loadRefreshed(store TokenStore, stale string) *Token {
+
+	token, err := store.Load(tc.key)
+	if err != nil {
+		if err != ErrTokenNotFound {
+			log.Warning("Failed to load %s from store: %s", tc.name, err)
+		}
+		return nil
+	}
+	if !token.Valid() || token.Value == stale {
+		return nil
+	}
+
+	log.Info("Loaded %s refreshed by other replica, expires at %s", tc.name, token.ExpiresAt)
+	return token
+}
+
+// start background refresh
+func (tc *tokenCache) Start() {
+	tc.Lock()
+	defer tc.Unlock()
+
+	if tc.stopCh != nil {
+		return
+	}
+	tc.stopCh = make(chan struct{})
+	go tc.run(tc.stopCh)
+}
+
+// stop background refresh
+func (tc *tokenCache) Stop() {
+	tc.Lock()
+	defer tc.Unlock()
+
+	if tc.stopCh != nil {
+		close(tc.stopCh)
+		tc.stopCh = nil
+	}
+}
+
+// channel closed when token is refreshed next time
+func (tc *tokenCache) refreshed() <-chan struct{} {
+	tc.Lock()
+	defer tc.Unlock()
+
+	return tc.refreshedCh
+}
+
+func (tc *tokenCache) run(stopCh chan struct{}) {
+
+	retryWait := tc.retryInterval
+	for {
+		token := tc.current()
+
+		var wait time.Duration
+		if token != nil {
+			wait = token.ExpiresAt.Sub(time.Now()) - tc.margin
+			if wait < tc.minInterval {
+				wait = tc.minInterval
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-stopCh:
+			return
+		}
+
+		refreshed := tc.refreshed()
+		_, err := tc.Refresh(nil)
+		if err == nil {
+			retryWait = tc.retryInterval
+			continue
+		}
+
+		// every fetch counts against daily quota, don't retry in vain, but
+		// resume once the token is refreshed on demand after it's fixed
+		if err == ErrAppNotConfigured || IsWXError(err, tokenFatalErrCodes...) {
+			log.Error("Stopped background refresh of %s until configuration is fixed: %s", tc.name, err)
+			retryWait = tc.retryInterval
+			select {
+			case <-refreshed:
+				continue
+			case <-stopCh:
+				return
+			}
+		}
+
+		select {
+		case <-time.After(retryWait):
+		case <-stopCh:
+			return
+		}
+		retryWait *= 2
+		if retryWait > tc.maxRetryInterval {
+			retryWait = tc.maxRetryInterval
+		}
+	}
+}
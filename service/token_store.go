@@ -0,0 +1,201 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTokenNotFound        = errors.New("Token not found")
+	ErrTokenFileLockTimeout = errors.New("Timeout waiting for token file saved by other replica")
+)
+
+const (
+	// lock of token file shared by replicas, held while it's saved
+	tokenFileLockKey = "token_file"
+	tokenFileLockTTL = 10 * time.Second
+	// how often to try the lock while other replica is saving
+	tokenFileLockRetry = 10 * time.Millisecond
+)
+
+// storage of tokens like access_token and jsapi_ticket, so that a still
+// valid token can be reused after restart instead of fetching a new one
+type TokenStore interface {
+	Load(key string) (*Token, error)
+	Save(key string, token *Token) error
+}
+
+// TokenStore in memory, tokens are lost when process exits
+type MemoryTokenStore struct {
+	sync.Mutex
+	tokens map[string]Token
+}
+
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{
+		tokens: make(map[string]Token),
+	}
+}
+
+func (ms *MemoryTokenStore) Load(key string) (*Token, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	token, ok := ms.tokens[key]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	return &token, nil
+}
+
+func (ms *MemoryTokenStore) Save(key string, token *Token) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	ms.tokens[key] = *token
+	return nil
+}
+
+// TokenStore persisted in a JSON file readable only by owner, the file is
+// replaced atomically on every save, and read again on every load so that
+// replicas on the same host can share it, with a Locker set to serialize
+// their saves
+type FileTokenStore struct {
+	sync.Mutex
+	file   *jsonFile
+	locker Locker
+}
+
+func NewFileTokenStore(path string) (*FileTokenStore, error) {
+
+	fs := &FileTokenStore{
+		file: newJSONFile("token", path),
+	}
+
+	// make sure the file is readable
+	if _, err := fs.read(); err != nil {
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+// lock shared by replicas, so that one's save doesn't overwrite the token
+// just saved by another
+func (fs *FileTokenStore) SetLocker(locker Locker) {
+	fs.locker = locker
+}
+
+func (fs *FileTokenStore) read() (map[string]Token, error) {
+
+	tokens := make(map[string]Token)
+	if err := fs.file.Load(&tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (fs *FileTokenStore) Load(key string) (*Token, error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	tokens, err := fs.read()
+	if err != nil {
+		return nil, err
+	}
+	token, ok := tokens[key]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	return &token, nil
+}
+
+func (fs *FileTokenStore) Save(key string, token *Token) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if fs.locker != nil {
+		unlock, err := fs.lockFile()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	tokens, err := fs.read()
+	if err != nil {
+		return err
+	}
+	tokens[key] = *token
+	return fs.file.Save(tokens)
+}
+
+// wait for the lock of token file held by other replica
+func (fs *FileTokenStore) lockFile() (unlock func(), err error) {
+
+	deadline := time.Now().Add(tokenFileLockTTL)
+	for {
+		unlock, ok, err := fs.locker.TryLock(tokenFileLockKey, tokenFileLockTTL)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return unlock, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrTokenFileLockTimeout
+		}
+		time.Sleep(tokenFileLockRetry)
+	}
+}
+
+// TokenStore in Redis, shared by replicas on different hosts, tokens expire
+// in Redis along with themselves
+type RedisTokenStore struct {
+	client *redisClient
+	prefix string
+}
+
+func NewRedisTokenStore(option *RedisOption) *RedisTokenStore {
+	return &RedisTokenStore{
+		client: newRedisClient(option),
+		prefix: option.Prefix,
+	}
+}
+
+func (rs *RedisTokenStore) Load(key string) (*Token, error) {
+
+	reply, err := rs.client.Do("GET", rs.prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+
+	token := &Token{}
+	if err = json.Unmarshal([]byte(data), token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (rs *RedisTokenStore) Save(key string, token *Token) error {
+
+	ttl := token.ExpiresAt.Sub(time.Now()) / time.Millisecond
+	if ttl <= 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	_, err = rs.client.Do("SET", rs.prefix+key, string(data), "PX", strconv.FormatInt(int64(ttl), 10))
+	return err
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFileTokenStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "wxtest")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.json")
+
+	var fetchCnt int32
+	s, stop := startTokenServer(&fetchCnt, 0, 7200)
+	defer stop()
+
+	{
+		store, err := NewFileTokenStore(path)
+		if !assert.Nil(t, err) {
+			return
+		}
+		s.SetTokenStore(store)
+		token, err := s.AccessTokenManager().AccessToken(nil)
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, "TOKEN1", token) {
+			return
+		}
+
+		fi, err := os.Stat(path)
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, os.FileMode(0600), fi.Mode().Perm()) {
+			return
+		}
+	}
+
+	{
+		// "restart" reuses the saved token
+		store, err := NewFileTokenStore(path)
+		if !assert.Nil(t, err) {
+			return
+		}
+		m := NewAccessTokenManager("wx123", "secret", s.client, s.apiBase, 0)
+		m.SetStore(store)
+		token, err := m.AccessToken(nil)
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, "TOKEN1", token) {
+			return
+		}
+		if !assert.Equal(t, int32(1), atomic.LoadInt32(&fetchCnt)) {
+			return
+		}
+
+		// invalidated token is not loaded again
+		m.Invalidate("TOKEN1")
+		token, err = m.AccessToken(nil)
+		if !assert.Equal(t, "TOKEN2", token) {
+			return
+		}
+	}
+
+	{
+		// expired token is not reused
+		store, err := NewFileTokenStore(path)
+		if !assert.Nil(t, err) {
+			return
+		}
+		store.Save("access_token:wx123", &Token{Value: "EXPIRED", ExpiresAt: time.Now()})
+		m := NewAccessTokenManager("wx123", "secret", s.client, s.apiBase, 0)
+		m.SetStore(store)
+		token, err := m.AccessToken(nil)
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, "TOKEN3", token) {
+			return
+		}
+	}
+}
+
+func TestFileTokenStoreReplicas(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "wxtest")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.json")
+	locker, err := NewFileLocker(filepath.Join(dir, "locks"))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// replicas save tokens of their own keys at the same time, none is lost
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		store, err := NewFileTokenStore(path)
+		if !assert.Nil(t, err) {
+			return
+		}
+		store.SetLocker(locker)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				store.Save(fmt.Sprintf("key%d-%d", i, j), &Token{Value: "TOKEN", ExpiresAt: time.Now().Add(time.Hour)})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	store, err := NewFileTokenStore(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 20; j++ {
+			if _, err := store.Load(fmt.Sprintf("key%d-%d", i, j)); !assert.Nil(t, err) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	ErrUserTokenNotFound = errors.New("User token not found")
+)
+
+// storage of users' OAuth tokens, keyed by OpenID
+type UserTokenStore interface {
+	Get(openID string) (*OAuthToken, error)
+	Put(token *OAuthToken) error
+}
+
+// UserTokenStore in memory, tokens are lost when process exits
+type MemoryUserTokenStore struct {
+	sync.Mutex
+	tokens map[string]OAuthToken
+}
+
+func NewMemoryUserTokenStore() *MemoryUserTokenStore {
+	return &MemoryUserTokenStore{
+		tokens: make(map[string]OAuthToken),
+	}
+}
+
+func (ms *MemoryUserTokenStore) Get(openID string) (*OAuthToken, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	token, ok := ms.tokens[openID]
+	if !ok {
+		return nil, ErrUserTokenNotFound
+	}
+	return &token, nil
+}
+
+func (ms *MemoryUserTokenStore) Put(token *OAuthToken) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	ms.tokens[token.OpenID] = *token
+	return nil
+}
+
+// UserTokenStore persisted in a JSON file, the whole file is rewritten on
+// every change, which is fine for moderate number of users
+type FileUserTokenStore struct {
+	MemoryUserTokenStore
+	file *jsonFile
+}
+
+func NewFileUserTokenStore(path string) (*FileUserTokenStore, error) {
+
+	fs := &FileUserTokenStore{
+		MemoryUserTokenStore: *NewMemoryUserTokenStore(),
+		file:                 newJSONFile("user token", path),
+	}
+
+	if err := fs.file.Load(&fs.tokens); err != nil {
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+func (fs *FileUserTokenStore) Put(token *OAuthToken) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	fs.tokens[token.OpenID] = *token
+	return fs.file.Save(fs.tokens)
+}
@@ -0,0 +1,711 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hyt-hz/wxOpenID/httpclient"
+	"github.com/hyt-hz/wxOpenID/log"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrDeliveryNotFound     = errors.New("Webhook delivery not found")
+	ErrWebhookNotConfigured = errors.New("Webhook not configured any more")
+)
+
+const (
+	DefaultWebhookMaxAttempts = 10
+	// headers of webhook request, signature is HMAC-SHA256 of the body with
+	// secret of the webhook, in hex
+	WebhookSignatureHeader = "X-WX-Signature"
+	WebhookDeliveryHeader  = "X-WX-Delivery"
+)
+
+const (
+	webhookInitialBackoff = 10 * time.Second
+	webhookMaxBackoff     = time.Hour
+	webhookTimeout        = 10 * time.Second
+	// longest wait of the worker, in case it misses a wakeup
+	webhookPollInterval = time.Minute
+	// oldest dead letters are dropped beyond this
+	maxDeadLetters = 1000
+)
+
+// downstream webhook receiving messages and events in JSON
+type WebhookOption struct {
+	URL    string `yaml:"url"`
+	Secret string `yaml:"secret"`
+	// MsgType of messages and Event of events to forward, all if empty
+	Events []string `yaml:"events"`
+}
+
+func (o WebhookOption) String() string {
+	type option WebhookOption
+	c := option(o)
+	c.Secret = RedactSecret(c.Secret)
+	return fmt.Sprintf("%+v", c)
+}
+
+// body of webhook request
+type WebhookEvent struct {
+	MsgType    string `json:"msg_type"`
+	Event      string `json:"event,omitempty"`
+	OpenID     string `json:"openid"`
+	CreateTime int64  `json:"create_time"`
+	// the parsed message, fields are named as in WeChat XML, with the raw XML
+	// in Raw if its type is unknown
+	Message Message `json:"message"`
+}
+
+// a message to be delivered to a webhook
+type WebhookDelivery struct {
+	ID          string          `json:"id"`
+	URL         string          `json:"url"`
+	Body        json.RawMessage `json:"body"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	BuriedAt    time.Time       `json:"buried_at,omitempty"`
+}
+
+// storage of webhook deliveries, pending ones and those failed too many
+// times (dead letters)
+type WebhookQueue interface {
+	// add delivery, or update it after a failed attempt
+	Put(d *WebhookDelivery) error
+	Remove(id string) error
+	Pending() ([]*WebhookDelivery, error)
+	// pending delivery to url with the earliest next attempt, nil if none
+	Next(url string) (*WebhookDelivery, error)
+	// move delivery to dead letters
+	Bury(d *WebhookDelivery) error
+	DeadLetters() ([]*WebhookDelivery, error)
+	// move dead letter back to pending
+	Revive(id string) (*WebhookDelivery, error)
+}
+
+// WebhookQueue in memory, deliveries are lost when process exits
+type MemoryWebhookQueue struct {
+	sync.Mutex
+	pending map[string]WebhookDelivery
+	// IDs of pending deliveries to each URL, in order of next attempt
+	byURL map[string][]string
+	// in order of burial
+	dead []WebhookDelivery
+}
+
+func NewMemoryWebhookQueue() *MemoryWebhookQueue {
+	return &MemoryWebhookQueue{
+		pending: make(map[string]WebhookDelivery),
+		byURL:   make(map[string][]string),
+	}
+}
+
+// position of d in IDs of pending deliveries to its URL, or where it's
+// inserted, ordered by next attempt then ID
+func (mq *MemoryWebhookQueue) search(d *WebhookDelivery) int {
+	ids := mq.byURL[d.URL]
+	return sort.Search(len(ids), func(i int) bool {
+		other := mq.pending[ids[i]]
+		if !other.NextAttempt.Equal(d.NextAttempt) {
+			return other.NextAttempt.After(d.NextAttempt)
+		}
+		return other.ID >= d.ID
+	})
+}
+
+// add or replace pending delivery, with mq locked
+func (mq *MemoryWebhookQueue) put(d WebhookDelivery) {
+	mq.remove(d.ID)
+	ids := mq.byURL[d.URL]
+	i := mq.search(&d)
+	ids = append(ids, "")
+	copy(ids[i+1:], ids[i:])
+	ids[i] = d.ID
+	mq.byURL[d.URL] = ids
+	mq.pending[d.ID] = d
+}
+
+// remove pending delivery, with mq locked
+func (mq *MemoryWebhookQueue) remove(id string) {
+	d, ok := mq.pending[id]
+	if !ok {
+		return
+	}
+	ids := mq.byURL[d.URL]
+	if i := mq.search(&d); i < len(ids) && ids[i] == id {
+		ids = append(ids[:i], ids[i+1:]...)
+	}
+	if len(ids) == 0 {
+		delete(mq.byURL, d.URL)
+	} else {
+		mq.byURL[d.URL] = ids
+	}
+	delete(mq.pending, id)
+}
+
+func (mq *MemoryWebhookQueue) Put(d *WebhookDelivery) error {
+	mq.Lock()
+	defer mq.Unlock()
+
+	mq.put(*d)
+	return nil
+}
+
+func (mq *MemoryWebhookQueue) Remove(id string) error {
+	mq.Lock()
+	defer mq.Unlock()
+
+	mq.remove(id)
+	return nil
+}
+
+// pending deliveries in order of next attempt
+func (mq *MemoryWebhookQueue) Pending() ([]*WebhookDelivery, error) {
+	mq.Lock()
+	defer mq.Unlock()
+
+	deliveries := make([]*WebhookDelivery, 0, len(mq.pending))
+	for _, d := range mq.pending {
+		d := d
+		deliveries = append(deliveries, &d)
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].NextAttempt.Before(deliveries[j].NextAttempt)
+	})
+	return deliveries, nil
+}
+
+func (mq *MemoryWebhookQueue) Next(url string) (*WebhookDelivery, error) {
+	mq.Lock()
+	defer mq.Unlock()
+
+	ids := mq.byURL[url]
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	d := mq.pending[ids[0]]
+	return &d, nil
+}
+
+func (mq *MemoryWebhookQueue) Bury(d *WebhookDelivery) error {
+	mq.bury(d)
+	return nil
+}
+
+// bury delivery and return the oldest dead letters dropped
+func (mq *MemoryWebhookQueue) bury(d *WebhookDelivery) (dropped []WebhookDelivery) {
+	mq.Lock()
+	defer mq.Unlock()
+
+	d.BuriedAt = time.Now()
+	mq.remove(d.ID)
+	mq.dead = append(mq.dead, *d)
+	if len(mq.dead) > maxDeadLetters {
+		dropped = append(dropped, mq.dead[:len(mq.dead)-maxDeadLetters]...)
+		mq.dead = mq.dead[len(mq.dead)-maxDeadLetters:]
+	}
+	return dropped
+}
+
+func (mq *MemoryWebhookQueue) DeadLetters() ([]*WebhookDelivery, error) {
+	mq.Lock()
+	defer mq.Unlock()
+
+	deliveries := make([]*WebhookDelivery, len(mq.dead))
+	for i := range mq.dead {
+		d := mq.dead[i]
+		deliveries[i] = &d
+	}
+	return deliveries, nil
+}
+
+func (mq *MemoryWebhookQueue) Revive(id string) (*WebhookDelivery, error) {
+	mq.Lock()
+	defer mq.Unlock()
+
+	for i, d := range mq.dead {
+		if d.ID == id {
+			mq.dead = append(mq.dead[:i], mq.dead[i+1:]...)
+			d.Attempts = 0
+			d.NextAttempt = time.Now()
+			mq.put(d)
+			return &d, nil
+		}
+	}
+	return nil, ErrDeliveryNotFound
+}
+
+// WebhookQueue persisted in a directory, so that deliveries survive restart,
+// every delivery is a JSON file under pending or dead, so that a change of
+// one delivery doesn't rewrite the others. Pending deliveries are written in
+// background, not to hold up the reply to WeChat
+type FileWebhookQueue struct {
+	MemoryWebhookQueue
+	dir string
+
+	// serialize writing of pending deliveries, so that older state never
+	// overwrites newer
+	flushLock sync.Mutex
+	// IDs of pending deliveries changed but not written yet
+	dirtyLock sync.Mutex
+	dirty     map[string]bool
+	scheduled bool
+}
+
+const (
+	webhookPendingDir = "pending"
+	webhookDeadDir    = "dead"
+)
+
+func NewFileWebhookQueue(dir string) (*FileWebhookQueue, error) {
+
+	fq := &FileWebhookQueue{
+		MemoryWebhookQueue: *NewMemoryWebhookQueue(),
+		dir:                dir,
+		dirty:              make(map[string]bool),
+	}
+
+	pending, err := fq.load(webhookPendingDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range pending {
+		fq.put(d)
+	}
+
+	if fq.dead, err = fq.load(webhookDeadDir); err != nil {
+		return nil, err
+	}
+	sort.Slice(fq.dead, func(i, j int) bool {
+		return fq.dead[i].BuriedAt.Before(fq.dead[j].BuriedAt)
+	})
+
+	return fq, nil
+}
+
+// deliveries in subdirectory, which is created if not exists
+func (fq *FileWebhookQueue) load(sub string) ([]WebhookDelivery, error) {
+
+	if err := os.MkdirAll(filepath.Join(fq.dir, sub), 0700); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(filepath.Join(fq.dir, sub))
+	if err != nil {
+		return nil, err
+	}
+
+	var deliveries []WebhookDelivery
+	for _, fi := range files {
+		// temp files of unfinished writes are ignored
+		if fi.IsDir() || filepath.Ext(fi.Name()) != ".json" {
+			continue
+		}
+		path := filepath.Join(fq.dir, sub, fi.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Error("Failed to read webhook delivery file %s: %s", path, err)
+			return nil, err
+		}
+		d := WebhookDelivery{}
+		if err = json.Unmarshal(data, &d); err != nil {
+			log.Error("Failed to parse webhook delivery file %s: %s", path, err)
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+func (fq *FileWebhookQueue) path(sub, id string) string {
+	return filepath.Join(fq.dir, sub, id+".json")
+}
+
+func (fq *FileWebhookQueue) write(sub string, d *WebhookDelivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fq.path(sub, d.ID), data, 0600)
+}
+
+func (fq *FileWebhookQueue) remove(sub, id string) error {
+	if err := os.Remove(fq.path(sub, id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// write the file of pending delivery in background
+func (fq *FileWebhookQueue) writeLater(id string) {
+	fq.dirtyLock.Lock()
+	defer fq.dirtyLock.Unlock()
+
+	fq.dirty[id] = true
+	if !fq.scheduled {
+		fq.scheduled = true
+		go fq.Flush()
+	}
+}
+
+// write files of pending deliveries changed, or remove them if they are not
+// pending any more
+func (fq *FileWebhookQueue) Flush() error {
+	fq.flushLock.Lock()
+	defer fq.flushLock.Unlock()
+
+	fq.dirtyLock.Lock()
+	dirty := fq.dirty
+	fq.dirty = make(map[string]bool)
+	fq.scheduled = false
+	fq.dirtyLock.Unlock()
+
+	var lastErr error
+	for id := range dirty {
+		fq.Lock()
+		d, ok := fq.pending[id]
+		fq.Unlock()
+
+		var err error
+		if ok {
+			err = fq.write(webhookPendingDir, &d)
+		} else {
+			err = fq.remove(webhookPendingDir, id)
+		}
+		if err != nil {
+			log.Error("Failed to save webhook delivery %s: %s", id, err)
+			// retried by next change or flush
+			fq.dirtyLock.Lock()
+			fq.dirty[id] = true
+			fq.dirtyLock.Unlock()
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (fq *FileWebhookQueue) Put(d *WebhookDelivery) error {
+	fq.MemoryWebhookQueue.Put(d)
+	fq.writeLater(d.ID)
+	return nil
+}
+
+func (fq *FileWebhookQueue) Remove(id string) error {
+	fq.MemoryWebhookQueue.Remove(id)
+	fq.writeLater(id)
+	return nil
+}
+
+func (fq *FileWebhookQueue) Bury(d *WebhookDelivery) error {
+
+	dropped := fq.bury(d)
+	fq.writeLater(d.ID)
+	if err := fq.write(webhookDeadDir, d); err != nil {
+		return err
+	}
+	for _, old := range dropped {
+		if err := fq.remove(webhookDeadDir, old.ID); err != nil {
+			log.Warning("Failed to remove dropped dead letter %s: %s", old.ID, err)
+		}
+	}
+	return nil
+}
+
+func (fq *FileWebhookQueue) Revive(id string) (*WebhookDelivery, error) {
+
+	d, err := fq.MemoryWebhookQueue.Revive(id)
+	if err != nil {
+		return nil, err
+	}
+	fq.writeLater(d.ID)
+	return d, fq.remove(webhookDeadDir, d.ID)
+}
+
+// forwarder of messages to webhooks, deliveries are queued and sent in
+// background by a worker of each webhook, so a slow webhook doesn't hold up
+// the others, failed ones are retried with exponential backoff, and become
+// dead letters after maxAttempts
+type WebhookForwarder struct {
+	hooks       []WebhookOption
+	client      *myhttp.Client
+	queue       WebhookQueue
+	maxAttempts int
+	// backoff after the first failure, doubled after each failure
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	// wakeup of the worker of each webhook, by URL
+	wakeChs map[string]chan struct{}
+	stopCh  chan struct{}
+	workers sync.WaitGroup
+}
+
+func NewWebhookForwarder(hooks []WebhookOption, maxAttempts int) *WebhookForwarder {
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultWebhookMaxAttempts
+	}
+	wakeChs := make(map[string]chan struct{})
+	for _, hook := range hooks {
+		wakeChs[hook.URL] = make(chan struct{}, 1)
+	}
+	return &WebhookForwarder{
+		hooks: hooks,
+		// we retry by ourselves
+		client:      myhttp.NewClient(myhttp.DefaultMaxIdleConnsPerHost, webhookTimeout, 0, 0),
+		queue:       NewMemoryWebhookQueue(),
+		maxAttempts: maxAttempts,
+		backoff:     webhookInitialBackoff,
+		maxBackoff:  webhookMaxBackoff,
+		wakeChs:     wakeChs,
+	}
+}
+
+func (f *WebhookForwarder) SetQueue(queue WebhookQueue) {
+	f.queue = queue
+}
+
+// queue msg to the webhooks subscribed to it
+func (f *WebhookForwarder) Forward(msg Message) error {
+
+	header := msg.Header()
+	event := &WebhookEvent{
+		MsgType:    header.MsgType,
+		Event:      EventOf(msg),
+		OpenID:     header.FromUserName,
+		CreateTime: header.CreateTime,
+		Message:    msg,
+	}
+
+	var body []byte
+	var queued []string
+	now := time.Now()
+	for _, hook := range f.hooks {
+		if !hook.subscribes(event) {
+			continue
+		}
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(event); err != nil {
+				return err
+			}
+		}
+		d := &WebhookDelivery{
+			ID:          randomHex(16),
+			URL:         hook.URL,
+			Body:        body,
+			NextAttempt: now,
+			CreatedAt:   now,
+		}
+		if err := f.queue.Put(d); err != nil {
+			return err
+		}
+		queued = append(queued, hook.URL)
+	}
+
+	for _, url := range queued {
+		f.wake(url)
+	}
+	return nil
+}
+
+func (hook *WebhookOption) subscribes(event *WebhookEvent) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, e := range hook.Events {
+		if e == event.MsgType || (event.Event != "" && e == event.Event) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *WebhookForwarder) DeadLetters() ([]*WebhookDelivery, error) {
+	return f.queue.DeadLetters()
+}
+
+// queue dead letter again, with attempts reset
+func (f *WebhookForwarder) Retry(id string) (*WebhookDelivery, error) {
+	d, err := f.queue.Revive(id)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := f.wakeChs[d.URL]; !ok {
+		// no worker to deliver it, bury it again
+		f.attempt(d)
+		return nil, ErrWebhookNotConfigured
+	}
+	f.wake(d.URL)
+	return d, nil
+}
+
+func (f *WebhookForwarder) wake(url string) {
+	select {
+	case f.wakeChs[url] <- struct{}{}:
+	default:
+	}
+}
+
+// start to deliver in background
+func (f *WebhookForwarder) Start() {
+	if f.stopCh != nil {
+		return
+	}
+
+	// deliveries to webhooks removed from configuration have no worker
+	if pending, err := f.queue.Pending(); err == nil {
+		for _, d := range pending {
+			if _, ok := f.wakeChs[d.URL]; !ok {
+				f.attempt(d)
+			}
+		}
+	}
+
+	f.stopCh = make(chan struct{})
+	for url, wakeCh := range f.wakeChs {
+		f.workers.Add(1)
+		go f.run(url, wakeCh)
+	}
+}
+
+// stop delivering, and wait for the ongoing deliveries
+func (f *WebhookForwarder) Stop() {
+	if f.stopCh == nil {
+		return
+	}
+	close(f.stopCh)
+	f.workers.Wait()
+	f.stopCh = nil
+
+	// write what the queue is saving in background
+	if q, ok := f.queue.(flusher); ok {
+		q.Flush()
+	}
+}
+
+func (f *WebhookForwarder) run(url string, wakeCh chan struct{}) {
+	defer f.workers.Done()
+
+	for {
+		wait := f.deliverDue(url)
+		select {
+		case <-wakeCh:
+		case <-time.After(wait):
+		case <-f.stopCh:
+			return
+		}
+	}
+}
+
+// deliver pending deliveries to url which are due, and return how long to
+// wait for the next one
+func (f *WebhookForwarder) deliverDue(url string) time.Duration {
+
+	for {
+		d, err := f.queue.Next(url)
+		if err != nil {
+			log.Error("Failed to load pending webhook deliveries to %s: %s", url, err)
+			return webhookPollInterval
+		}
+		if d == nil {
+			return webhookPollInterval
+		}
+		if wait := d.NextAttempt.Sub(time.Now()); wait > 0 {
+			if wait > webhookPollInterval {
+				wait = webhookPollInterval
+			}
+			return wait
+		}
+		select {
+		case <-f.stopCh:
+			return 0
+		default:
+		}
+		// removed, buried or put back with the next attempt later
+		f.attempt(d)
+	}
+}
+
+func (f *WebhookForwarder) attempt(d *WebhookDelivery) {
+
+	err := f.deliver(d)
+	if err == nil {
+		if err := f.queue.Remove(d.ID); err != nil {
+			log.Error("Failed to remove webhook delivery %s: %s", d.ID, err)
+		}
+		return
+	}
+
+	d.Attempts++
+	d.LastError = err.Error()
+	if d.Attempts >= f.maxAttempts || err == ErrWebhookNotConfigured {
+		log.Error("Webhook delivery %s to %s failed %d times, give up: %s", d.ID, d.URL, d.Attempts, err)
+		err = f.queue.Bury(d)
+	} else {
+		backoff := f.backoff << uint(d.Attempts-1)
+		if backoff > f.maxBackoff || backoff <= 0 {
+			backoff = f.maxBackoff
+		}
+		d.NextAttempt = time.Now().Add(backoff)
+		log.Warning("Webhook delivery %s to %s failed, retry in %s: %s", d.ID, d.URL, backoff, err)
+		err = f.queue.Put(d)
+	}
+	if err != nil {
+		log.Error("Failed to update webhook delivery %s: %s", d.ID, err)
+	}
+}
+
+func (f *WebhookForwarder) deliver(d *WebhookDelivery) error {
+
+	var secret string
+	found := false
+	for _, hook := range f.hooks {
+		if hook.URL == d.URL {
+			secret, found = hook.Secret, true
+			break
+		}
+	}
+	if !found {
+		return ErrWebhookNotConfigured
+	}
+
+	req, err := http.NewRequest("POST", d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set(WebhookDeliveryHeader, d.ID)
+	req.Header.Set(WebhookSignatureHeader, WebhookSignature(secret, d.Body))
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	// response other than 200 OK is returned as error
+	response, err := f.client.DoRequest(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+	return nil
+}
+
+// HMAC-SHA256 of webhook request body in hex, for receivers to verify
+func WebhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,254 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/hyt-hz/wxOpenID/httpclient"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookForwarder(t *testing.T) {
+
+	var cnt int32
+	received := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fail twice before success
+		if atomic.AddInt32(&cnt, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer ts.Close()
+
+	f := NewWebhookForwarder([]WebhookOption{
+		{URL: ts.URL, Secret: "secret", Events: []string{EventSubscribe}},
+		{URL: ts.URL + "/text", Secret: "secret", Events: []string{MsgTypeText}},
+	}, 0)
+	f.backoff = 10 * time.Millisecond
+	f.Start()
+	defer f.Stop()
+
+	if !assert.Nil(t, f.Forward(newEvent(EventSubscribe, "qrscene_1"))) {
+		return
+	}
+
+	select {
+	case r := <-received:
+		body := <-bodies
+		if !assert.Equal(t, "/", r.URL.Path) {
+			return
+		}
+		if !assert.Equal(t, WebhookSignature("secret", body), r.Header.Get(WebhookSignatureHeader)) {
+			return
+		}
+		event := struct {
+			MsgType string                 `json:"msg_type"`
+			Event   string                 `json:"event"`
+			OpenID  string                 `json:"openid"`
+			Message map[string]interface{} `json:"message"`
+		}{}
+		if !assert.Nil(t, json.Unmarshal(body, &event)) {
+			return
+		}
+		if !assert.Equal(t, EventSubscribe, event.Event) || !assert.Equal(t, "OPENID", event.OpenID) {
+			return
+		}
+		if !assert.Equal(t, "qrscene_1", event.Message["EventKey"]) {
+			return
+		}
+	case <-time.After(time.Second):
+		t.Error("Webhook not delivered")
+		return
+	}
+
+	// delivered after 2 retries, and nothing more
+	time.Sleep(50 * time.Millisecond)
+	if !assert.Equal(t, int32(3), atomic.LoadInt32(&cnt)) {
+		return
+	}
+	pending, _ := f.queue.Pending()
+	if !assert.Equal(t, 0, len(pending)) {
+		return
+	}
+}
+
+func TestWebhookDeadLetters(t *testing.T) {
+
+	var fail int32 = 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	f := NewWebhookForwarder([]WebhookOption{{URL: ts.URL}}, 3)
+	f.backoff = 10 * time.Millisecond
+	f.Start()
+	defer f.Stop()
+
+	if !assert.Nil(t, f.Forward(newTextMessage("hi"))) {
+		return
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	dead, err := f.DeadLetters()
+	if !assert.Nil(t, err) || !assert.Equal(t, 1, len(dead)) {
+		return
+	}
+	if !assert.Equal(t, 3, dead[0].Attempts) || !assert.Equal(t, myhttp.ErrHTTPStatusCode.Error(), dead[0].LastError) {
+		return
+	}
+
+	// retry after webhook is fixed
+	atomic.StoreInt32(&fail, 0)
+	if _, err := f.Retry(dead[0].ID); !assert.Nil(t, err) {
+		return
+	}
+	time.Sleep(50 * time.Millisecond)
+	dead, _ = f.DeadLetters()
+	pending, _ := f.queue.Pending()
+	if !assert.Equal(t, 0, len(dead)) || !assert.Equal(t, 0, len(pending)) {
+		return
+	}
+
+	if _, err := f.Retry("unknown"); !assert.Equal(t, ErrDeliveryNotFound, err) {
+		return
+	}
+
+	{
+		// webhook removed from configuration
+		f.queue.Bury(&WebhookDelivery{ID: "removed", URL: "http://removed"})
+		if _, err := f.Retry("removed"); !assert.Equal(t, ErrWebhookNotConfigured, err) {
+			return
+		}
+		dead, _ = f.DeadLetters()
+		if !assert.Equal(t, 1, len(dead)) || !assert.Equal(t, "removed", dead[0].ID) {
+			return
+		}
+	}
+}
+
+func TestWebhookDeliveredIndependently(t *testing.T) {
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer slow.Close()
+	received := make(chan struct{}, 10)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	}))
+	defer fast.Close()
+
+	f := NewWebhookForwarder([]WebhookOption{{URL: slow.URL}, {URL: fast.URL}}, 0)
+	f.Start()
+	defer f.Stop()
+
+	for i := 0; i < 3; i++ {
+		if !assert.Nil(t, f.Forward(newTextMessage("hi"))) {
+			return
+		}
+	}
+
+	// the slow webhook takes 1.5 seconds for all
+	timeout := time.After(300 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-received:
+		case <-timeout:
+			t.Error("Webhook held up by the slow one")
+			return
+		}
+	}
+}
+
+func TestFileWebhookQueue(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "wxtest")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	fq, err := NewFileWebhookQueue(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	now := time.Now()
+	fq.Put(&WebhookDelivery{ID: "1", URL: "http://a", Body: json.RawMessage(`{"a":1}`), NextAttempt: now.Add(time.Second)})
+	fq.Put(&WebhookDelivery{ID: "2", URL: "http://a", Body: json.RawMessage(`{"a":2}`), NextAttempt: now})
+	fq.Put(&WebhookDelivery{ID: "3", URL: "http://a", Body: json.RawMessage(`{"a":3}`), NextAttempt: now})
+	fq.Bury(&WebhookDelivery{ID: "3", URL: "http://a", Body: json.RawMessage(`{"a":3}`), Attempts: 10})
+	fq.Bury(&WebhookDelivery{ID: "4", URL: "http://a", Body: json.RawMessage(`{"a":4}`), Attempts: 10})
+	// pending deliveries are written in background
+	if !assert.Nil(t, fq.Flush()) {
+		return
+	}
+
+	// a file for each delivery
+	info, err := os.Stat(filepath.Join(dir, "pending", "2.json"))
+	if !assert.Nil(t, err) || !assert.Equal(t, os.FileMode(0600), info.Mode().Perm()) {
+		return
+	}
+	if _, err := os.Stat(filepath.Join(dir, "pending", "3.json")); !assert.True(t, os.IsNotExist(err)) {
+		return
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dead", "3.json")); !assert.Nil(t, err) {
+		return
+	}
+
+	fq, err = NewFileWebhookQueue(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	pending, _ := fq.Pending()
+	if !assert.Equal(t, 2, len(pending)) || !assert.Equal(t, "2", pending[0].ID) {
+		return
+	}
+	if !assert.Equal(t, `{"a":2}`, string(pending[0].Body)) {
+		return
+	}
+	// the next delivery to each webhook is indexed
+	if next, _ := fq.Next("http://a"); !assert.NotNil(t, next) || !assert.Equal(t, "2", next.ID) {
+		return
+	}
+	fq.Put(&WebhookDelivery{ID: "2", URL: "http://a", Body: json.RawMessage(`{"a":2}`), NextAttempt: now.Add(2 * time.Second)})
+	if next, _ := fq.Next("http://a"); !assert.Equal(t, "1", next.ID) {
+		return
+	}
+	if next, _ := fq.Next("http://b"); !assert.Nil(t, next) {
+		return
+	}
+	dead, _ := fq.DeadLetters()
+	if !assert.Equal(t, 2, len(dead)) || !assert.Equal(t, "3", dead[0].ID) || !assert.Equal(t, "4", dead[1].ID) {
+		return
+	}
+
+	{
+		// revived dead letter is pending again
+		if _, err := fq.Revive("3"); !assert.Nil(t, err) || !assert.Nil(t, fq.Flush()) {
+			return
+		}
+		fq, err = NewFileWebhookQueue(dir)
+		if !assert.Nil(t, err) {
+			return
+		}
+		pending, _ := fq.Pending()
+		dead, _ := fq.DeadLetters()
+		if !assert.Equal(t, 3, len(pending)) || !assert.Equal(t, 1, len(dead)) {
+			return
+		}
+	}
+}
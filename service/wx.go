@@ -1,15 +1,313 @@
 package service
 
-import "golang.org/x/net/context"
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/hyt-hz/wxOpenID/httpclient"
+	"github.com/hyt-hz/wxOpenID/log"
+	"github.com/hyt-hz/wxOpenID/wxcrypt"
+	"golang.org/x/net/context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTokenNotConfigured = errors.New("WeChat token not configured")
+	ErrInvalidSignature   = errors.New("Invalid WeChat signature")
+)
+
+// options of WXService, loaded from the "wx" section of wx.yaml
+type Option struct {
+	// token configured in the WeChat MP console for server validation
+	Token string `yaml:"token"`
+	// EncodingAESKey configured in MP console for safe mode
+	EncodingAESKey string `yaml:"encoding_aes_key"`
+	// AppID and AppSecret of the Official Account
+	AppID     string `yaml:"app_id"`
+	AppSecret string `yaml:"app_secret"`
+	// access_token and jsapi_ticket are refreshed in background this long before they expire
+	AccessTokenRefreshMargin time.Duration `yaml:"access_token_refresh_margin"`
+	// file to persist access_token etc. across restart, kept in memory only if empty
+	TokenFile string `yaml:"token_file"`
+	// for multiple replicas, either share token_file and lock its refresh and
+	// saves with files in lock_dir on the same host, or share tokens and lock
+	// in Redis
+	LockDir string      `yaml:"lock_dir"`
+	Redis   RedisOption `yaml:"redis"`
+	// URL of our OAuth callback, WeChat redirects user here after web authorization
+	OAuthRedirectURI string `yaml:"oauth_redirect_uri"`
+	// secret to sign OpenID ticket handed to return URL after web
+	// authorization, and how long the state and the ticket are valid
+	OAuthStateSecret string        `yaml:"oauth_state_secret"`
+	OAuthStateTTL    time.Duration `yaml:"oauth_state_ttl"`
+	// file to persist users' OAuth tokens, kept in memory only if empty
+	UserTokenFile string `yaml:"user_token_file"`
+	// mini-programs, and how long their login sessions are kept
+	MiniPrograms          []MiniProgramOption `yaml:"mini_programs"`
+	MiniProgramSessionTTL time.Duration       `yaml:"mini_program_session_ttl"`
+	// how long to wait for message handlers before responding to WeChat
+	DispatchTimeout time.Duration `yaml:"dispatch_timeout"`
+	// how long and how many received messages are remembered to detect
+	// retries of WeChat
+	DedupTTL      time.Duration `yaml:"dedup_ttl"`
+	DedupCapacity int           `yaml:"dedup_capacity"`
+	// downstream webhooks messages and events are forwarded to, failed
+	// deliveries are retried and persisted in webhook_queue_dir if set
+	Webhooks           []WebhookOption `yaml:"webhooks"`
+	WebhookQueueDir    string          `yaml:"webhook_queue_dir"`
+	WebhookMaxAttempts int             `yaml:"webhook_max_attempts"`
+	// file to persist subscription state of followers, kept in memory only if empty
+	FollowerFile string `yaml:"follower_file"`
+	// followers are synchronized with WeChat this often, never if 0
+	FollowerSyncInterval time.Duration `yaml:"follower_sync_interval"`
+	// file to persist delivery status of template messages, kept in memory only if empty
+	TemplateDeliveryFile string `yaml:"template_delivery_file"`
+	// file to persist mass jobs, kept in memory only if empty, jobs not
+	// finished are resumed at start
+	MassJobFile string `yaml:"mass_job_file"`
+	// wait between batches of a mass job, DefaultMassSendInterval if 0
+	MassSendInterval time.Duration `yaml:"mass_send_interval"`
+	// YAML file of menus, applied on start if changed
+	MenuFile string `yaml:"menu_file"`
+}
+
+// options with secrets redacted, for logging
+func (o Option) String() string {
+	type option Option
+	c := option(o)
+	c.Token = RedactSecret(c.Token)
+	c.EncodingAESKey = RedactSecret(c.EncodingAESKey)
+	c.AppSecret = RedactSecret(c.AppSecret)
+	c.OAuthStateSecret = RedactSecret(c.OAuthStateSecret)
+	return fmt.Sprintf("%+v", c)
+}
+
+// mask secret in logs, an empty one is kept to show it's not configured
+func RedactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "******"
+}
 
 type WXService struct {
+	option     Option
+	client     *myhttp.Client
+	apiBase    string
+	userTokens UserTokenStore
+
+	oauthStates OAuthStateStore
+
+	accessToken *AccessTokenManager
+	jsapiTicket *JSAPITicketManager
+
+	miniPrograms      map[string]MiniProgramOption
+	miniProgramTokens map[string]*AccessTokenManager
+	sessions          SessionStore
+
+	dispatcher *MessageDispatcher
+	crypter    *wxcrypt.Crypter
+	dedup      DedupStore
+	webhooks   *WebhookForwarder
+
+	followers FollowerStore
+	// serialize updates of follower records
+	followerLock sync.Mutex
+	followerSync followerSync
+
+	templateDeliveries TemplateDeliveryStore
+	templateLock       sync.Mutex
+
+	massJobs MassJobStore
+	massLock sync.Mutex
 }
 
-func NewWXService() *WXService {
-	s := WXService{}
-	return &s
+func NewWXService(option *Option) (*WXService, error) {
+	s := WXService{
+		option:     *option,
+		client:     myhttp.DefaultClient(),
+		apiBase:    DefaultAPIBase,
+		userTokens: NewMemoryUserTokenStore(),
+
+		oauthStates: NewMemoryOAuthStateStore(),
+
+		miniPrograms:      make(map[string]MiniProgramOption),
+		miniProgramTokens: make(map[string]*AccessTokenManager),
+		sessions:          NewMemorySessionStore(),
+
+		dispatcher: NewMessageDispatcher(
+			NewMessageRouter().Use(LoggerMessageMiddleware).Use(RecoveryMessageMiddleware),
+			option.DispatchTimeout,
+		),
+		dedup:    NewMemoryDedupStore(option.DedupTTL, option.DedupCapacity),
+		webhooks: NewWebhookForwarder(option.Webhooks, option.WebhookMaxAttempts),
+
+		followers:          NewMemoryFollowerStore(),
+		templateDeliveries: NewMemoryTemplateDeliveryStore(),
+		massJobs:           NewMemoryMassJobStore(),
+	}
+	for _, mp := range option.MiniPrograms {
+		// rather than failing every message sent with a bad template
+		if err := validateSubscribeTemplates(&mp); err != nil {
+			return nil, err
+		}
+		s.miniPrograms[mp.AppID] = mp
+		s.miniProgramTokens[mp.AppID] = NewAccessTokenManager(mp.AppID, mp.AppSecret, s.client, s.apiBase, option.AccessTokenRefreshMargin)
+	}
+	s.accessToken = NewAccessTokenManager(option.AppID, option.AppSecret, s.client, s.apiBase, option.AccessTokenRefreshMargin)
+	s.jsapiTicket = NewJSAPITicketManager(s.accessToken, option.AccessTokenRefreshMargin)
+
+	// records kept up to date with events, before handlers see them
+	s.Router().Use(EventObserverMiddleware(s.trackFollower, EventSubscribe, EventUnsubscribe, EventScan))
+	s.Router().Use(EventObserverMiddleware(s.trackTemplateDelivery, EventTemplateSendJobFinish))
+	s.Router().Use(EventObserverMiddleware(s.trackMassJob, EventMassSendJobFinish))
+	return &s, nil
+}
+
+// start background jobs, e.g. access_token refresh
+func (s *WXService) Start() {
+	if s.option.AppID != "" && s.option.AppSecret != "" {
+		s.accessToken.Start()
+		s.jsapiTicket.Start()
+		s.resumeMassJobs()
+		if s.option.FollowerSyncInterval > 0 {
+			s.startFollowerSyncSchedule(s.option.FollowerSyncInterval)
+		}
+		if s.option.MenuFile != "" {
+			go func() {
+				if _, err := s.ApplyMenuFile(context.Background()); err != nil {
+					log.Error("Failed to apply menu file %s: %s", s.option.MenuFile, err)
+				}
+			}()
+		}
+	}
+	if len(s.option.Webhooks) > 0 {
+		s.webhooks.Start()
+	}
+}
+
+func (s *WXService) Stop() {
+	s.accessToken.Stop()
+	s.jsapiTicket.Stop()
+	s.webhooks.Stop()
+	s.stopFollowerSyncSchedule()
+
+	// write what file stores are saving in background
+	for _, store := range []interface{}{s.followers, s.templateDeliveries, s.massJobs} {
+		if f, ok := store.(flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+// access_token manager of the Official Account
+func (s *WXService) AccessTokenManager() *AccessTokenManager {
+	return s.accessToken
 }
 
-func (s *WXService) ValidateServer(ctx context.Context) {
+func (s *WXService) SetUserTokenStore(store UserTokenStore) {
+	s.userTokens = store
+}
+
+// store of web authorizations in progress, must be shared by replicas
+func (s *WXService) SetOAuthStateStore(store OAuthStateStore) {
+	s.oauthStates = store
+}
+
+// store of access_token and other tokens shared by the Official Account and
+// mini-programs
+func (s *WXService) SetTokenStore(store TokenStore) {
+	s.accessToken.SetStore(store)
+	s.jsapiTicket.SetStore(store)
+	for _, m := range s.miniProgramTokens {
+		m.SetStore(store)
+	}
+}
+
+// forwarder of messages and events to downstream webhooks
+func (s *WXService) Webhooks() *WebhookForwarder {
+	return s.webhooks
+}
+
+// router of messages pushed by WeChat, register message handlers to it
+func (s *WXService) Router() *MessageRouter {
+	return s.dispatcher.Router()
+}
+
+// crypter of messages in safe mode
+func (s *WXService) SetCrypter(crypter *wxcrypt.Crypter) {
+	s.crypter = crypter
+}
+
+// lock shared by replicas to refresh tokens, token store must be shared too
+func (s *WXService) SetLocker(locker Locker) {
+	s.accessToken.SetLocker(locker)
+	s.jsapiTicket.SetLocker(locker)
+	for _, m := range s.miniProgramTokens {
+		m.SetLocker(locker)
+	}
+}
+
+// store of received messages to detect retries, must be shared by replicas
+func (s *WXService) SetDedupStore(store DedupStore) {
+	s.dedup = store
+}
+
+func (s *WXService) SetFollowerStore(store FollowerStore) {
+	s.followers = store
+}
+
+func (s *WXService) SetTemplateDeliveryStore(store TemplateDeliveryStore) {
+	s.templateDeliveries = store
+}
+
+func (s *WXService) SetMassJobStore(store MassJobStore) {
+	s.massJobs = store
+}
+
+func (s *WXService) SetSessionStore(store SessionStore) {
+	s.sessions = store
+}
+
+// verify the signature WeChat attaches to every request sent to our server,
+// which is the SHA1 of token, timestamp and nonce sorted and concatenated
+func (s *WXService) ValidateServer(ctx context.Context, signature, timestamp, nonce string) error {
+
+	if s.option.Token == "" {
+		return ErrTokenNotConfigured
+	}
+
+	expected := Signature(s.option.Token, timestamp, nonce)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(signature))) != 1 {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// SHA1 signature of the given strings, sorted in dictionary order and
+// concatenated, as used across WeChat APIs
+func Signature(strs ...string) string {
+	sorted := make([]string, len(strs))
+	copy(sorted, strs)
+	sort.Strings(sorted)
+
+	h := sha1.New()
+	h.Write([]byte(strings.Join(sorted, "")))
+	return hex.EncodeToString(h.Sum(nil))
+}
 
+// random string of n bytes in hex
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
 }
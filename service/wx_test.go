@@ -0,0 +1,88 @@
+package service
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// start a fake WeChat API server, and a WXService talking to it
+func newTestService(option *Option, handler http.HandlerFunc) (*WXService, *httptest.Server) {
+	ts := httptest.NewServer(handler)
+	s, _ := NewWXService(option)
+	s.apiBase = ts.URL
+	s.accessToken.apiBase = ts.URL
+	for _, m := range s.miniProgramTokens {
+		m.apiBase = ts.URL
+	}
+	return s, ts
+}
+
+func TestSignature(t *testing.T) {
+	// sha1("1320562132" + "1409735669" + "spamtest")
+	sig := "16120ec1b8dbb870f510d87ce6bc2463eae6ca1a"
+	if !assert.Equal(t, sig, Signature("spamtest", "1409735669", "1320562132")) {
+		return
+	}
+	if !assert.Equal(t, sig, Signature("1409735669", "1320562132", "spamtest")) {
+		return
+	}
+}
+
+func TestValidateServer(t *testing.T) {
+
+	{
+		s, _ := NewWXService(&Option{})
+		err := s.ValidateServer(nil, "16120ec1b8dbb870f510d87ce6bc2463eae6ca1a", "1409735669", "1320562132")
+		if !assert.Equal(t, ErrTokenNotConfigured, err) {
+			return
+		}
+	}
+
+	s, _ := NewWXService(&Option{Token: "spamtest"})
+
+	{
+		err := s.ValidateServer(nil, "16120ec1b8dbb870f510d87ce6bc2463eae6ca1a", "1409735669", "1320562132")
+		if !assert.Nil(t, err) {
+			return
+		}
+	}
+
+	{
+		err := s.ValidateServer(nil, "16120EC1B8DBB870F510D87CE6BC2463EAE6CA1A", "1409735669", "1320562132")
+		if !assert.Nil(t, err) {
+			return
+		}
+	}
+
+	{
+		err := s.ValidateServer(nil, "16120ec1b8dbb870f510d87ce6bc2463eae6ca1a", "1409735670", "1320562132")
+		if !assert.Equal(t, ErrInvalidSignature, err) {
+			return
+		}
+	}
+}
+
+func TestOptionString(t *testing.T) {
+
+	option := Option{
+		Token:            "SECRET_TOKEN",
+		EncodingAESKey:   "SECRET_AES_KEY",
+		AppID:            "wx123",
+		AppSecret:        "SECRET_APP",
+		Redis:            RedisOption{Addr: "localhost:6379", Password: "SECRET_REDIS"},
+		OAuthStateSecret: "SECRET_STATE",
+		MiniPrograms:     []MiniProgramOption{{AppID: "wxmini", AppSecret: "SECRET_MINI"}},
+		Webhooks:         []WebhookOption{{URL: "http://crm.example.com/wx", Secret: "SECRET_WEBHOOK"}},
+	}
+
+	for _, s := range []string{fmt.Sprintf("%+v", option), fmt.Sprintf("%v", &option)} {
+		if !assert.NotContains(t, s, "SECRET") || !assert.Contains(t, s, "wx123") ||
+			!assert.Contains(t, s, "wxmini") || !assert.Contains(t, s, "localhost:6379") ||
+			!assert.Contains(t, s, "http://crm.example.com/wx") {
+			return
+		}
+	}
+}
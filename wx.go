@@ -26,6 +26,7 @@ func main() {
 	s, err := NewServer(&options)
 	if err != nil {
 		log.Critical("Failed to create server: %s", err)
+		return
 	}
 
 	s.Run()
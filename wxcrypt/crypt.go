@@ -0,0 +1,188 @@
+// Package wxcrypt implements encryption of messages exchanged with WeChat in
+// safe mode, as described in WeChat's message encryption document:
+//
+// message is prefixed with 16 random bytes and 4 bytes of its length in
+// network order, suffixed with AppID, padded with PKCS#7 to 32 bytes block,
+// encrypted with AES-256-CBC using EncodingAESKey as key and its first 16
+// bytes as IV, and encoded in base64
+//
+// msg_signature is SHA1 of token, timestamp, nonce and the encrypted message
+// sorted and concatenated
+package wxcrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrInvalidAESKey     = errors.New("Invalid EncodingAESKey")
+	ErrInvalidCiphertext = errors.New("Invalid encrypted message")
+	ErrInvalidSignature  = errors.New("Invalid msg_signature")
+	ErrAppIDMismatch     = errors.New("AppID of encrypted message mismatch")
+)
+
+const (
+	// WeChat pads to 32 bytes, not AES block size
+	padBlockSize = 32
+	randomSize   = 16
+)
+
+type Crypter struct {
+	token string
+	appID string
+	key   []byte
+}
+
+// encodingAESKey is the 43 characters key configured in MP console
+func NewCrypter(token, encodingAESKey, appID string) (*Crypter, error) {
+
+	if len(encodingAESKey) != 43 {
+		return nil, ErrInvalidAESKey
+	}
+	key, err := base64.StdEncoding.DecodeString(encodingAESKey + "=")
+	if err != nil || len(key) != 32 {
+		return nil, ErrInvalidAESKey
+	}
+
+	return &Crypter{
+		token: token,
+		appID: appID,
+		key:   key,
+	}, nil
+}
+
+// msg_signature of encrypted message
+func (c *Crypter) Signature(timestamp, nonce, encrypted string) string {
+	strs := []string{c.token, timestamp, nonce, encrypted}
+	sort.Strings(strs)
+
+	h := sha1.New()
+	h.Write([]byte(strings.Join(strs, "")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *Crypter) VerifySignature(msgSignature, timestamp, nonce, encrypted string) error {
+	expected := c.Signature(timestamp, nonce, encrypted)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(msgSignature))) != 1 {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// decrypt message encrypted by WeChat, AppID appended to the message must be
+// ours
+func (c *Crypter) Decrypt(encrypted string) ([]byte, error) {
+
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil || len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, ErrInvalidCiphertext
+	}
+
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, c.key[:aes.BlockSize]).CryptBlocks(plain, data)
+
+	plain, err = unpad(plain)
+	if err != nil {
+		return nil, err
+	}
+	if len(plain) < randomSize+4 {
+		return nil, ErrInvalidCiphertext
+	}
+
+	msgLen := int(binary.BigEndian.Uint32(plain[randomSize : randomSize+4]))
+	msgStart := randomSize + 4
+	if msgLen < 0 || msgStart+msgLen > len(plain) {
+		return nil, ErrInvalidCiphertext
+	}
+	msg := plain[msgStart : msgStart+msgLen]
+
+	if string(plain[msgStart+msgLen:]) != c.appID {
+		return nil, ErrAppIDMismatch
+	}
+
+	return msg, nil
+}
+
+// encrypt message to send to WeChat
+func (c *Crypter) Encrypt(msg []byte) (string, error) {
+
+	random := make([]byte, randomSize)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return c.encrypt(random, msg)
+}
+
+func (c *Crypter) encrypt(random []byte, msg []byte) (string, error) {
+
+	buf := bytes.NewBuffer(make([]byte, 0, randomSize+4+len(msg)+len(c.appID)+padBlockSize))
+	buf.Write(random)
+	binary.Write(buf, binary.BigEndian, uint32(len(msg)))
+	buf.Write(msg)
+	buf.WriteString(c.appID)
+	plain := pad(buf.Bytes())
+
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return "", err
+	}
+	data := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, c.key[:aes.BlockSize]).CryptBlocks(data, plain)
+
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+func pad(data []byte) []byte {
+	n := padBlockSize - len(data)%padBlockSize
+	return append(data, bytes.Repeat([]byte{byte(n)}, n)...)
+}
+
+func unpad(data []byte) ([]byte, error) {
+	n := int(data[len(data)-1])
+	if n < 1 || n > padBlockSize || n > len(data) {
+		return nil, ErrInvalidCiphertext
+	}
+	return data[:len(data)-n], nil
+}
+
+type cdata struct {
+	Text string `xml:",cdata"`
+}
+
+// encrypt message and wrap it in XML with msg_signature, to reply in safe mode
+func (c *Crypter) EncryptMessage(msg []byte, timestamp, nonce string) ([]byte, error) {
+
+	encrypted, err := c.Encrypt(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return xml.Marshal(&struct {
+		XMLName      xml.Name `xml:"xml"`
+		Encrypt      cdata    `xml:"Encrypt"`
+		MsgSignature cdata    `xml:"MsgSignature"`
+		TimeStamp    string   `xml:"TimeStamp"`
+		Nonce        cdata    `xml:"Nonce"`
+	}{
+		Encrypt:      cdata{encrypted},
+		MsgSignature: cdata{c.Signature(timestamp, nonce, encrypted)},
+		TimeStamp:    timestamp,
+		Nonce:        cdata{nonce},
+	})
+}
@@ -0,0 +1,166 @@
+package wxcrypt
+
+import (
+	"encoding/xml"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// test vectors of WeChat message encryption sample code
+const (
+	testToken          = "spamtest"
+	testEncodingAESKey = "abcdefghijklmnopqrstuvwxyz0123456789ABCDEFG"
+	testAppID          = "wx2c2769f8efd9abc2"
+	testTimestamp      = "1409735669"
+	testNonce          = "1320562132"
+	testMsgSignature   = "5d197aaffba7e9b25a30732f161a50dee96bd5fa"
+	testRandom         = "89465c840c5f116f"
+	testEncrypted      = "hyzAe4OzmOMbd6TvGdIOO6uBmdJoD0Fk53REIHvxYtJlE2B655HuD0m8KUePWB3+LrPXo87wzQ1QLvbeUgmBM4x6" +
+		"F8PGHQHFVAFmOD2LdJF9FrXpbUAh0B5GIItb52sn896wVsMSHGuPE328HnRGBcrS7C41IzDWyWNlZkyyXwon8T332jisa+h6" +
+		"tEDYsVticbSnyU8dKOIbgU6ux5VTjg3yt+WGzjlpKn6NPhRjpA912xMezR4kw6KWwMrCVKSVCZciVGCgavjIQ6X8tCOp3yZb" +
+		"Gpy0VxpAe+77TszTfRd5RJSVO/HTnifJpXgCSUdUue1v6h0EIBYYI1BD1DlD+C0CR8e6OewpusjZ4uBl9FyJvnhvQl+q5rv1" +
+		"ixrcpCumEPo5MJSgM9ehVsNPfUM669WuMyVWQLCzpu9GhglF2PE="
+	testPlain = "<xml><ToUserName><![CDATA[gh_10f6c3c3ac5a]]></ToUserName>\n" +
+		"<FromUserName><![CDATA[oyORnuP8q7ou2gfYjqLzSIWZf0rs]]></FromUserName>\n" +
+		"<CreateTime>1409735668</CreateTime>\n" +
+		"<MsgType><![CDATA[text]]></MsgType>\n" +
+		"<Content><![CDATA[abcdteT]]></Content>\n" +
+		"<MsgId>6054768590064713728</MsgId>\n" +
+		"</xml>"
+)
+
+func TestNewCrypter(t *testing.T) {
+
+	_, err := NewCrypter(testToken, testEncodingAESKey[1:], testAppID)
+	if !assert.Equal(t, ErrInvalidAESKey, err) {
+		return
+	}
+	_, err = NewCrypter(testToken, "!"+testEncodingAESKey[1:], testAppID)
+	if !assert.Equal(t, ErrInvalidAESKey, err) {
+		return
+	}
+}
+
+func TestSignature(t *testing.T) {
+
+	c, err := NewCrypter(testToken, testEncodingAESKey, testAppID)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	if !assert.Equal(t, testMsgSignature, c.Signature(testTimestamp, testNonce, testEncrypted)) {
+		return
+	}
+	if !assert.Nil(t, c.VerifySignature(testMsgSignature, testTimestamp, testNonce, testEncrypted)) {
+		return
+	}
+	err = c.VerifySignature(testMsgSignature, "1409735670", testNonce, testEncrypted)
+	if !assert.Equal(t, ErrInvalidSignature, err) {
+		return
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+
+	c, err := NewCrypter(testToken, testEncodingAESKey, testAppID)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	{
+		msg, err := c.Decrypt(testEncrypted)
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, testPlain, string(msg)) {
+			return
+		}
+	}
+
+	{
+		other, _ := NewCrypter(testToken, testEncodingAESKey, "wx0000000000000000")
+		_, err := other.Decrypt(testEncrypted)
+		if !assert.Equal(t, ErrAppIDMismatch, err) {
+			return
+		}
+	}
+
+	{
+		_, err := c.Decrypt(testEncrypted[4:])
+		if !assert.Equal(t, ErrInvalidCiphertext, err) {
+			return
+		}
+		_, err = c.Decrypt("")
+		if !assert.Equal(t, ErrInvalidCiphertext, err) {
+			return
+		}
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+
+	c, err := NewCrypter(testToken, testEncodingAESKey, testAppID)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	{
+		encrypted, err := c.encrypt([]byte(testRandom), []byte(testPlain))
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, testEncrypted, encrypted) {
+			return
+		}
+	}
+
+	{
+		encrypted, err := c.Encrypt([]byte("<xml>hello</xml>"))
+		if !assert.Nil(t, err) {
+			return
+		}
+		msg, err := c.Decrypt(encrypted)
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, "<xml>hello</xml>", string(msg)) {
+			return
+		}
+	}
+}
+
+func TestEncryptMessage(t *testing.T) {
+
+	c, err := NewCrypter(testToken, testEncodingAESKey, testAppID)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	data, err := c.EncryptMessage([]byte("<xml>hello</xml>"), testTimestamp, testNonce)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	envelope := struct {
+		Encrypt      string
+		MsgSignature string
+		TimeStamp    string
+		Nonce        string
+	}{}
+	if !assert.Nil(t, xml.Unmarshal(data, &envelope)) {
+		return
+	}
+	if !assert.Equal(t, testTimestamp, envelope.TimeStamp) || !assert.Equal(t, testNonce, envelope.Nonce) {
+		return
+	}
+	if !assert.Nil(t, c.VerifySignature(envelope.MsgSignature, testTimestamp, testNonce, envelope.Encrypt)) {
+		return
+	}
+	msg, err := c.Decrypt(envelope.Encrypt)
+	if !assert.Nil(t, err) {
+		return
+	}
+	if !assert.Equal(t, "<xml>hello</xml>", string(msg)) {
+		return
+	}
+}